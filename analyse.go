@@ -0,0 +1,65 @@
+package syn
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dlclark/regexp2"
+	"github.com/jeffwilliams/syn/internal/config"
+)
+
+// analyser determines how likely it is that some text is in the language of a lexer. It is
+// built from the <analyse> element of the lexer's config.
+type analyser struct {
+	first   bool
+	regexes []scoredRegex
+}
+
+type scoredRegex struct {
+	pattern *regexp2.Regexp
+	score   float32
+}
+
+func newAnalyser(cfg *config.Analyse) (*analyser, error) {
+	a := &analyser{first: cfg.First}
+	for i, r := range cfg.Regexes {
+		re, err := regexp2.Compile(r.Pattern, regexp2.None)
+		if err != nil {
+			return nil, fmt.Errorf("analyse regex index %d: %w", i, err)
+		}
+		re.MatchTimeout = time.Millisecond * 250
+		a.regexes = append(a.regexes, scoredRegex{pattern: re, score: r.Score})
+	}
+	return a, nil
+}
+
+// analyse returns a score between 0 and 1 for text.
+func (a *analyser) analyse(text []rune) float32 {
+	var score float32
+	for _, r := range a.regexes {
+		ok, err := r.pattern.MatchRunes(text)
+		if err != nil || !ok {
+			continue
+		}
+
+		if a.first {
+			return r.score
+		}
+		score += r.score
+	}
+
+	if score > 1 {
+		score = 1
+	}
+	return score
+}
+
+// AnalyseText returns a score between 0 and 1 that represents how likely it is that text is
+// in the language of this Lexer, based on the <analyse> element in the Lexer's definition.
+// It returns 0 if the Lexer has no <analyse> element.
+func (l *Lexer) AnalyseText(text []rune) float32 {
+	if l.analyser == nil {
+		return 0
+	}
+	return l.analyser.analyse(text)
+}
@@ -0,0 +1,125 @@
+package syn
+
+import (
+	"fmt"
+	"sync"
+)
+
+// RuleFunc lexes text that the patterns of rules can't describe. It is called by a rule with a <call> element
+// with the text from the current position to the end of the input, and returns the number of runes at the start
+// of text that it matches, or 0 if it doesn't match.
+//
+// toks are the tokens for the matched text. Their Start and End are positions in text, and their Value is
+// ignored. They must be in order and must not overlap. As with bygroups, text that no token covers is skipped.
+// action is the change to make to the state stack after the tokens have been returned.
+type RuleFunc func(text []rune, st *CallbackState) (n int, toks []Token, action CallbackAction)
+
+// CallbackAction is the change to the state stack that a RuleFunc asks for when it matches. The states
+// are popped first, and then the states in Push are pushed in order. An empty name in Push pushes
+// the current state again.
+type CallbackAction struct {
+	Pop  int
+	Push []string
+}
+
+// CallbackState is the state of the lexer that a RuleFunc is called in.
+type CallbackState struct {
+	stack *stack
+}
+
+// State returns the name of the current state.
+func (s *CallbackState) State() string {
+	return s.stack.Top().name
+}
+
+// States returns the names of the states on the stack, from the bottom to the top.
+func (s *CallbackState) States() []string {
+	names := make([]string, s.stack.Len())
+	for i, st := range s.stack.data {
+		names[i] = st.name
+	}
+	return names
+}
+
+// Variable returns the value of the variable called name that a push captured, as in {{$name}}.
+func (s *CallbackState) Variable(name string) (string, bool) {
+	return s.stack.variable(name)
+}
+
+var ruleFuncs = struct {
+	sync.RWMutex
+	m map[string]RuleFunc
+}{m: map[string]RuleFunc{}}
+
+// RegisterRuleFunc registers the RuleFunc f under name, so that lexers can call it using <call func="name"/>.
+// Registering a function with a name that is already registered replaces the old function. Functions must be
+// registered before the lexers that call them are loaded.
+func RegisterRuleFunc(name string, f RuleFunc) {
+	ruleFuncs.Lock()
+	defer ruleFuncs.Unlock()
+	ruleFuncs.m[name] = f
+}
+
+func lookupRuleFunc(name string) (RuleFunc, error) {
+	ruleFuncs.RLock()
+	defer ruleFuncs.RUnlock()
+	f, ok := ruleFuncs.m[name]
+	if !ok {
+		return nil, fmt.Errorf("The rule calls the function %s, which is not registered", name)
+	}
+	return f, nil
+}
+
+// call is the function called by a rule instead of matching a pattern.
+type call struct {
+	name string
+	f    RuleFunc
+}
+
+// match calls the function at the start of text. The match has a group for each token, and its tokens and
+// mutators are those returned by the function.
+func (c *call) match(text []rune, stk *stack) (*match, error) {
+	n, toks, action := c.f(text, &CallbackState{stack: stk})
+	if n <= 0 {
+		return nil, nil
+	}
+	if n > len(text) {
+		return nil, fmt.Errorf("The function %s matched %d runes, but only %d remain", c.name, n, len(text))
+	}
+
+	m := &match{
+		groups: make([]capture, 1, len(toks)+1),
+		call:   &callResult{types: make([]TokenType, len(toks))},
+	}
+	m.groups[0] = capture{start: 0, length: n}
+
+	end := 0
+	for i, tok := range toks {
+		if tok.Start < end || tok.End < tok.Start || tok.End > n {
+			return nil, fmt.Errorf("The function %s returned a token from %d to %d, which is out of order or outside the %d runes it matched",
+				c.name, tok.Start, tok.End, n)
+		}
+		end = tok.End
+		m.groups = append(m.groups, capture{start: tok.Start, length: tok.End - tok.Start})
+		m.call.types[i] = tok.Type
+	}
+
+	if action.Pop > 0 {
+		m.call.mutators = append(m.call.mutators, mutator{popDepth: action.Pop})
+	}
+	for _, name := range action.Push {
+		m.call.mutators = append(m.call.mutators, mutator{pushState: name, pushCurrent: name == ""})
+	}
+	return m, nil
+}
+
+func (c *call) String() string {
+	return fmt.Sprintf("call %s", c.name)
+}
+
+// callResult is the part of the result of the function of a call rule that is not in the groups of the match.
+type callResult struct {
+	// types are the types of the tokens for the groups of the match after group 0.
+	types    []TokenType
+	mutators []mutator
+}
@@ -0,0 +1,194 @@
+package syn
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// assignment matches a name, then spaces, then = and pushes the value state. A name followed by ( instead
+// of = is matched too, but then nothing is pushed.
+func assignment(text []rune, st *CallbackState) (int, []Token, CallbackAction) {
+	name := 0
+	for name < len(text) && unicode.IsLetter(text[name]) {
+		name++
+	}
+	eq := name
+	for eq < len(text) && text[eq] == ' ' {
+		eq++
+	}
+	if name == 0 || eq >= len(text) || (text[eq] != '=' && text[eq] != '(') {
+		return 0, nil, CallbackAction{}
+	}
+
+	if text[eq] == '(' {
+		toks := []Token{
+			{Type: NameVariable, Start: 0, End: name},
+			{Type: Punctuation, Start: eq, End: eq + 1},
+		}
+		return eq + 1, toks, CallbackAction{}
+	}
+
+	toks := []Token{
+		{Type: NameVariable, Start: 0, End: name},
+		{Type: Operator, Start: eq, End: eq + 1},
+	}
+	return eq + 1, toks, CallbackAction{Push: []string{"value"}}
+}
+
+func init() {
+	RegisterRuleFunc("test-assignment", assignment)
+}
+
+const callLexerDef = `<lexer>
+  <config>
+    <name>Call</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule>
+        <call func="test-assignment"/>
+      </rule>
+      <rule>
+        <call func="lua-long-string"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="value">
+      <rule pattern="\d+">
+        <token type="LiteralNumber"/>
+        <pop depth="1"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+func TestCall(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerFromXMLStrict(strings.NewReader(callLexerDef))
+	if err != nil {
+		t.Fatalf("Loading the lexer failed: %v", err)
+	}
+	assert.Empty(ValidateLexer(lex))
+
+	// The positions of the tokens are adjusted for the \r\n within the long string.
+	input := []rune("x  =1 [=[a\r\n]]b]=] y")
+	expected := []Token{
+		{Type: NameVariable, Value: []rune("x"), Start: 0, End: 1},
+		// The spaces between the tokens aren't emitted.
+		{Type: Operator, Value: []rune("="), Start: 3, End: 4},
+		{Type: LiteralNumber, Value: []rune("1"), Start: 4, End: 5},
+		{Type: Text, Value: []rune(" "), Start: 5, End: 6},
+		{Type: LiteralString, Value: []rune("[=[a\r\n]]b]=]"), Start: 6, End: 18},
+		{Type: Text, Value: []rune(" "), Start: 18, End: 19},
+		{Type: Name, Value: []rune("y"), Start: 19, End: 20},
+	}
+
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal(expected, tokens)
+
+	for i := 1; i < len(expected); i++ {
+		it := lex.Tokenise(input)
+
+		tokens, err := tokenizeAtMost(it, i)
+		assert.Nil(err)
+
+		state := it.State()
+		_, err = tokenize(it)
+		assert.Nil(err)
+		it.SetState(state)
+		assert.True(state.Equal(it.State()))
+
+		rest, err := tokenize(it)
+		assert.Nil(err)
+
+		assert.Equal(expected, append(tokens, rest...), "restoring state after %d tokens", i)
+	}
+
+	// Within the tokens of a call, the states differ if the function returned different token types or
+	// stack changes, even though the same rule matched. The iterator is used without the coalescer, which
+	// would read past the call.
+	call := []rune("x (1")
+	it := newIterator(call, lex.rules)
+	_, err = tokenizeAtMost(it, 1)
+	assert.Nil(err)
+	other := newIterator([]rune("x =1"), lex.rules)
+	_, err = tokenizeAtMost(other, 1)
+	assert.Nil(err)
+	assert.False(it.State().Equal(other.State()))
+
+	state := it.State()
+	it = newIterator(call, lex.rules)
+	it.SetState(state)
+	assert.True(state.Equal(it.State()))
+
+	rest, err := tokenize(it)
+	assert.Nil(err)
+	expected = []Token{
+		{Type: Punctuation, Value: []rune("("), Start: 2, End: 3},
+		{Type: Name, Value: []rune("1"), Start: 3, End: 4},
+	}
+	assert.Equal(expected, rest)
+}
+
+func TestBadCallIsRejected(t *testing.T) {
+	bad := strings.Replace(callLexerDef, `"test-assignment"`, `"no-such-function"`, 1)
+	_, err := NewLexerFromXML(strings.NewReader(bad))
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "no-such-function")
+	}
+
+	bad = strings.Replace(callLexerDef, `<call func="test-assignment"/>`, `<call func="test-assignment"/><token type="Name"/>`, 1)
+	_, err = NewLexerFromXML(strings.NewReader(bad))
+	assert.NotNil(t, err)
+}
+
+func TestRustRawString(t *testing.T) {
+	tests := []struct {
+		text string
+		n    int
+	}{
+		{text: `r"a\"x`, n: 5},
+		{text: `r#"a"b"#x`, n: 8},
+		{text: `br##"a"#"##`, n: 11},
+		{text: `r#"a"`, n: 0},
+		{text: `rx"a"`, n: 0},
+	}
+
+	for _, tc := range tests {
+		n, _, _ := rustRawString([]rune(tc.text), nil)
+		assert.Equal(t, tc.n, n, tc.text)
+	}
+}
+
+func TestLexerDefCall(t *testing.T) {
+	lex, err := NewLexerDef("Call").
+		State("root").
+		Rule(``, Call("rust-raw-string")).
+		Rule(`\w+`, Emit(Name)).
+		Build()
+	if err != nil {
+		t.Fatalf("Building lexer failed: %v", err)
+	}
+
+	tokens, err := tokenize(lex.Tokenise([]rune(`r#"a"#b`)))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	expected := []Token{
+		{Type: LiteralString, Value: []rune(`r#"a"#`), Start: 0, End: 6},
+		{Type: Name, Value: []rune("b"), Start: 6, End: 7},
+	}
+	assert.Equal(t, expected, tokens)
+}
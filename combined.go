@@ -0,0 +1,206 @@
+package syn
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dlclark/regexp2"
+)
+
+// combinedRules is the combined pattern of a run of consecutive rules of a state. The pattern of each rule is
+// wrapped in a group, and the groups are joined into one alternation, so that
+//
+//	a(b)  c  (d)(e)
+//
+// become \G(?:(?<r0>a(b))|(?<r1>c)|(?<r2>(d)(e))). Since the alternatives are tried in order, as the rules are,
+// the match is that of the first rule that matches, and which rule that is can be told by which of the outer
+// groups, numbered 1, 2, 3 and so on, took part in it. One match of the combined pattern replaces a match of
+// each rule that fails before it.
+//
+// The combined pattern is compiled with regexp2.ExplicitCapture, so that only the outer groups capture and
+// matches are cheap to make. The groups of the rule that matched, which bygroups needs, are found by matching
+// the rule's own pattern again at the same position, which is only done if it has groups. Keeping the groups of
+// all the rules in the combined pattern instead makes regexp2 build every one of them for each match, which costs
+// more than the second match; BenchmarkCombinedRules measures the difference to matching the rules one by one.
+type combinedRules struct {
+	re    *regexp2.Regexp
+	rules []rule
+}
+
+// combineRules combines the patterns of the rules of each state of the lexer, so that a state is matched
+// with fewer matches of regular expressions. It is done after the includes are resolved, so that the
+// included rules are combined with the rules around them.
+func (lb *lexerBuilder) combineRules() {
+	for name, st := range lb.lexer.rules.rules {
+		st.combined = combineRules(st.rules)
+		lb.lexer.rules.rules[name] = st
+	}
+}
+
+// combineRules combines the patterns of the runs of rules in rules that can be matched together. It returns
+// the combined patterns at the index of the first rule of each run, or nil if there are none. The rules that
+// can't be combined are matched on their own, and so are the rules of a run whose combined pattern doesn't compile.
+func combineRules(rules []rule) []*combinedRules {
+	var combined []*combinedRules
+	for i := 0; i < len(rules); {
+		if !canCombine(&rules[i]) {
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j < len(rules) && canCombine(&rules[j]) && rules[j].opts == rules[i].opts {
+			j++
+		}
+
+		if j-i > 1 {
+			c, err := newCombinedRules(rules[i:j])
+			if err == nil {
+				if combined == nil {
+					combined = make([]*combinedRules, len(rules))
+				}
+				combined[i] = c
+			}
+		}
+		i = j
+	}
+	return combined
+}
+
+func newCombinedRules(rules []rule) (*combinedRules, error) {
+	var b strings.Builder
+	for i := range rules {
+		if i > 0 {
+			b.WriteByte('|')
+		}
+		fmt.Fprintf(&b, "(?<r%d>%s)", i, rules[i].expr)
+	}
+
+	re, err := compilePattern(b.String(), rules[0].opts|regexp2.ExplicitCapture)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(re.GetGroupNumbers()) != len(rules)+1 {
+		return nil, fmt.Errorf("The combined pattern has %d groups rather than %d", len(re.GetGroupNumbers()), len(rules)+1)
+	}
+	return &combinedRules{re: re, rules: rules}, nil
+}
+
+// len returns the number of rules in the run.
+func (c *combinedRules) len() int {
+	return len(c.rules)
+}
+
+// match matches the combined pattern at index pos of text. It returns the match of the first rule of the run
+// that matches and the index of that rule in the run, or nil and -1 if none does.
+func (c *combinedRules) match(text []rune, pos int) (*match, int, error) {
+	m, err := c.re.FindRunesMatchStartingAt(text, pos)
+	if err != nil || m == nil || m.Index != pos {
+		return nil, -1, err
+	}
+
+	for i := range c.rules {
+		if len(m.GroupByNumber(i+1).Captures) == 0 {
+			continue
+		}
+
+		if c.rules[i].groupCount() > 1 {
+			res, err := c.rules[i].match(text, pos, nil)
+			return res, i, err
+		}
+		return &match{groups: []capture{{start: 0, length: m.Length}}}, i, nil
+	}
+	return nil, -1, nil
+}
+
+// canCombine returns true if the pattern of r can be combined with the patterns of other rules. Rules that
+// match words, delimited regions or calls have no pattern, and those whose patterns refer to captured variables
+// are compiled when they are matched.
+func canCombine(r *rule) bool {
+	if r.words != nil || r.delimited != nil || r.call != nil || r.pattern == nil {
+		return false
+	}
+	if r.captured != nil {
+		return false
+	}
+	return canCombinePattern(r.expr)
+}
+
+// canCombinePattern returns false if the pattern uses a feature whose meaning depends on where the pattern
+// is in a combined pattern: backreferences and conditionals, which refer to groups by number, named groups,
+// which are numbered after the other groups, and inline options like (?i) or (?x), which apply to the rest
+// of the enclosing group or change how the rest of the pattern is read.
+func canCombinePattern(pattern string) bool {
+	s := []rune(pattern)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] >= '1' && s[i+1] <= '9' || s[i+1] == 'k') {
+				return false
+			}
+			i++
+		case '[':
+			i = endOfClass(s, i) - 1
+		case '(':
+			if i+1 >= len(s) || s[i+1] != '?' {
+				continue
+			}
+			rest := string(s[i+2:])
+			switch {
+			case strings.HasPrefix(rest, "#"):
+				end := strings.IndexRune(rest, ')')
+				if end < 0 {
+					return false
+				}
+				i += 2 + len([]rune(rest[:end]))
+			case strings.HasPrefix(rest, ":"), strings.HasPrefix(rest, "="), strings.HasPrefix(rest, "!"),
+				strings.HasPrefix(rest, "<="), strings.HasPrefix(rest, "<!"), strings.HasPrefix(rest, ">"):
+			case isScopedOptionGroup(rest):
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isScopedOptionGroup returns true if rest, the text after (?, starts a group with options that apply only
+// within it, like (?i:...).
+func isScopedOptionGroup(rest string) bool {
+	i := strings.IndexFunc(rest, func(r rune) bool {
+		return !strings.ContainsRune("ims-", r)
+	})
+	return i > 0 && rest[i] == ':'
+}
+
+// endOfClass returns the index just after the character class that starts at s[start]. A class may end with
+// a nested class that is subtracted from it, as in [a-z-[aeiou]].
+func endOfClass(s []rune, start int) int {
+	i := start + 1
+	if i < len(s) && s[i] == '^' {
+		i++
+	}
+	// A ] right after the opening [ or [^ is a literal.
+	if i < len(s) && s[i] == ']' {
+		i++
+	}
+
+	depth := 1
+	for ; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			if s[i-1] == '-' {
+				depth++
+			}
+		case ']':
+			depth--
+			if depth == 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(s)
+}
@@ -0,0 +1,151 @@
+package syn
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanCombinePattern(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		expected bool
+	}{
+		{pattern: `\w+`, expected: true},
+		{pattern: `(a)(b)`, expected: true},
+		{pattern: `(?:a|b)c`, expected: true},
+		{pattern: `a(?=b)(?!c)(?<=d)(?<!e)(?>f)`, expected: true},
+		{pattern: `(?i:select)\b`, expected: true},
+		{pattern: `a(?#comment (?i))b`, expected: true},
+		{pattern: `[(?i)]+`, expected: true},
+		{pattern: `[]a(?]`, expected: true},
+		{pattern: `\(\?i\)`, expected: true},
+		{pattern: `(['"]).*?\1`, expected: false},
+		{pattern: `(?<q>['"]).*?\k<q>`, expected: false},
+		{pattern: `(?<name>a)`, expected: false},
+		{pattern: `(?i)select`, expected: false},
+		{pattern: `a(?x) b`, expected: false},
+		{pattern: `(?(a)b|c)`, expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.pattern, func(t *testing.T) {
+			assert.Equal(t, tc.expected, canCombinePattern(tc.pattern))
+		})
+	}
+}
+
+func TestCombinedRules(t *testing.T) {
+	assert := assert.New(t)
+
+	def := `<lexer>
+  <config>
+    <name>Combined</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="(if)(\s+)(\w+)">
+        <bygroups>
+          <token type="Keyword"/>
+          <token type="Text"/>
+          <token type="NameVariable"/>
+        </bygroups>
+      </rule>
+      <rule pattern="if|else">
+        <token type="KeywordReserved"/>
+      </rule>
+      <rule pattern="(?i)end">
+        <token type="KeywordDeclaration"/>
+      </rule>
+      <rule pattern="(\d+)(?:(\.)(\d+))?">
+        <bygroups>
+          <token type="LiteralNumberInteger"/>
+          <token type="Punctuation"/>
+          <token type="LiteralNumberInteger"/>
+        </bygroups>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	lex, err := NewLexerFromXMLStrict(strings.NewReader(def))
+	if err != nil {
+		t.Fatalf("Loading the lexer failed: %v", err)
+	}
+
+	// The rule with (?i) can't be combined, so the rules before it and the rules after it are two runs.
+	combined := lex.rules.rules["root"].combined
+	if assert.Len(combined, 6) {
+		assert.Equal(2, combined[0].len())
+		assert.Nil(combined[2])
+		assert.Equal(3, combined[3].len())
+	}
+
+	tokens, err := tokenize(lex.Tokenise([]rune("if x else END 1.5 y")))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	expected := []Token{
+		{Type: Keyword, Value: []rune("if"), Start: 0, End: 2},
+		{Type: Text, Value: []rune(" "), Start: 2, End: 3},
+		{Type: NameVariable, Value: []rune("x"), Start: 3, End: 4},
+		{Type: Text, Value: []rune(" "), Start: 4, End: 5},
+		{Type: KeywordReserved, Value: []rune("else"), Start: 5, End: 9},
+		{Type: Text, Value: []rune(" "), Start: 9, End: 10},
+		{Type: KeywordDeclaration, Value: []rune("END"), Start: 10, End: 13},
+		{Type: Text, Value: []rune(" "), Start: 13, End: 14},
+		{Type: LiteralNumberInteger, Value: []rune("1"), Start: 14, End: 15},
+		{Type: Punctuation, Value: []rune("."), Start: 15, End: 16},
+		{Type: LiteralNumberInteger, Value: []rune("5"), Start: 16, End: 17},
+		{Type: Text, Value: []rune(" "), Start: 17, End: 18},
+		{Type: Name, Value: []rune("y"), Start: 18, End: 19},
+	}
+	assert.Equal(expected, tokens)
+}
+
+// BenchmarkCombinedRules compares lexing with the combined patterns of the rules to matching the rules one by one.
+func BenchmarkCombinedRules(b *testing.B) {
+	src, err := os.ReadFile("lexer.go")
+	if err != nil {
+		b.Fatalf("Reading the input failed: %v", err)
+	}
+	input := []rune(string(src))
+
+	for _, name := range []string{"c", "go", "python", "javascript", "rust", "ruby", "bash", "markdown"} {
+		combined, err := NewLexerFromXMLFile("lexers/embedded/" + name + ".xml")
+		if err != nil {
+			b.Fatalf("Creating lexer failed: %v", err)
+		}
+		separate, err := NewLexerFromXMLFile("lexers/embedded/" + name + ".xml")
+		if err != nil {
+			b.Fatalf("Creating lexer failed: %v", err)
+		}
+		// Matching the rules of the states one by one is what was done before the rules were combined.
+		for stateName, st := range separate.rules.rules {
+			st.combined = nil
+			separate.rules.rules[stateName] = st
+		}
+
+		for _, bc := range []struct {
+			name string
+			lex  *Lexer
+		}{{"combined", combined}, {"separate", separate}} {
+			b.Run(name+"/"+bc.name, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					_, err := tokenize(bc.lex.Tokenise(input))
+					if err != nil {
+						b.Fatalf("Tokenizing returned error: %v\n", err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package syn
+
+import (
+	"encoding/xml"
+	"fmt"
+
+	"github.com/jeffwilliams/syn/internal/config"
+)
+
+// LexerDef is used to define a Lexer in Go code rather than in XML. The methods of LexerDef can be chained:
+//
+//	lexer, err := syn.NewLexerDef("MyLang").
+//		State("root").
+//		Rule(`"`, syn.Emit(syn.String), syn.Push("string")).
+//		Rule(`\w+`, syn.Emit(syn.Name)).
+//		Rule(`\s+`, syn.Emit(syn.Text)).
+//		State("string").
+//		Rule(`[^"]+`, syn.Emit(syn.String)).
+//		Rule(`"`, syn.Emit(syn.String), syn.Pop(1)).
+//		Build()
+//
+// The definition is validated in the same way as an XML definition when Build is called.
+type LexerDef struct {
+	cfg config.Lexer
+	// state is the index of the state that rules are added to, or -1 if no state was started.
+	state int
+	err   error
+}
+
+// NewLexerDef starts the definition of a lexer with the given name.
+func NewLexerDef(name string) *LexerDef {
+	d := &LexerDef{state: -1}
+	d.cfg.XMLName = xml.Name{Local: "lexer"}
+	d.cfg.Config.Name = name
+	return d
+}
+
+// Alias adds aliases for the lexer.
+func (d *LexerDef) Alias(aliases ...string) *LexerDef {
+	d.cfg.Config.Aliases = append(d.cfg.Config.Aliases, aliases...)
+	return d
+}
+
+// Filename adds filename globs that the lexer handles.
+func (d *LexerDef) Filename(globs ...string) *LexerDef {
+	d.cfg.Config.Filenames = append(d.cfg.Config.Filenames, globs...)
+	return d
+}
+
+// MimeType adds MIME types that the lexer handles.
+func (d *LexerDef) MimeType(types ...string) *LexerDef {
+	d.cfg.Config.MimeTypes = append(d.cfg.Config.MimeTypes, types...)
+	return d
+}
+
+// Priority sets the priority of the lexer when more than one lexer matches a filename or MIME type.
+func (d *LexerDef) Priority(p float32) *LexerDef {
+	d.cfg.Config.Priority = p
+	return d
+}
+
+// CaseInsensitive makes the patterns of all rules case insensitive.
+func (d *LexerDef) CaseInsensitive() *LexerDef {
+	d.cfg.Config.CaseInsensitive = true
+	return d
+}
+
+// DotAll makes . match newlines in the patterns of all rules.
+func (d *LexerDef) DotAll() *LexerDef {
+	d.cfg.Config.DotAll = true
+	return d
+}
+
+// NotMultiline makes ^ and $ match only at the beginning and end of the text in the patterns of all rules.
+func (d *LexerDef) NotMultiline() *LexerDef {
+	d.cfg.Config.NotMultiline = true
+	return d
+}
+
+// EnsureNL makes the lexer behave as if the text ends in a newline.
+func (d *LexerDef) EnsureNL() *LexerDef {
+	d.cfg.Config.EnsureNL = true
+	return d
+}
+
+// Variable defines a variable that patterns can refer to as {{name}}. The reference is replaced by value,
+// which may itself refer to other variables.
+func (d *LexerDef) Variable(name, value string) *LexerDef {
+	d.cfg.Variables = append(d.cfg.Variables, config.Var{Name: name, Value: value})
+	return d
+}
+
+// Option declares an option of the lexer with the given default value. Rules that are only used for some
+// values of the option are added using the If action, and Lexer.WithOptions makes a lexer with other values.
+func (d *LexerDef) Option(name, def string) *LexerDef {
+	d.cfg.Options = append(d.cfg.Options, config.Option{Name: name, Default: def})
+	return d
+}
+
+// State starts a new state with the given name. The rules added after this call belong to the state.
+// If the state already exists, rules are appended to it.
+func (d *LexerDef) State(name string) *LexerDef {
+	for i, s := range d.cfg.Rules.States {
+		if s.Name == name {
+			d.state = i
+			return d
+		}
+	}
+
+	d.cfg.Rules.States = append(d.cfg.Rules.States, config.State{Name: name})
+	d.state = len(d.cfg.Rules.States) - 1
+	return d
+}
+
+// Rule adds a rule to the current state. When the pattern matches at the current position
+// in the text the actions are performed.
+func (d *LexerDef) Rule(pattern string, actions ...RuleAction) *LexerDef {
+	if d.state < 0 {
+		d.setErr(fmt.Errorf("The rule with pattern '%s' is not within a state", pattern))
+		return d
+	}
+
+	rd := ruleDef{rule: config.Rule{Pattern: pattern}}
+	for _, a := range actions {
+		a.applyToRule(&rd)
+	}
+	rd.finish()
+
+	st := &d.cfg.Rules.States[d.state]
+	st.Rules = append(st.Rules, rd.rule)
+	return d
+}
+
+// Include adds a rule to the current state that includes all the rules of the named state.
+func (d *LexerDef) Include(state string) *LexerDef {
+	return d.Rule("", Include(state))
+}
+
+// Build validates the definition and creates the Lexer.
+func (d *LexerDef) Build() (*Lexer, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+
+	bld := newLexerBuilder(d.config())
+	return bld.Build()
+}
+
+// config returns a copy of the lexer configuration, so that later changes to the definition don't
+// affect a Lexer built from it.
+func (d *LexerDef) config() *config.Lexer {
+	cfg := d.cfg
+	cfg.Variables = append([]config.Var(nil), d.cfg.Variables...)
+	cfg.Options = append([]config.Option(nil), d.cfg.Options...)
+	cfg.Rules.States = make([]config.State, len(d.cfg.Rules.States))
+	for i, s := range d.cfg.Rules.States {
+		s.Rules = append([]config.Rule(nil), s.Rules...)
+		cfg.Rules.States[i] = s
+	}
+	return &cfg
+}
+
+func (d *LexerDef) setErr(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// ruleDef is a rule being defined by a LexerDef.
+type ruleDef struct {
+	rule     config.Rule
+	mutators []config.Mutator
+}
+
+// finish sets the push and pop of the rule. A single push or pop is set directly on the rule, while
+// more than one is set as a mutators element.
+func (rd *ruleDef) finish() {
+	if len(rd.mutators) == 0 {
+		return
+	}
+
+	if len(rd.mutators) == 1 {
+		switch v := rd.mutators[0].V.(type) {
+		case *config.Push:
+			rd.rule.Push = v
+		case *config.Pop:
+			rd.rule.Pop = v
+		}
+		return
+	}
+
+	rd.rule.Mutators = &config.Mutators{Mutators: rd.mutators}
+}
+
+// RuleAction is an action performed when a rule matches.
+type RuleAction interface {
+	applyToRule(rd *ruleDef)
+}
+
+// GroupAction is an action performed for one capture group of a rule's match. See ByGroups.
+type GroupAction interface {
+	groupElement() config.ByGroupsElement
+}
+
+// Action is an action that may be used either as a RuleAction or a GroupAction.
+type Action interface {
+	RuleAction
+	GroupAction
+}
+
+type ruleActionFunc func(rd *ruleDef)
+
+func (f ruleActionFunc) applyToRule(rd *ruleDef) {
+	f(rd)
+}
+
+// Emit returns an action that emits a token of the given type. When used as a RuleAction the token covers
+// the entire match, and when used as a GroupAction it covers the group.
+func Emit(typ TokenType) Action {
+	return emitAction{typ}
+}
+
+type emitAction struct {
+	typ TokenType
+}
+
+func (e emitAction) applyToRule(rd *ruleDef) {
+	rd.rule.Token = &config.Token{Type: e.typ.String()}
+}
+
+func (e emitAction) groupElement() config.ByGroupsElement {
+	return config.ByGroupsElement{V: &config.Token{Type: e.typ.String()}}
+}
+
+// Push returns an action that pushes the named states onto the state stack in order. If no states
+// are given, the current state is pushed again.
+func Push(states ...string) RuleAction {
+	return ruleActionFunc(func(rd *ruleDef) {
+		if len(states) == 0 {
+			rd.mutators = append(rd.mutators, config.Mutator{V: &config.Push{}})
+			return
+		}
+
+		for _, s := range states {
+			rd.mutators = append(rd.mutators, config.Mutator{V: &config.Push{State: s}})
+		}
+	})
+}
+
+// PushCapture returns an action that pushes the named state and stores the text of the numbered group of
+// the match in the variable of the pushed state called variable. Patterns of rules refer to the variable
+// as {{$variable}} while the state is on the stack. If state is empty, the current state is pushed again.
+func PushCapture(state, variable string, group int) RuleAction {
+	return ruleActionFunc(func(rd *ruleDef) {
+		rd.mutators = append(rd.mutators, config.Mutator{V: &config.Push{State: state, Capture: variable, Group: group}})
+	})
+}
+
+// Pop returns an action that pops depth states from the state stack. Push and Pop actions are
+// performed in the order they are passed to Rule.
+func Pop(depth int) RuleAction {
+	return ruleActionFunc(func(rd *ruleDef) {
+		rd.mutators = append(rd.mutators, config.Mutator{V: &config.Pop{Depth: depth}})
+	})
+}
+
+// Include returns an action that makes the rule include all the rules of the named state.
+// The rule must have no pattern.
+func Include(state string) RuleAction {
+	return ruleActionFunc(func(rd *ruleDef) {
+		rd.rule.Include = &config.Include{State: state}
+	})
+}
+
+// Call returns an action that makes the rule call the RuleFunc registered under name instead of
+// matching a pattern. The rule must have no pattern and no other actions.
+func Call(name string) RuleAction {
+	return ruleActionFunc(func(rd *ruleDef) {
+		rd.rule.Call = &config.Call{Func: name}
+	})
+}
+
+// If returns an action that makes the rule part of the lexer only when the condition on the options of the
+// lexer holds. The condition is of the form option=value or option!=value, where value may be several
+// values separated by |, as in dialect=mysql|tsql.
+func If(condition string) RuleAction {
+	return ruleActionFunc(func(rd *ruleDef) {
+		rd.rule.If = condition
+	})
+}
+
+// Combined returns an action that pushes a new state made by combining the rules of the named states.
+func Combined(states ...string) RuleAction {
+	return ruleActionFunc(func(rd *ruleDef) {
+		rd.rule.Combined = &config.Combined{States: states}
+	})
+}
+
+// ByGroups returns an action that performs one GroupAction for each capture group of the match.
+func ByGroups(actions ...GroupAction) RuleAction {
+	return ruleActionFunc(func(rd *ruleDef) {
+		bg := &config.ByGroups{}
+		for _, a := range actions {
+			bg.ByGroupsElements = append(bg.ByGroupsElements, a.groupElement())
+		}
+		rd.rule.ByGroups = bg
+	})
+}
+
+// UsingSelf returns an action that lexes the text with this lexer, starting in the named state.
+func UsingSelf(state string) Action {
+	return usingSelfAction{state}
+}
+
+type usingSelfAction struct {
+	state string
+}
+
+func (u usingSelfAction) applyToRule(rd *ruleDef) {
+	rd.rule.UsingSelf = &config.UsingSelf{State: u.state}
+}
+
+func (u usingSelfAction) groupElement() config.ByGroupsElement {
+	return config.ByGroupsElement{V: &config.UsingSelf{State: u.state}}
+}
+
+// Using returns an action that lexes the text with the named lexer from the registry of this lexer.
+func Using(lexer string) Action {
+	return usingAction{lexer}
+}
+
+type usingAction struct {
+	lexer string
+}
+
+func (u usingAction) applyToRule(rd *ruleDef) {
+	rd.rule.Using = &config.Using{Lexer: u.lexer}
+}
+
+func (u usingAction) groupElement() config.ByGroupsElement {
+	return config.ByGroupsElement{V: &config.Using{Lexer: u.lexer}}
+}
+
+// UsingByGroup returns a GroupAction that lexes the group with the lexer named by the text of the group
+// numbered sublexerNameGroup. If there is no such lexer the group is emitted as a token of type fallback.
+func UsingByGroup(sublexerNameGroup int, fallback TokenType) GroupAction {
+	return usingByGroupAction{sublexerNameGroup, fallback}
+}
+
+type usingByGroupAction struct {
+	sublexerNameGroup int
+	fallback          TokenType
+}
+
+func (u usingByGroupAction) groupElement() config.ByGroupsElement {
+	return config.ByGroupsElement{V: &config.UsingByGroup{
+		SublexerNameGroup: u.sublexerNameGroup,
+		Fallback:          u.fallback.String(),
+	}}
+}
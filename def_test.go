@@ -0,0 +1,236 @@
+package syn
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLexerDef(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerDef("MyLang").
+		Alias("mylang").
+		Filename("*.my").
+		CaseInsensitive().
+		State("root").
+		Include("keywords").
+		Rule(`"`, Emit(String), Push("string")).
+		Rule(`(\w+)(=)`, ByGroups(Emit(NameAttribute), Emit(Operator))).
+		Rule(`\w+`, Emit(Name)).
+		Rule(`\s+`, Emit(Text)).
+		State("keywords").
+		Rule(`(if|else)\b`, Emit(Keyword)).
+		State("string").
+		Rule(`[^"]+`, Emit(String)).
+		Rule(`"`, Emit(String), Pop(1)).
+		Build()
+	if err != nil {
+		t.Fatalf("Building lexer failed: %v", err)
+	}
+
+	input := []rune(`IF a=b "x"`)
+	expected := []Token{
+		{Type: Keyword, Value: []rune("IF"), Start: 0, End: 2},
+		{Type: Text, Value: []rune(" "), Start: 2, End: 3},
+		{Type: NameAttribute, Value: []rune("a"), Start: 3, End: 4},
+		{Type: Operator, Value: []rune("="), Start: 4, End: 5},
+		{Type: Name, Value: []rune("b"), Start: 5, End: 6},
+		{Type: Text, Value: []rune(" "), Start: 6, End: 7},
+		{Type: String, Value: []rune(`"x"`), Start: 7, End: 10},
+	}
+
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	dumpTokens(t, tokens)
+	assert.Equal(expected, tokens)
+
+	// The definition can be written as XML and read back.
+	var buf bytes.Buffer
+	assert.Nil(lex.WriteXML(&buf))
+	lex2, err := NewLexerFromXML(&buf)
+	assert.Nil(err)
+	assert.Equal(lex.cfg(), lex2.cfg())
+}
+
+func TestLexerDefMutators(t *testing.T) {
+	d := NewLexerDef("MyLang").
+		State("root").
+		Rule(`\(`, Emit(Punctuation), Push()).
+		Rule(`\[`, Emit(Punctuation), Push("a", "b")).
+		Rule(`;`, Emit(Punctuation), Pop(1), Push("a")).
+		State("a").
+		State("b")
+
+	lex, err := d.Build()
+	if err != nil {
+		t.Fatalf("Building lexer failed: %v", err)
+	}
+
+	rules := lex.cfg().Rules.States[0].Rules
+	assert := assert.New(t)
+	assert.NotNil(rules[0].Push)
+	assert.Nil(rules[0].Mutators)
+	assert.Nil(rules[1].Push)
+	assert.Len(rules[1].Mutators.Mutators, 2)
+	assert.Nil(rules[2].Pop)
+	assert.Len(rules[2].Mutators.Mutators, 2)
+}
+
+func TestLexerDefPushCapture(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerDef("Quotes").
+		State("root").
+		Rule(`(q)(.)`, Emit(Punctuation), PushCapture("quoted", "end", 2)).
+		Rule(`\w+`, Emit(Name)).
+		State("quoted").
+		Rule(`{{$end}}`, Emit(Punctuation), Pop(1)).
+		Rule(`.`, Emit(LiteralString)).
+		Build()
+	if err != nil {
+		t.Fatalf("Building lexer failed: %v", err)
+	}
+
+	input := []rune(`q|a(b)|x`)
+	expected := []Token{
+		{Type: Punctuation, Value: []rune("q|"), Start: 0, End: 2},
+		{Type: LiteralString, Value: []rune("a(b)"), Start: 2, End: 6},
+		{Type: Punctuation, Value: []rune("|"), Start: 6, End: 7},
+		{Type: Name, Value: []rune("x"), Start: 7, End: 8},
+	}
+
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal(expected, tokens)
+}
+
+func TestLexerDefValidation(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := NewLexerDef("NoRoot").
+		State("other").
+		Rule(`x`, Emit(Text)).
+		Build()
+	assert.NotNil(err)
+
+	_, err = NewLexerDef("MissingPush").
+		State("root").
+		Rule(`x`, Emit(Text), Push("missing")).
+		Build()
+	assert.NotNil(err)
+
+	_, err = NewLexerDef("NoState").
+		Rule(`x`, Emit(Text)).
+		State("root").
+		Build()
+	assert.NotNil(err)
+
+	_, err = NewLexerDef("BadPattern").
+		State("root").
+		Rule(`(x`, Emit(Text)).
+		Build()
+	assert.NotNil(err)
+
+	_, err = NewLexerDef("BadToken").
+		State("root").
+		Rule(`x`, Emit(TokenType(123456))).
+		Build()
+	assert.NotNil(err)
+}
+
+func TestLexerDefVariables(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerDef("Vars").
+		Variable("ident", `[A-Za-z_]\w*`).
+		Variable("call", `{{ident}}(?=\()`).
+		State("root").
+		Rule(`{{call}}`, Emit(NameFunction)).
+		Rule(`{{ident}}`, Emit(Name)).
+		Rule(`\{{1,2}|[()]`, Emit(Punctuation)).
+		Build()
+	if err != nil {
+		t.Fatalf("Building lexer failed: %v", err)
+	}
+
+	input := []rune(`f(x){{`)
+	expected := []Token{
+		{Type: NameFunction, Value: []rune("f"), Start: 0, End: 1},
+		{Type: Punctuation, Value: []rune("("), Start: 1, End: 2},
+		{Type: Name, Value: []rune("x"), Start: 2, End: 3},
+		{Type: Punctuation, Value: []rune("){{"), Start: 3, End: 6},
+	}
+
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal(expected, tokens)
+
+	_, err = NewLexerDef("Undefined").
+		Variable("other", `x`).
+		State("root").
+		Rule(`{{ident}}`, Emit(Name)).
+		Build()
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "variable ident, which is not defined")
+	}
+
+	_, err = NewLexerDef("Recursive").
+		Variable("a", `x{{b}}`).
+		Variable("b", `y{{a}}`).
+		State("root").
+		Rule(`{{a}}`, Emit(Name)).
+		Build()
+	if assert.NotNil(err) {
+		assert.Contains(err.Error(), "a -> b -> a")
+	}
+
+	// In a lexer without variables, what looks like a reference to one is matched literally.
+	lex, err = NewLexerDef("NoVars").
+		State("root").
+		Rule(`{{x}}`, Emit(NameVariable)).
+		Build()
+	if err != nil {
+		t.Fatalf("Building lexer failed: %v", err)
+	}
+
+	tokens, err = tokenize(lex.Tokenise([]rune(`{{x}}`)))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal([]Token{{Type: NameVariable, Value: []rune(`{{x}}`), Start: 0, End: 5}}, tokens)
+}
+
+func TestLexerDefOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerDef("Options").
+		Option("version", "3").
+		State("root").
+		Rule(`print\b`, Emit(Keyword), If("version=2")).
+		Rule(`\w+`, Emit(Name)).
+		Rule(`\s+`, Emit(Text)).
+		Build()
+	if err != nil {
+		t.Fatalf("Building lexer failed: %v", err)
+	}
+
+	tokens, err := tokenize(lex.Tokenise([]rune("print")))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal([]Token{{Type: Name, Value: []rune("print"), Start: 0, End: 5}}, tokens)
+
+	tokens, err = tokenize(lex.WithOptions(map[string]string{"version": "2"}).Tokenise([]rune("print")))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal([]Token{{Type: Keyword, Value: []rune("print"), Start: 0, End: 5}}, tokens)
+}
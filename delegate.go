@@ -0,0 +1,251 @@
+package syn
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// delegation holds the two lexers used by a delegating Lexer.
+type delegation struct {
+	root     *Lexer
+	language *Lexer
+}
+
+// NewDelegatingLexer creates a Lexer for template languages that are embedded in a host language,
+// such as Go templates or Jinja within HTML.
+//
+// The text is first lexed using the language lexer, which is the lexer for the template language.
+// All the runs of text it emits as Other tokens are then joined and lexed as one continuous stream
+// using the root lexer, which is the lexer for the host language. Finally the two token streams are merged
+// in offset order.
+//
+// The returned Lexer takes its name, aliases and other configuration from the language lexer.
+//
+// Since the root lexer needs all of the Other text, an Iterator of the returned Lexer lexes the whole text
+// with both lexers before returning its first token, including when a state is restored into a new Iterator
+// with SetState. Restoring a state for each line of a text, as an editor might, therefore takes time
+// quadratic in the length of the text.
+func NewDelegatingLexer(root, language *Lexer) *Lexer {
+	return &Lexer{
+		config: language.config,
+		rules:  newRules(),
+		delegate: &delegation{
+			root:     root,
+			language: language,
+		},
+	}
+}
+
+func (d *delegation) tokenise(text []rune) Iterator {
+	return &delegatingIterator{
+		text:       text,
+		delegation: d,
+	}
+}
+
+// delegatingIterator is the Iterator for a delegating Lexer. Since the root lexer must lex all
+// the Other text as one stream, the delegatingIterator lexes the entire text when Next is first called
+// and then iterates over the merged tokens.
+type delegatingIterator struct {
+	text       []rune
+	delegation *delegation
+	tokens     []Token
+	lexed      bool
+	// index is the index in tokens of the next token to return
+	index int
+}
+
+// otherRun is a run of text that the language lexer emitted as Other tokens.
+type otherRun struct {
+	// start and end are the bounds of the run in the text being lexed
+	start, end int
+	// joinedStart is the start of the run in the text formed by joining all the runs.
+	joinedStart int
+}
+
+func (r otherRun) length() int {
+	return r.end - r.start
+}
+
+func (it *delegatingIterator) Next() (tok Token, err error) {
+	if !it.lexed {
+		err = it.lex()
+		if err != nil {
+			return
+		}
+	}
+
+	if it.index >= len(it.tokens) {
+		return Token{Type: EOFType}, nil
+	}
+
+	tok = it.tokens[it.index]
+	it.index++
+	return
+}
+
+func (it *delegatingIterator) lex() error {
+	langTokens, err := tokenizeAll(it.delegation.language.Tokenise(it.text))
+	if err != nil {
+		return err
+	}
+
+	var joined []rune
+	var runs []otherRun
+	for _, tok := range langTokens {
+		if tok.Type != Other {
+			continue
+		}
+		if len(runs) > 0 && runs[len(runs)-1].end == tok.Start {
+			runs[len(runs)-1].end = tok.End
+		} else {
+			runs = append(runs, otherRun{start: tok.Start, end: tok.End, joinedStart: len(joined)})
+		}
+		joined = append(joined, it.text[tok.Start:tok.End]...)
+	}
+
+	rootTokens, err := tokenizeAll(it.delegation.root.Tokenise(joined))
+	if err != nil {
+		return err
+	}
+
+	it.tokens = it.merge(langTokens, runs, rootTokens)
+	it.lexed = true
+	return nil
+}
+
+// merge replaces each run of Other tokens in langTokens with the rootTokens that lie within
+// that run, split at the run boundaries and moved to their offsets in the text.
+func (it *delegatingIterator) merge(langTokens []Token, runs []otherRun, rootTokens []Token) []Token {
+	merged := make([]Token, 0, len(langTokens)+len(rootTokens))
+
+	r := 0
+	j := 0
+	for _, tok := range langTokens {
+		if tok.Type != Other {
+			merged = append(merged, tok)
+			continue
+		}
+
+		if r >= len(runs) || tok.Start != runs[r].start {
+			// Not the first token of a run; the whole run was already emitted.
+			continue
+		}
+
+		run := runs[r]
+		joinedEnd := run.joinedStart + run.length()
+		lastRun := r == len(runs)-1
+		for ; j < len(rootTokens); j++ {
+			rt := rootTokens[j]
+			if rt.Start > joinedEnd || (rt.Start == joinedEnd && (rt.Length() > 0 || !lastRun)) {
+				break
+			}
+
+			start, end := rt.Start, rt.End
+			if end > joinedEnd {
+				end = joinedEnd
+			}
+
+			delta := run.start - run.joinedStart
+			merged = append(merged, Token{
+				Type:  rt.Type,
+				Value: it.text[start+delta : end+delta],
+				Start: start + delta,
+				End:   end + delta,
+			})
+
+			if rt.End > joinedEnd {
+				// The token continues into the next run. Keep the rest of it for then.
+				rootTokens[j].Start = joinedEnd
+				break
+			}
+		}
+		r++
+	}
+
+	return merged
+}
+
+// tokenizeAll returns all the tokens that it produces up until the end of the text.
+func tokenizeAll(it Iterator) (tokens []Token, err error) {
+	for {
+		var tok Token
+		tok, err = it.Next()
+		if err != nil || tok.Type == EOFType {
+			return
+		}
+		tokens = append(tokens, tok)
+	}
+}
+
+func (it *delegatingIterator) State() IteratorState {
+	if !it.lexed {
+		// Nothing has been returned yet.
+		return &delegatingState{}
+	}
+
+	state := &delegatingState{index: len(it.text)}
+	if it.index < len(it.tokens) {
+		state.index = it.tokens[it.index].Start
+	}
+
+	// Empty tokens share their start with the token after them.
+	for i := it.index - 1; i >= 0 && it.tokens[i].Start == state.index; i-- {
+		state.skip++
+	}
+	return state
+}
+
+func (it *delegatingIterator) SetState(s IteratorState) {
+	state := s.(*delegatingState)
+
+	if !it.lexed {
+		// Errors are reported again when Next is called.
+		if it.lex() != nil {
+			return
+		}
+	}
+
+	it.index = sort.Search(len(it.tokens), func(i int) bool {
+		return it.tokens[i].Start >= state.index
+	})
+	it.index += state.skip
+	if it.index > len(it.tokens) {
+		it.index = len(it.tokens)
+	}
+}
+
+// delegatingState is the IteratorState of a delegating Lexer's Iterator.
+type delegatingState struct {
+	// index is the index in the text of the start of the next token to be returned.
+	index int
+	// skip is the number of tokens starting at index that were already returned.
+	skip int
+}
+
+func (s delegatingState) Equal(o IteratorState) bool {
+	other, ok := o.(*delegatingState)
+	if !ok {
+		return false
+	}
+	return s.index == other.index && s.skip == other.skip
+}
+
+func (s *delegatingState) SetIndex(i int) {
+	s.index = i
+}
+
+func (s *delegatingState) AddToIndex(i int) {
+	s.index += i
+}
+
+func (s delegatingState) String() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "delegatingState: \n")
+	fmt.Fprintf(&buf, "  index: %d\n", s.index)
+	fmt.Fprintf(&buf, "  skip: %d\n", s.skip)
+
+	return buf.String()
+}
@@ -0,0 +1,111 @@
+package syn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelegatingLexer(t *testing.T) {
+	host := `
+<lexer>
+  <config>
+    <name>Host</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="&#34;">
+        <token type="LiteralString"/>
+        <push state="string"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+      <rule pattern="=">
+        <token type="Operator"/>
+      </rule>
+    </state>
+    <state name="string">
+      <rule pattern="[^&#34;]+">
+        <token type="LiteralString"/>
+      </rule>
+      <rule pattern="&#34;">
+        <token type="LiteralString"/>
+        <pop depth="1"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	assert := assert.New(t)
+
+	root, err := NewLexerFromXML(strings.NewReader(host))
+	if err != nil {
+		t.Fatalf("Creating lexer failed: %v", err)
+	}
+
+	language, err := NewLexerFromXMLFile("lexers/embedded/handlebars.xml")
+	if err != nil {
+		t.Fatalf("Creating lexer failed: %v", err)
+	}
+
+	lex := NewDelegatingLexer(root, language)
+	assert.Equal("Handlebars", lex.cfg().Config.Name)
+
+	// The string is split by the template tag, but the host lexer sees it as one string.
+	input := []rune(`a = "x{{v}}y" b`)
+	expected := []Token{
+		{Type: Name, Value: []rune("a"), Start: 0, End: 1},
+		{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+		{Type: Operator, Value: []rune("="), Start: 2, End: 3},
+		{Type: Text, Value: []rune(" "), Start: 3, End: 4},
+		{Type: LiteralString, Value: []rune(`"x`), Start: 4, End: 6},
+		{Type: CommentPreproc, Value: []rune("{{"), Start: 6, End: 8},
+		{Type: Text, Value: []rune(""), Start: 8, End: 8},
+		{Type: NameVariable, Value: []rune("v"), Start: 8, End: 9},
+		{Type: CommentPreproc, Value: []rune("}}"), Start: 9, End: 11},
+		{Type: LiteralString, Value: []rune(`y"`), Start: 11, End: 13},
+		{Type: Text, Value: []rune(" "), Start: 13, End: 14},
+		{Type: Name, Value: []rune("b"), Start: 14, End: 15},
+	}
+
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	dumpTokens(t, tokens)
+	assert.Equal(expected, tokens)
+
+	for i := 1; i < len(expected); i++ {
+		it := lex.Tokenise(input)
+
+		tokens, err := tokenizeAtMost(it, i)
+		assert.Nil(err)
+
+		state := it.State()
+		_, err = tokenize(it)
+		assert.Nil(err)
+		assert.False(state.Equal(it.State()))
+		it.SetState(state)
+		assert.True(state.Equal(it.State()))
+
+		rest, err := tokenize(it)
+		assert.Nil(err)
+
+		assert.Equal(expected, append(tokens, rest...), "restoring state after %d tokens", i)
+	}
+
+	// A state saved before the first token restores to the start of the text.
+	state := lex.Tokenise(input).State()
+	it := lex.Tokenise(input)
+	it.SetState(state)
+	assert.True(state.Equal(it.State()))
+
+	tokens, err = tokenize(it)
+	assert.Nil(err)
+	assert.Equal(expected, tokens)
+}
@@ -0,0 +1,103 @@
+package syn
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/jeffwilliams/syn/internal/config"
+)
+
+// delimited matches a region of text that starts with an open delimiter and ends with a close delimiter,
+// like a block comment. Rather than matching rules within the region, the iterator scans it directly. It
+// emits a token for each line of the region, so that the state of the iterator can be saved within it.
+type delimited struct {
+	open, close []rune
+	nested      bool
+	// escape is the character that makes the character after it part of the region, or 0 if there is none.
+	escape rune
+	tok    TokenType
+}
+
+func newDelimited(cd *config.Delimited) (*delimited, error) {
+	d := &delimited{
+		open:   []rune(cd.Open),
+		close:  []rune(cd.Close),
+		nested: cd.Nested,
+	}
+
+	if cd.Escape != "" {
+		if utf8.RuneCountInString(cd.Escape) != 1 {
+			return nil, fmt.Errorf("The escape of a delimited region must be a single character, not '%s'", cd.Escape)
+		}
+		d.escape, _ = utf8.DecodeRuneInString(cd.Escape)
+	}
+
+	typ, err := TokenTypeString(cd.Token)
+	if err != nil {
+		return nil, err
+	}
+	d.tok = typ
+
+	return d, nil
+}
+
+// match matches the open delimiter at the start of text.
+func (d *delimited) match(text []rune) (*match, error) {
+	if !hasRunePrefix(text, d.open) {
+		return nil, nil
+	}
+	return &match{groups: []capture{{start: 0, length: len(d.open)}}}, nil
+}
+
+// scan scans text, which starts depth regions deep, up to the end of the region or the end of the first line,
+// whichever comes first. A depth of 0 means that text starts with the open delimiter. It returns the length of
+// the text scanned and the depth at the end of it, which is 0 if the region ended.
+func (d *delimited) scan(text []rune, depth int) (n, newDepth int) {
+	for n < len(text) {
+		switch {
+		case depth > 0 && d.escape != 0 && text[n] == d.escape:
+			n += 2
+			if n > len(text) {
+				n = len(text)
+			}
+			continue
+		case (depth == 0 || d.nested) && hasRunePrefix(text[n:], d.open):
+			depth++
+			n += len(d.open)
+			continue
+		case depth > 0 && hasRunePrefix(text[n:], d.close):
+			depth--
+			n += len(d.close)
+			if depth == 0 {
+				return n, 0
+			}
+			continue
+		case depth == 0:
+			// The text doesn't start with the open delimiter. This happens only if the text was changed after the
+			// state of the iterator was saved.
+			return n, 0
+		}
+
+		n++
+		if text[n-1] == '\n' {
+			return n, depth
+		}
+	}
+	return n, depth
+}
+
+func (d *delimited) String() string {
+	return fmt.Sprintf("delimited %s...%s", string(d.open), string(d.close))
+}
+
+func hasRunePrefix(text, prefix []rune) bool {
+	if len(text) < len(prefix) {
+		return false
+	}
+	for i, r := range prefix {
+		if text[i] != r {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+package syn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const delimitedLexerDef = `<lexer>
+  <config>
+    <name>Delimited</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule>
+        <delimited open="(*" close="*)" nested="true" escape="\" token="CommentMultiline"/>
+      </rule>
+      <rule>
+        <delimited open="&lt;&lt;" close="&gt;&gt;" token="LiteralString"/>
+        <push state="after"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="after">
+      <rule pattern="\w+">
+        <token type="Keyword"/>
+        <pop depth="1"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+func TestDelimited(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerFromXMLStrict(strings.NewReader(delimitedLexerDef))
+	if err != nil {
+		t.Fatalf("Loading the lexer failed: %v", err)
+	}
+	assert.Empty(ValidateLexer(lex))
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []Token
+	}{
+		{
+			name:  "nested",
+			input: "a (* b (* c *) \\*) d\n*) e",
+			expected: []Token{
+				{Type: Name, Value: []rune("a"), Start: 0, End: 1},
+				{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+				{Type: CommentMultiline, Value: []rune("(* b (* c *) \\*) d\n*)"), Start: 2, End: 23},
+				{Type: Text, Value: []rune(" "), Start: 23, End: 24},
+				{Type: Name, Value: []rune("e"), Start: 24, End: 25},
+			},
+		},
+		{
+			name:  "not closed",
+			input: "a (* b (* c *)",
+			expected: []Token{
+				{Type: Name, Value: []rune("a"), Start: 0, End: 1},
+				{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+				{Type: CommentMultiline, Value: []rune("(* b (* c *)"), Start: 2, End: 14},
+			},
+		},
+		{
+			name:  "not nested",
+			input: "<<a<<b>>c",
+			expected: []Token{
+				{Type: LiteralString, Value: []rune("<<a<<b>>"), Start: 0, End: 8},
+				{Type: Keyword, Value: []rune("c"), Start: 8, End: 9},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := tokenize(lex.Tokenise([]rune(tc.input)))
+			if err != nil {
+				t.Fatalf("Tokenizing returned error: %v\n", err)
+			}
+			assert.Equal(tc.expected, tokens)
+		})
+	}
+}
+
+func TestDelimitedSaveAndRestoreState(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerFromXML(strings.NewReader(delimitedLexerDef))
+	if err != nil {
+		t.Fatalf("Loading the lexer failed: %v", err)
+	}
+
+	input := []rune("(* a\n(* b\n*)\nc *) d")
+
+	// The region is split into a token for each line, so that the state can be saved within it.
+	expected := []Token{
+		{Type: CommentMultiline, Value: []rune("(* a\n"), Start: 0, End: 5},
+		{Type: CommentMultiline, Value: []rune("(* b\n"), Start: 5, End: 10},
+		{Type: CommentMultiline, Value: []rune("*)\n"), Start: 10, End: 13},
+		{Type: CommentMultiline, Value: []rune("c *)"), Start: 13, End: 17},
+		{Type: Text, Value: []rune(" "), Start: 17, End: 18},
+		{Type: Name, Value: []rune("d"), Start: 18, End: 19},
+	}
+
+	newIter := func() *iterator {
+		it := newIterator(input, lex.rules)
+		it.pushRootStateIfNeeded()
+		return it
+	}
+
+	tokens, err := tokenize(newIter())
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal(expected, tokens)
+
+	for i := 1; i < len(expected); i++ {
+		it := newIter()
+
+		tokens, err := tokenizeAtMost(it, i)
+		assert.Nil(err)
+
+		state := it.State()
+		_, err = tokenize(it)
+		assert.Nil(err)
+		it.SetState(state)
+		assert.True(state.Equal(it.State()))
+
+		rest, err := tokenize(it)
+		assert.Nil(err)
+
+		assert.Equal(expected, append(tokens, rest...), "restoring state after %d tokens", i)
+	}
+}
+
+func TestBadDelimitedIsRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		delimited string
+	}{
+		{name: "no close", delimited: `<delimited open="(*" token="Comment"/>`},
+		{name: "nested with the same delimiters", delimited: `<delimited open="'" close="'" nested="true" token="Comment"/>`},
+		{name: "long escape", delimited: `<delimited open="(*" close="*)" escape="\\" token="Comment"/>`},
+		{name: "bad token", delimited: `<delimited open="(*" close="*)" token="NoSuchToken"/>`},
+		{name: "with token", delimited: `<delimited open="(*" close="*)" token="Comment"/><token type="Comment"/>`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			def := `<lexer>
+  <config>
+    <name>Test</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule>
+        ` + tc.delimited + `
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+			_, err := NewLexerFromXML(strings.NewReader(def))
+			assert.NotNil(t, err)
+		})
+	}
+}
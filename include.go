@@ -0,0 +1,238 @@
+package syn
+
+import (
+	"fmt"
+
+	"github.com/jeffwilliams/syn/internal/config"
+)
+
+// hasLexerIncludes returns true if a rule of the lexer defined by cfg includes a state of another lexer.
+func hasLexerIncludes(cfg *config.Lexer) bool {
+	for _, st := range cfg.Rules.States {
+		for _, r := range st.Rules {
+			if r.Include != nil && r.Include.Lexer != "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// importLexerIncludes handles the include elements that include a state of another lexer. Since a rule
+// can only include a state of the lexer being built, the included state is copied into the lexer, along with
+// the states of the other lexer that it refers to. The copies are named by the name of the other lexer, then ::,
+// then the name of the state, so that they don't clash with the states of the lexer being built. The
+// configuration of the lexer is replaced by a copy that contains the copied states.
+func (lb *lexerBuilder) importLexerIncludes() error {
+	if !hasLexerIncludes(lb.cfg) {
+		return nil
+	}
+
+	if lb.registry == nil {
+		return fmt.Errorf("The lexer includes states of other lexers, but has no registry to find them in")
+	}
+
+	im := stateImporter{
+		registry: lb.registry,
+		host:     *lb.cfg,
+		imported: map[string]bool{},
+	}
+	im.host.Rules.States = make([]config.State, len(lb.cfg.Rules.States))
+	copy(im.host.Rules.States, lb.cfg.Rules.States)
+
+	for i := range lb.cfg.Rules.States {
+		rules := append([]config.Rule(nil), lb.cfg.Rules.States[i].Rules...)
+		for j := range rules {
+			inc := rules[j].Include
+			if inc == nil || inc.Lexer == "" {
+				continue
+			}
+
+			name, err := im.importState(inc.Lexer, inc.State)
+			if err != nil {
+				return lb.errorAt(i, j, err)
+			}
+			rules[j].Include = &config.Include{State: name}
+		}
+		im.host.Rules.States[i].Rules = rules
+	}
+
+	lb.cfg = &im.host
+	lb.lexer.config = lb.cfg
+	return nil
+}
+
+// stateImporter copies states of other lexers into the definition of a lexer.
+type stateImporter struct {
+	registry *LexerRegistry
+	host     config.Lexer
+	// imported holds the names of the states that have been copied into host.
+	imported map[string]bool
+}
+
+// importState copies the state named state of the lexer named lexerName into the host, and returns the name
+// of the copy. The states that the state refers to are copied as well.
+func (im *stateImporter) importState(lexerName, state string) (string, error) {
+	lexer := im.registry.lookup(lexerName)
+	if lexer == nil {
+		return "", fmt.Errorf("A rule includes the state '%s' of the lexer %s, but there is no such lexer in the registry", state, lexerName)
+	}
+	src := lexer.cfg()
+
+	if state == "" {
+		state = "root"
+	}
+	name := importedStateName(src.Config.Name, state)
+	if im.imported[name] {
+		return name, nil
+	}
+
+	var st *config.State
+	for i := range src.Rules.States {
+		if src.Rules.States[i].Name == state {
+			st = &src.Rules.States[i]
+			break
+		}
+	}
+	if st == nil {
+		return "", fmt.Errorf("A rule includes the state '%s' of the lexer %s, but there is no such state in that lexer", state, lexerName)
+	}
+
+	im.imported[name] = true
+	index := len(im.host.Rules.States)
+	im.host.Rules.States = append(im.host.Rules.States, config.State{Name: name})
+
+	// The conditions of the rules are on the options of src, which the host doesn't have, so they are
+	// tested against the values of the options of src.
+	options := optionValues(src, lexer.options)
+	rules := make([]config.Rule, 0, len(st.Rules))
+	for i, r := range st.Rules {
+		ok, err := ruleApplies(&r, options)
+		if err == nil && ok {
+			r.If = ""
+			err = im.importRule(&r, src)
+		}
+		if err != nil {
+			return "", fmt.Errorf("In state %s of the lexer %s: rule index %d: %w", state, src.Config.Name, i, err)
+		}
+		if ok {
+			rules = append(rules, r)
+		}
+	}
+	im.host.Rules.States[index].Rules = rules
+
+	return name, nil
+}
+
+// importedStateName returns the name of the copy of the state of the named lexer.
+func importedStateName(lexer, state string) string {
+	return lexer + "::" + state
+}
+
+// importRule changes the rule r, a copy of a rule of the lexer defined by src, so that it refers to the copies
+// of the states of src and so that its pattern is compiled with the same variables and options as in src. The elements of r
+// that are changed are replaced rather than modified, since they are shared with src.
+func (im *stateImporter) importRule(r *config.Rule, src *config.Lexer) error {
+	// The first error is kept, and the states aren't imported after it.
+	var err error
+	importFrom := func(lexer, state string) string {
+		if err != nil {
+			return state
+		}
+		var name string
+		name, err = im.importState(lexer, state)
+		return name
+	}
+	importState := func(state string) string {
+		if state == "" {
+			// Pushing the current state.
+			return state
+		}
+		return importFrom(src.Config.Name, state)
+	}
+
+	if r.Push != nil {
+		p := *r.Push
+		p.State = importState(p.State)
+		r.Push = &p
+	}
+
+	if r.Mutators != nil {
+		mutators := make([]config.Mutator, len(r.Mutators.Mutators))
+		for i, m := range r.Mutators.Mutators {
+			if p, ok := m.V.(*config.Push); ok {
+				imported := *p
+				imported.State = importState(p.State)
+				m.V = &imported
+			}
+			mutators[i] = m
+		}
+		r.Mutators = &config.Mutators{Mutators: mutators}
+	}
+
+	if r.Include != nil {
+		lexer := r.Include.Lexer
+		if lexer == "" {
+			lexer = src.Config.Name
+		}
+		r.Include = &config.Include{State: importFrom(lexer, r.Include.State)}
+	}
+
+	if r.Combined != nil {
+		states := make([]string, len(r.Combined.States))
+		for i, s := range r.Combined.States {
+			states[i] = importState(s)
+		}
+		r.Combined = &config.Combined{States: states}
+	}
+
+	if r.UsingSelf != nil {
+		r.UsingSelf = &config.UsingSelf{State: importState(r.UsingSelf.State)}
+	}
+
+	if r.ByGroups != nil {
+		elems := make([]config.ByGroupsElement, len(r.ByGroups.ByGroupsElements))
+		for i, e := range r.ByGroups.ByGroupsElements {
+			if u, ok := e.V.(*config.UsingSelf); ok {
+				e.V = &config.UsingSelf{State: importState(u.State)}
+			}
+			elems[i] = e
+		}
+		r.ByGroups = &config.ByGroups{ByGroupsElements: elems}
+	}
+
+	// The patterns may refer to variables of src, which the host doesn't have.
+	pattern, perr := expandVariables(r.Pattern, src.Variables)
+	if perr != nil {
+		return perr
+	}
+	r.Pattern = pattern
+
+	if r.Words != nil {
+		words := *r.Words
+		words.Prefix, perr = expandVariables(words.Prefix, src.Variables)
+		if perr != nil {
+			return perr
+		}
+		words.Suffix, perr = expandVariables(words.Suffix, src.Variables)
+		if perr != nil {
+			return perr
+		}
+		r.Words = &words
+	}
+
+	r.CaseInsensitive = importFlag(r.CaseInsensitive, src.Config.CaseInsensitive, im.host.Config.CaseInsensitive)
+	r.DotAll = importFlag(r.DotAll, src.Config.DotAll, im.host.Config.DotAll)
+	r.NotMultiline = importFlag(r.NotMultiline, src.Config.NotMultiline, im.host.Config.NotMultiline)
+
+	return err
+}
+
+// importFlag returns the value of a rule's override of a lexer-wide flag for a copy of the rule in the host
+// lexer. The copy must override the flag if the rule didn't and the lexers' settings differ.
+func importFlag(rule *bool, src, host bool) *bool {
+	if rule != nil || src == host {
+		return rule
+	}
+	return &src
+}
@@ -0,0 +1,113 @@
+package config
+
+import "fmt"
+
+// The modes of a state in a lexer that extends another.
+const (
+	// StateReplace replaces the state of the same name in the extended lexer.
+	StateReplace = "replace"
+	// StatePrepend puts the rules of the state before the rules of the state of the same name in the extended lexer.
+	StatePrepend = "prepend"
+	// StateAppend puts the rules of the state after the rules of the state of the same name in the extended lexer.
+	StateAppend = "append"
+)
+
+// Extend returns the definition of the lexer child, which extends the lexer parent. The result has the
+// config of child, the variables and options of both lexers, with those of child taking precedence, and the states of
+// parent combined with those of child according to their Mode. States
+// of child that parent doesn't have are added after the states of parent. Neither parent nor child is modified.
+func Extend(parent, child *Lexer) (*Lexer, error) {
+	res := *child
+	res.Extends = nil
+	res.Variables = extendVariables(parent.Variables, child.Variables)
+	res.Options = extendOptions(parent.Options, child.Options)
+
+	states := make([]State, len(parent.Rules.States))
+	index := map[string]int{}
+	for i, st := range parent.Rules.States {
+		st.Rules = append([]Rule(nil), st.Rules...)
+		states[i] = st
+		if _, ok := index[st.Name]; !ok {
+			index[st.Name] = i
+		}
+	}
+
+	for _, st := range child.Rules.States {
+		i, ok := index[st.Name]
+		if !ok {
+			if st.Mode == StatePrepend || st.Mode == StateAppend {
+				return nil, fmt.Errorf("The state %s has mode %s, but the lexer %s has no state of that name to extend",
+					st.Name, st.Mode, parent.Config.Name)
+			}
+			st.Mode = ""
+			st.Rules = append([]Rule(nil), st.Rules...)
+			states = append(states, st)
+			index[st.Name] = len(states) - 1
+			continue
+		}
+
+		var rules []Rule
+		switch st.Mode {
+		case "", StateReplace:
+			rules = append(rules, st.Rules...)
+		case StatePrepend:
+			rules = append(append(rules, st.Rules...), states[i].Rules...)
+		case StateAppend:
+			rules = append(append(rules, states[i].Rules...), st.Rules...)
+		default:
+			return nil, fmt.Errorf("The state %s has an invalid mode '%s'", st.Name, st.Mode)
+		}
+		states[i].Rules = rules
+	}
+
+	res.Rules.States = states
+	return &res, nil
+}
+
+// extendVariables returns the variables of parent followed by those of child. A variable of child replaces
+// the variable of parent with the same name.
+func extendVariables(parent, child []Var) []Var {
+	if len(parent) == 0 {
+		return child
+	}
+
+	vars := append([]Var(nil), parent...)
+	index := map[string]int{}
+	for i, v := range vars {
+		index[v.Name] = i
+	}
+
+	for _, v := range child {
+		if i, ok := index[v.Name]; ok {
+			vars[i] = v
+			continue
+		}
+		vars = append(vars, v)
+		index[v.Name] = len(vars) - 1
+	}
+	return vars
+}
+
+// extendOptions returns the options of parent followed by those of child. An option of child replaces
+// the option of parent with the same name.
+func extendOptions(parent, child []Option) []Option {
+	if len(parent) == 0 {
+		return child
+	}
+
+	opts := append([]Option(nil), parent...)
+	index := map[string]int{}
+	for i, o := range opts {
+		index[o.Name] = i
+	}
+
+	for _, o := range child {
+		if i, ok := index[o.Name]; ok {
+			opts[i] = o
+			continue
+		}
+		opts = append(opts, o)
+		index[o.Name] = len(opts) - 1
+	}
+	return opts
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtend(t *testing.T) {
+	rule := func(pattern string) Rule {
+		return Rule{Pattern: pattern, Token: &Token{Type: "Text"}}
+	}
+
+	parent := &Lexer{
+		Config:    Config{Name: "Parent", CaseInsensitive: true},
+		Variables: []Var{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}},
+		Options:   []Option{{Name: "dialect", Default: "ansi"}},
+		Rules: Rules{States: []State{
+			{Name: "root", Rules: []Rule{rule("a"), rule("b")}},
+			{Name: "string", Rules: []Rule{rule("c")}},
+			{Name: "comment", Rules: []Rule{rule("d")}},
+			{Name: "number", Rules: []Rule{rule("e")}},
+		}},
+	}
+	child := &Lexer{
+		Extends:   &Extends{Lexer: "Parent"},
+		Config:    Config{Name: "Child"},
+		Variables: []Var{{Name: "b", Value: "3"}, {Name: "c", Value: "4"}},
+		Options:   []Option{{Name: "version", Default: "3"}, {Name: "dialect", Default: "mysql"}},
+		Rules: Rules{States: []State{
+			{Name: "root", Mode: StatePrepend, Rules: []Rule{rule("x")}},
+			{Name: "string", Mode: StateAppend, Rules: []Rule{rule("y")}},
+			{Name: "comment", Rules: []Rule{rule("z")}},
+			{Name: "extra", Rules: []Rule{rule("w")}},
+		}},
+	}
+
+	res, err := Extend(parent, child)
+	if err != nil {
+		t.Fatalf("Extend failed: %v", err)
+	}
+
+	assert := assert.New(t)
+	assert.Nil(res.Extends)
+	assert.Equal(child.Config, res.Config)
+	assert.Equal([]Var{{Name: "a", Value: "1"}, {Name: "b", Value: "3"}, {Name: "c", Value: "4"}}, res.Variables)
+	assert.Equal([]Option{{Name: "dialect", Default: "mysql"}, {Name: "version", Default: "3"}}, res.Options)
+	assert.Equal([]State{
+		{Name: "root", Rules: []Rule{rule("x"), rule("a"), rule("b")}},
+		{Name: "string", Rules: []Rule{rule("c"), rule("y")}},
+		{Name: "comment", Rules: []Rule{rule("z")}},
+		{Name: "number", Rules: []Rule{rule("e")}},
+		{Name: "extra", Rules: []Rule{rule("w")}},
+	}, res.Rules.States)
+
+	// The definitions that were extended are unchanged.
+	assert.Equal([]Rule{rule("a"), rule("b")}, parent.Rules.States[0].Rules)
+	assert.Equal(StatePrepend, child.Rules.States[0].Mode)
+
+	child.Rules.States = []State{{Name: "missing", Mode: StateAppend}}
+	_, err = Extend(parent, child)
+	assert.NotNil(err)
+
+	child.Rules.States = []State{{Name: "root", Mode: "merge"}}
+	_, err = Extend(parent, child)
+	assert.NotNil(err)
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The JSON form of a lexer maps one-to-one onto the types in this package. Elements become objects
+// and attributes become their fields. The intermixed elements of bygroups and mutators become arrays
+// of objects that each have a single field named after the element, for example:
+//
+//	"bygroups": [{"token": {"type": "Keyword"}}, {"usingself": {"state": "root"}}]
+
+// errNoLexer is returned when a JSON or YAML document is null, which decodes without error but
+// leaves no lexer.
+var errNoLexer = fmt.Errorf("the document contains no lexer definition")
+
+func DecodeLexerJSON(rdr io.Reader) (lex *Lexer, err error) {
+	dec := json.NewDecoder(rdr)
+
+	err = dec.Decode(&lex)
+	if err == nil && lex == nil {
+		err = errNoLexer
+	}
+	return
+}
+
+// EncodeLexerJSON writes lex as indented JSON.
+func EncodeLexerJSON(w io.Writer, lex *Lexer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(lex)
+}
+
+func (b ByGroups) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.ByGroupsElements)
+}
+
+func (b *ByGroups) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &b.ByGroupsElements)
+}
+
+func (m ByGroupsElement) MarshalJSON() ([]byte, error) {
+	name, err := m.name()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{name: m.V})
+}
+
+func (m *ByGroupsElement) UnmarshalJSON(data []byte) (err error) {
+	name, raw, err := singleJSONField(data)
+	if err != nil {
+		return err
+	}
+
+	m.V, err = newByGroupsElementValue(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, m.V)
+}
+
+func (m Mutators) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Mutators)
+}
+
+func (m *Mutators) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.Mutators)
+}
+
+func (m Mutator) MarshalJSON() ([]byte, error) {
+	name, err := m.name()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string]interface{}{name: m.V})
+}
+
+func (m *Mutator) UnmarshalJSON(data []byte) (err error) {
+	name, raw, err := singleJSONField(data)
+	if err != nil {
+		return err
+	}
+
+	m.V, err = newMutatorValue(name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, m.V)
+}
+
+// singleJSONField decodes data as an object that must have exactly one field, and returns
+// the name and value of that field.
+func singleJSONField(data []byte) (name string, value json.RawMessage, err error) {
+	var obj map[string]json.RawMessage
+	err = json.Unmarshal(data, &obj)
+	if err != nil {
+		return
+	}
+
+	if len(obj) != 1 {
+		err = fmt.Errorf("expected an object with exactly one field but it has %d", len(obj))
+		return
+	}
+
+	for name, value = range obj {
+	}
+	return
+}
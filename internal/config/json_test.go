@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJsonDecode(t *testing.T) {
+	inp := `
+{
+  "config": {
+    "name": "C",
+    "aliases": ["c"],
+    "filenames": ["*.c", "*.h"],
+    "ensure_nl": true
+  },
+  "rules": {
+    "states": [
+      {
+        "name": "statement",
+        "rules": [
+          {"include": {"state": "whitespace"}},
+          {"pattern": ";", "token": {"type": "Punctuation"}, "pop": {"depth": 1}},
+          {
+            "pattern": "\"",
+            "bygroups": [
+              {"usingself": {"state": "root"}},
+              {"token": {"type": "NameFunction"}}
+            ],
+            "combined": {"states": ["a", "b"]}
+          },
+          {
+            "pattern": "x",
+            "case_insensitive": true,
+            "mutators": [{"pop": {"depth": 1}}, {"push": {"state": "a"}}]
+          }
+        ]
+      }
+    ]
+  }
+}`
+
+	assert := assert.New(t)
+
+	lex, err := DecodeLexerJSON(strings.NewReader(inp))
+	if err != nil {
+		t.Fatalf("Decoding JSON failed: %v\n", err)
+	}
+
+	caseInsensitive := true
+	expected := &Lexer{
+		Config: Config{
+			Name:      "C",
+			Aliases:   []string{"c"},
+			Filenames: []string{"*.c", "*.h"},
+			EnsureNL:  true,
+		},
+		Rules: Rules{
+			States: []State{
+				{
+					Name: "statement",
+					Rules: []Rule{
+						{
+							Include: &Include{State: "whitespace"},
+						},
+						{
+							Pattern: ";",
+							Token:   &Token{Type: "Punctuation"},
+							Pop:     &Pop{Depth: 1},
+						},
+						{
+							Pattern: "\"",
+							ByGroups: &ByGroups{
+								ByGroupsElements: []ByGroupsElement{
+									{V: &UsingSelf{State: "root"}},
+									{V: &Token{Type: "NameFunction"}},
+								},
+							},
+							Combined: &Combined{States: []string{"a", "b"}},
+						},
+						{
+							Pattern:         "x",
+							CaseInsensitive: &caseInsensitive,
+							Mutators: &Mutators{
+								Mutators: []Mutator{
+									{V: &Pop{Depth: 1}},
+									{V: &Push{State: "a"}},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	assert.Equal(expected, lex)
+}
+
+func TestJsonDecodeBadByGroupsElement(t *testing.T) {
+	inp := `{"rules": {"states": [{"name": "root", "rules": [{"bygroups": [{"token": {"type": "A"}, "using": {"lexer": "B"}}]}]}]}}`
+
+	_, err := DecodeLexerJSON(strings.NewReader(inp))
+	assert.NotNil(t, err)
+
+	inp = `{"rules": {"states": [{"name": "root", "rules": [{"bygroups": [{"tokens": {"type": "A"}}]}]}]}}`
+
+	_, err = DecodeLexerJSON(strings.NewReader(inp))
+	assert.NotNil(t, err)
+}
+
+func TestJsonDecodeNull(t *testing.T) {
+	lex, err := DecodeLexerJSON(strings.NewReader("null"))
+	assert.Nil(t, lex)
+	assert.Equal(t, errNoLexer, err)
+}
+
+func TestJsonRoundTrip(t *testing.T) {
+	paths, err := filepath.Glob("../../lexers/embedded/*.xml")
+	if err != nil {
+		t.Fatalf("Listing lexers failed: %v", err)
+	}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Opening %s failed: %v", path, err)
+		}
+		lex, err := DecodeLexer(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Decoding %s failed: %v", path, err)
+		}
+
+		var buf bytes.Buffer
+		err = EncodeLexerJSON(&buf, lex)
+		if err != nil {
+			t.Fatalf("Encoding %s as JSON failed: %v", path, err)
+		}
+
+		lex2, err := DecodeLexerJSON(&buf)
+		if err != nil {
+			t.Fatalf("Decoding JSON for %s failed: %v", path, err)
+		}
+
+		lex2.XMLName = lex.XMLName
+		assert.Equal(t, lex, lex2, "lexer %s", path)
+	}
+}
@@ -0,0 +1,138 @@
+package config
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"unicode/utf8"
+)
+
+// Position is the location of an element in an XML lexer definition.
+type Position struct {
+	// Offset is the byte offset of the start of the element.
+	Offset int64
+	// Line and Column are numbered from 1. Column counts characters, not bytes.
+	Line   int
+	Column int
+}
+
+// Positions holds the locations of the states and rules of a lexer definition decoded from XML.
+type Positions struct {
+	// States holds the position of each state in Lexer.Rules.States, in the same order.
+	States []Position
+	// Rules holds the positions of the rules of each state, indexed like States.
+	Rules [][]Position
+}
+
+// State returns the position of the state at index i of Lexer.Rules.States. ok is false if the
+// position is not known. It may be called on a nil Positions.
+func (p *Positions) State(i int) (pos Position, ok bool) {
+	if p == nil || i < 0 || i >= len(p.States) {
+		return
+	}
+	return p.States[i], true
+}
+
+// Rule returns the position of the rule at index rule of the state at index state. ok is false if the
+// position is not known. It may be called on a nil Positions.
+func (p *Positions) Rule(state, rule int) (pos Position, ok bool) {
+	if p == nil || state < 0 || state >= len(p.Rules) || rule < 0 || rule >= len(p.Rules[state]) {
+		return
+	}
+	return p.Rules[state][rule], true
+}
+
+// DecodeLexerWithPositions is like DecodeLexer, but also returns the positions in the input of the
+// states and rules of the lexer.
+func DecodeLexerWithPositions(rdr io.Reader) (lex *Lexer, pos *Positions, err error) {
+	data, err := io.ReadAll(rdr)
+	if err != nil {
+		return
+	}
+
+	return decodeLexer(data)
+}
+
+func decodeLexer(data []byte) (lex *Lexer, pos *Positions, err error) {
+	rec := &positionRecorder{
+		dec: xml.NewDecoder(bytes.NewReader(data)),
+		lc:  lineCounter{data: data, line: 1},
+	}
+
+	err = xml.NewTokenDecoder(rec).Decode(&lex)
+	if err != nil {
+		return
+	}
+	return lex, &rec.pos, nil
+}
+
+// positionRecorder passes on the tokens of an XML document to the decoder that decodes it, and records the
+// positions of the state and rule elements of a lexer on the way, so that the document is only read once.
+// They are found in the same order that the decoder stores them in Lexer.Rules.States. dec reads the document
+// and checks that it is well formed, so that syntax errors give the line they are on.
+type positionRecorder struct {
+	dec  *xml.Decoder
+	pos  Positions
+	path []string
+	lc   lineCounter
+}
+
+func (r *positionRecorder) Token() (xml.Token, error) {
+	offset := r.dec.InputOffset()
+	tok, err := r.dec.Token()
+	if err != nil {
+		return tok, err
+	}
+
+	switch t := tok.(type) {
+	case xml.StartElement:
+		r.path = append(r.path, t.Name.Local)
+		switch {
+		case pathIs(r.path, "lexer", "rules", "state"):
+			r.pos.States = append(r.pos.States, r.lc.position(offset))
+			r.pos.Rules = append(r.pos.Rules, nil)
+		case pathIs(r.path, "lexer", "rules", "state", "rule"):
+			last := len(r.pos.Rules) - 1
+			r.pos.Rules[last] = append(r.pos.Rules[last], r.lc.position(offset))
+		}
+	case xml.EndElement:
+		r.path = r.path[:len(r.path)-1]
+	}
+	return tok, nil
+}
+
+func pathIs(path []string, elems ...string) bool {
+	if len(path) != len(elems) {
+		return false
+	}
+	for i := range path {
+		if path[i] != elems[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// lineCounter computes the line and column of offsets into data. The offsets it is given must not decrease.
+type lineCounter struct {
+	data []byte
+	// offset is the offset counted up to, and lineStart the offset of the start of the line it is on.
+	offset    int64
+	lineStart int64
+	line      int
+}
+
+func (c *lineCounter) position(offset int64) Position {
+	for ; c.offset < offset; c.offset++ {
+		if c.data[c.offset] == '\n' {
+			c.line++
+			c.lineStart = c.offset + 1
+		}
+	}
+
+	return Position{
+		Offset: offset,
+		Line:   c.line,
+		Column: utf8.RuneCount(c.data[c.lineStart:offset]) + 1,
+	}
+}
@@ -0,0 +1,270 @@
+package config
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// SchemaError is an element, attribute or text in an XML lexer definition that DecodeLexer doesn't
+// understand and would ignore.
+type SchemaError struct {
+	Position
+	// State is the name of the state the problem is in, if any.
+	State string
+	// Rule is the index of the rule within the state the problem is in, or -1 if it is not in a rule.
+	Rule    int
+	Message string
+}
+
+func (e *SchemaError) Error() string {
+	return e.Message
+}
+
+// DecodeLexerStrict is like DecodeLexerWithPositions, but returns a *SchemaError for the first element or
+// attribute that is not part of the lexer definition schema, rather than ignoring it. An attribute that is given
+// more than once is also an error, unless it holds a list, like the state attribute of combined.
+func DecodeLexerStrict(rdr io.Reader) (lex *Lexer, pos *Positions, err error) {
+	data, err := io.ReadAll(rdr)
+	if err != nil {
+		return
+	}
+
+	err = checkSchema(data)
+	if err != nil {
+		return
+	}
+
+	return decodeLexer(data)
+}
+
+// anyElementValues holds, for the types of the elements of fields with the ,any option, the function that
+// returns a new value for the element with a given name.
+var anyElementValues = map[reflect.Type]func(name string) (interface{}, error){
+	reflect.TypeOf(Mutator{}):         newMutatorValue,
+	reflect.TypeOf(ByGroupsElement{}): newByGroupsElementValue,
+}
+
+// schemaChecker walks the tokens of an XML lexer definition and checks each one against the types that
+// the definition is decoded into.
+type schemaChecker struct {
+	dec *xml.Decoder
+	lc  lineCounter
+	// types holds the types that the open elements are decoded into, and names their names.
+	types []reflect.Type
+	names []string
+	// state and rule locate the current rule, in the same way as SchemaError.
+	state string
+	rule  int
+	// offset is the offset of the current token.
+	offset int64
+}
+
+func checkSchema(data []byte) error {
+	c := schemaChecker{
+		dec:  xml.NewDecoder(bytes.NewReader(data)),
+		lc:   lineCounter{data: data, line: 1},
+		rule: -1,
+	}
+	return c.check()
+}
+
+func (c *schemaChecker) check() error {
+	for {
+		c.offset = c.dec.InputOffset()
+		tok, err := c.dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			err = c.startElement(t)
+		case xml.EndElement:
+			c.types = c.types[:len(c.types)-1]
+			c.names = c.names[:len(c.names)-1]
+		case xml.CharData:
+			err = c.charData(t)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *schemaChecker) startElement(t xml.StartElement) error {
+	name := t.Name.Local
+
+	var typ reflect.Type
+	if len(c.types) == 0 {
+		if name != "lexer" {
+			return c.errorf("the document element is <%s> rather than <lexer>", name)
+		}
+		typ = reflect.TypeOf(Lexer{})
+	} else {
+		var ok bool
+		typ, ok = childType(c.types[len(c.types)-1], name)
+		if !ok {
+			return c.errorf("unknown element <%s> in <%s>", name, c.names[len(c.names)-1])
+		}
+	}
+
+	c.types = append(c.types, typ)
+	c.names = append(c.names, name)
+
+	switch {
+	case pathIs(c.names, "lexer", "rules", "state"):
+		c.state, c.rule = "", -1
+		for _, a := range t.Attr {
+			if a.Name.Local == "name" {
+				c.state = a.Value
+			}
+		}
+	case pathIs(c.names, "lexer", "rules", "state", "rule"):
+		c.rule++
+	}
+
+	return c.checkAttrs(typ, t)
+}
+
+func (c *schemaChecker) checkAttrs(typ reflect.Type, t xml.StartElement) error {
+	seen := map[string]bool{}
+	for _, a := range t.Attr {
+		name := a.Name.Local
+		f, ok := attrField(typ, name)
+		if !ok {
+			return c.errorf("unknown attribute %s on <%s>", name, t.Name.Local)
+		}
+		if seen[name] && f.Type.Kind() != reflect.Slice {
+			return c.errorf("the attribute %s is given more than once on <%s>", name, t.Name.Local)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+func (c *schemaChecker) charData(t xml.CharData) error {
+	if len(c.types) == 0 {
+		return nil
+	}
+	typ := c.types[len(c.types)-1]
+	if typ.Kind() != reflect.Struct || hasCharData(typ) {
+		return nil
+	}
+	if len(bytes.TrimSpace(t)) > 0 {
+		return c.errorf("unexpected text %q in <%s>", strings.TrimSpace(string(t)), c.names[len(c.names)-1])
+	}
+	return nil
+}
+
+func (c *schemaChecker) errorf(format string, args ...interface{}) error {
+	e := &SchemaError{
+		Position: c.lc.position(c.offset),
+		Rule:     -1,
+		Message:  fmt.Sprintf(format, args...),
+	}
+	if len(c.names) >= 3 {
+		e.State = c.state
+	}
+	if len(c.names) >= 4 {
+		e.Rule = c.rule
+	}
+	return e
+}
+
+// childType returns the type that the child element called name of an element of type parent is decoded into.
+func childType(parent reflect.Type, name string) (reflect.Type, bool) {
+	if parent.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	for i := 0; i < parent.NumField(); i++ {
+		f := parent.Field(i)
+		tagName, opts := xmlTag(f)
+		if tagName == "-" || f.Name == "XMLName" || opts["attr"] || opts["chardata"] {
+			continue
+		}
+
+		if opts["any"] {
+			newValue, ok := anyElementValues[elemType(f.Type)]
+			if !ok {
+				continue
+			}
+			v, err := newValue(name)
+			if err != nil {
+				continue
+			}
+			return elemType(reflect.TypeOf(v)), true
+		}
+
+		if tagName == name {
+			return elemType(f.Type), true
+		}
+
+		if strings.HasPrefix(tagName, name+">") {
+			// The field is decoded from elements nested within this one, so this element is treated as a
+			// struct holding the field with the rest of the path.
+			rest := tagName[len(name)+1:]
+			return reflect.StructOf([]reflect.StructField{
+				{Name: f.Name, Type: f.Type, Tag: reflect.StructTag(`xml:"` + rest + `"`)},
+			}), true
+		}
+	}
+	return nil, false
+}
+
+// hasCharData returns true if typ is a struct with a field that holds the text content of the element.
+func hasCharData(typ reflect.Type) bool {
+	for i := 0; i < typ.NumField(); i++ {
+		_, opts := xmlTag(typ.Field(i))
+		if opts["chardata"] {
+			return true
+		}
+	}
+	return false
+}
+
+// attrField returns the field of typ that the attribute called name is decoded into.
+func attrField(typ reflect.Type, name string) (reflect.StructField, bool) {
+	if typ.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		tagName, opts := xmlTag(f)
+		if opts["attr"] && tagName == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// xmlTag returns the name and the options in the xml tag of the field f.
+func xmlTag(f reflect.StructField) (name string, opts map[string]bool) {
+	parts := strings.Split(f.Tag.Get("xml"), ",")
+	name = parts[0]
+	if name == "" {
+		name = f.Name
+	}
+
+	opts = map[string]bool{}
+	for _, o := range parts[1:] {
+		opts[o] = true
+	}
+	return
+}
+
+// elemType returns the type of the values that t points to or holds a list of.
+func elemType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t
+}
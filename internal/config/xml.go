@@ -4,100 +4,343 @@ package config
 // srex -s '\n' ../../c.xml 'x/<rules.*\n(.*\n)*? *<\/rules>/ x/<[^ ]+/' | sort | uniq -c
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io"
+	"regexp"
+	"sort"
 )
 
 type Lexer struct {
-	XMLName xml.Name `xml:"lexer"`
-	Config  Config   `xml:"config"`
-	Rules   Rules    `xml:"rules"`
+	XMLName xml.Name `xml:"lexer" json:"-" yaml:"-"`
+	Extends *Extends `xml:"extends" json:"extends,omitempty" yaml:"extends,omitempty"`
+	Config  Config   `xml:"config" json:"config" yaml:"config"`
+	// Variables are named fragments of regular expressions, which patterns refer to as {{name}}.
+	Variables []Var `xml:"variables>var" json:"variables,omitempty" yaml:"variables,omitempty"`
+	// Options are the options of the lexer that the If conditions of rules test.
+	Options []Option `xml:"options>option" json:"options,omitempty" yaml:"options,omitempty"`
+	Rules   Rules    `xml:"rules" json:"rules" yaml:"rules"`
+}
+
+// Var defines a variable. Its value may refer to other variables.
+type Var struct {
+	Name  string `xml:"name,attr" json:"name" yaml:"name"`
+	Value string `xml:",chardata" json:"value" yaml:"value"`
+}
+
+// Option declares an option of a lexer, like the SQL dialect to lex, and the value it has when it isn't set.
+type Option struct {
+	Name    string `xml:"name,attr" json:"name" yaml:"name"`
+	Default string `xml:"default,attr,omitempty" json:"default,omitempty" yaml:"default,omitempty"`
+}
+
+// Extends names the lexer that a lexer extends. See Extend.
+type Extends struct {
+	Lexer string `xml:"lexer,attr" json:"lexer" yaml:"lexer"`
 }
 
 type Config struct {
-	Name      string   `xml:"name"`
-	Aliases   []string `xml:"alias"`
-	Filenames []string `xml:"filename"`
-	MimeTypes []string `xml:"mime_type"`
-	EnsureNL  bool     `xml:"ensure_nl"`
-	Priority  float32  `xml:"priority,omitempty"`
+	Name            string   `xml:"name" json:"name" yaml:"name"`
+	Aliases         []string `xml:"alias" json:"aliases,omitempty" yaml:"aliases,omitempty"`
+	Filenames       []string `xml:"filename" json:"filenames,omitempty" yaml:"filenames,omitempty"`
+	MimeTypes       []string `xml:"mime_type" json:"mime_types,omitempty" yaml:"mime_types,omitempty"`
+	CaseInsensitive bool     `xml:"case_insensitive,omitempty" json:"case_insensitive,omitempty" yaml:"case_insensitive,omitempty"`
+	DotAll          bool     `xml:"dot_all,omitempty" json:"dot_all,omitempty" yaml:"dot_all,omitempty"`
+	NotMultiline    bool     `xml:"not_multiline,omitempty" json:"not_multiline,omitempty" yaml:"not_multiline,omitempty"`
+	EnsureNL        bool     `xml:"ensure_nl,omitempty" json:"ensure_nl,omitempty" yaml:"ensure_nl,omitempty"`
+	Priority        float32  `xml:"priority,omitempty" json:"priority,omitempty" yaml:"priority,omitempty"`
+	Analyse         *Analyse `xml:"analyse,omitempty" json:"analyse,omitempty" yaml:"analyse,omitempty"`
+}
+
+// Analyse contains regular expressions that are matched against text to determine how likely
+// it is that the text is in the lexer's language.
+type Analyse struct {
+	// First, when true, means the score of the first regex that matches is used. Otherwise the
+	// scores of all the regexes that match are added.
+	First   bool    `xml:"first,attr" json:"first,omitempty" yaml:"first,omitempty"`
+	Regexes []Regex `xml:"regex" json:"regexes" yaml:"regexes"`
+}
+
+type Regex struct {
+	Pattern string  `xml:"pattern,attr" json:"pattern" yaml:"pattern"`
+	Score   float32 `xml:"score,attr" json:"score" yaml:"score"`
 }
 
 type Rules struct {
-	States []State `xml:"state"`
+	States []State `xml:"state" json:"states" yaml:"states"`
 }
 
 type State struct {
-	Name  string `xml:"name,attr"`
-	Rules []Rule `xml:"rule"`
+	Name string `xml:"name,attr" json:"name" yaml:"name"`
+	// Mode is how the state is combined with the state of the same name in the lexer being extended: one of
+	// StateReplace, StatePrepend or StateAppend. It is empty, meaning StateReplace, for lexers that don't extend another.
+	Mode  string `xml:"mode,attr,omitempty" json:"mode,omitempty" yaml:"mode,omitempty"`
+	Rules []Rule `xml:"rule" json:"rules,omitempty" yaml:"rules,omitempty"`
 }
 
 type Rule struct {
-	Pattern   string     `xml:"pattern,attr"`
-	Include   *Include   `xml:"include"`
-	Token     *Token     `xml:"token"`
-	Pop       *Pop       `xml:"pop"`
-	Push      *Push      `xml:"push"`
-	ByGroups  *ByGroups  `xml:"bygroups"`
-	UsingSelf *UsingSelf `xml:"usingself"`
-	Combined  *Combined  `xml:"combined"`
+	Pattern   string     `xml:"pattern,attr,omitempty" json:"pattern,omitempty" yaml:"pattern,omitempty"`
+	Words     *Words     `xml:"words" json:"words,omitempty" yaml:"words,omitempty"`
+	Delimited *Delimited `xml:"delimited" json:"delimited,omitempty" yaml:"delimited,omitempty"`
+	Call      *Call      `xml:"call" json:"call,omitempty" yaml:"call,omitempty"`
+	Include   *Include   `xml:"include" json:"include,omitempty" yaml:"include,omitempty"`
+	Token     *Token     `xml:"token" json:"token,omitempty" yaml:"token,omitempty"`
+	Pop       *Pop       `xml:"pop" json:"pop,omitempty" yaml:"pop,omitempty"`
+	Push      *Push      `xml:"push" json:"push,omitempty" yaml:"push,omitempty"`
+	ByGroups  *ByGroups  `xml:"bygroups" json:"bygroups,omitempty" yaml:"bygroups,omitempty"`
+	UsingSelf *UsingSelf `xml:"usingself" json:"usingself,omitempty" yaml:"usingself,omitempty"`
+	Using     *Using     `xml:"using" json:"using,omitempty" yaml:"using,omitempty"`
+	Combined  *Combined  `xml:"combined" json:"combined,omitempty" yaml:"combined,omitempty"`
+	Mutators  *Mutators  `xml:"mutators" json:"mutators,omitempty" yaml:"mutators,omitempty"`
+
+	// CaseInsensitive, DotAll and NotMultiline override the lexer-wide flags
+	// of the same name in Config for this rule's pattern only. They are nil
+	// when the rule doesn't override the lexer's setting.
+	CaseInsensitive *bool `xml:"case_insensitive,attr,omitempty" json:"case_insensitive,omitempty" yaml:"case_insensitive,omitempty"`
+	DotAll          *bool `xml:"dot_all,attr,omitempty" json:"dot_all,omitempty" yaml:"dot_all,omitempty"`
+	NotMultiline    *bool `xml:"not_multiline,attr,omitempty" json:"not_multiline,omitempty" yaml:"not_multiline,omitempty"`
+
+	// If, when not empty, is a condition on the options of the lexer like dialect=mysql. The rule
+	// is left out of the lexer when the condition doesn't hold.
+	If string `xml:"if,attr,omitempty" json:"if,omitempty" yaml:"if,omitempty"`
+}
+
+// Words is matched instead of a pattern by a rule. It matches any of the words in List, which are separated by
+// whitespace, when the text before the word matches the pattern Prefix and the text after it matches the
+// pattern Suffix. It is like a pattern Prefix(word1|word2|...)Suffix, but is faster for long lists of words.
+type Words struct {
+	Prefix string `xml:"prefix,attr,omitempty" json:"prefix,omitempty" yaml:"prefix,omitempty"`
+	Suffix string `xml:"suffix,attr,omitempty" json:"suffix,omitempty" yaml:"suffix,omitempty"`
+	List   string `xml:",chardata" json:"list" yaml:"list"`
+}
+
+// Delimited is matched instead of a pattern by a rule. It matches a region of text that starts with Open and
+// ends with Close, and the whole region is emitted as tokens of the type Token. If Nested is true, Open within
+// the region starts a nested region, and the region only ends when each nested region has been closed. If Escape
+// is set, the character after it is part of the region even if it starts Open or Close.
+type Delimited struct {
+	Open   string `xml:"open,attr" json:"open" yaml:"open"`
+	Close  string `xml:"close,attr" json:"close" yaml:"close"`
+	Nested bool   `xml:"nested,attr,omitempty" json:"nested,omitempty" yaml:"nested,omitempty"`
+	Escape string `xml:"escape,attr,omitempty" json:"escape,omitempty" yaml:"escape,omitempty"`
+	Token  string `xml:"token,attr" json:"token" yaml:"token"`
+}
+
+// Call is matched instead of a pattern by a rule. It calls the Go function registered under the name Func,
+// which decides how much of the text matches, the tokens for it and how the state changes.
+type Call struct {
+	Func string `xml:"func,attr" json:"func" yaml:"func"`
 }
 
+// Include includes the rules of the state named State. If Lexer is set the state is one of the lexer
+// with that name, rather than of the lexer containing the include.
 type Include struct {
-	State string `xml:"state,attr"`
+	State string `xml:"state,attr" json:"state" yaml:"state"`
+	Lexer string `xml:"lexer,attr,omitempty" json:"lexer,omitempty" yaml:"lexer,omitempty"`
 }
 
 type Token struct {
-	Type string `xml:"type,attr"`
+	Type string `xml:"type,attr" json:"type" yaml:"type"`
 }
 
 type Pop struct {
-	Depth int `xml:"depth,attr"`
+	Depth int `xml:"depth,attr" json:"depth" yaml:"depth"`
 }
 
+// Push pushes the state named State. If State is empty the current state is pushed again.
+//
+// If Capture is not empty, the text of the group numbered Group in the rule's match is stored in a
+// variable of that name on the pushed state. Patterns refer to it as {{$name}} while the state is on the stack.
 type Push struct {
-	State string `xml:"state,attr"`
+	State   string `xml:"state,attr,omitempty" json:"state,omitempty" yaml:"state,omitempty"`
+	Capture string `xml:"capture,attr,omitempty" json:"capture,omitempty" yaml:"capture,omitempty"`
+	Group   int    `xml:"group,attr,omitempty" json:"group,omitempty" yaml:"group,omitempty"`
+}
+
+// Mutators contains push and pop elements intermixed, which are applied to the state stack in order.
+type Mutators struct {
+	Mutators []Mutator `xml:",any"`
+}
+
+// Mutator represents either a push or a pop element within a Mutators element.
+type Mutator struct {
+	V interface{}
+}
+
+// newMutatorValue returns a new value for the Mutator element with the given name.
+func newMutatorValue(name string) (interface{}, error) {
+	switch name {
+	case "push":
+		return &Push{}, nil
+	case "pop":
+		return &Pop{}, nil
+	default:
+		return nil, fmt.Errorf("unknown element: %s", name)
+	}
+}
+
+// name returns the name of the element that m represents.
+func (m Mutator) name() (string, error) {
+	switch m.V.(type) {
+	case *Push:
+		return "push", nil
+	case *Pop:
+		return "pop", nil
+	default:
+		return "", fmt.Errorf("unknown mutator type: %T", m.V)
+	}
+}
+
+func (m *Mutator) UnmarshalXML(d *xml.Decoder, start xml.StartElement) (err error) {
+	m.V, err = newMutatorValue(start.Name.Local)
+	if err != nil {
+		return err
+	}
+
+	return d.DecodeElement(m.V, &start)
+}
+
+func (m Mutator) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	name, err := m.name()
+	if err != nil {
+		return err
+	}
+
+	return e.EncodeElement(m.V, xml.StartElement{Name: xml.Name{Local: name}})
 }
 
 type ByGroups struct {
 	ByGroupsElements []ByGroupsElement `xml:",any"`
 }
 
-// ByGroups contains usingself and token elements intermixed, and the order matters.
+// ByGroups contains usingself, using, usingbygroup and token elements intermixed, and the order matters.
 // We preserve the order by representing either of those elements by a ByGroupsElement
 type ByGroupsElement struct {
 	V interface{}
 }
 
-func (m *ByGroupsElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
-
-	switch start.Name.Local {
+// newByGroupsElementValue returns a new value for the ByGroupsElement element with the given name.
+func newByGroupsElementValue(name string) (interface{}, error) {
+	switch name {
 	case "token":
-		m.V = &Token{}
+		return &Token{}, nil
 	case "usingself":
-		m.V = &UsingSelf{}
+		return &UsingSelf{}, nil
+	case "using":
+		return &Using{}, nil
+	case "usingbygroup":
+		return &UsingByGroup{}, nil
+	default:
+		return nil, fmt.Errorf("unknown element: %s", name)
+	}
+}
+
+// name returns the name of the element that m represents.
+func (m ByGroupsElement) name() (string, error) {
+	switch m.V.(type) {
+	case *Token:
+		return "token", nil
+	case *UsingSelf:
+		return "usingself", nil
+	case *Using:
+		return "using", nil
+	case *UsingByGroup:
+		return "usingbygroup", nil
 	default:
-		return fmt.Errorf("unknown element: %s", start)
+		return "", fmt.Errorf("unknown bygroups element type: %T", m.V)
 	}
+}
 
-	if err := d.DecodeElement(m.V, &start); err != nil {
+func (m *ByGroupsElement) UnmarshalXML(d *xml.Decoder, start xml.StartElement) (err error) {
+	m.V, err = newByGroupsElementValue(start.Name.Local)
+	if err != nil {
 		return err
 	}
-	return nil
+
+	return d.DecodeElement(m.V, &start)
+}
+
+func (m ByGroupsElement) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	name, err := m.name()
+	if err != nil {
+		return err
+	}
+
+	return e.EncodeElement(m.V, xml.StartElement{Name: xml.Name{Local: name}})
 }
 
 type UsingSelf struct {
-	State string `xml:"state,attr"`
+	State string `xml:"state,attr" json:"state" yaml:"state"`
 }
 
-func DecodeLexer(rdr io.Reader) (lex *Lexer, err error) {
-	dec := xml.NewDecoder(rdr)
+// Using requests that the matched text be lexed by the lexer with the given name.
+type Using struct {
+	Lexer string `xml:"lexer,attr" json:"lexer" yaml:"lexer"`
+}
+
+// UsingByGroup requests that the group be lexed by the lexer named by the text of the group numbered
+// SublexerNameGroup in the same match. If there is no such lexer the group is emitted as a token of type Fallback.
+type UsingByGroup struct {
+	SublexerNameGroup int    `xml:"sublexer_name_group,attr" json:"sublexer_name_group" yaml:"sublexer_name_group"`
+	Fallback          string `xml:"fallback,attr,omitempty" json:"fallback,omitempty" yaml:"fallback,omitempty"`
+}
 
-	err = dec.Decode(&lex)
+// DecodeLexer reads a lexer definition in XML format. Use DecodeLexerWithPositions to also find where
+// in the input each state and rule is defined.
+func DecodeLexer(rdr io.Reader) (lex *Lexer, err error) {
+	lex, _, err = DecodeLexerWithPositions(rdr)
 	return
 }
 
+// EncodeLexer writes lex as XML in a canonical form: the lists of aliases, filenames and MIME types
+// in the config are sorted, elements are indented by two spaces, and elements without content are
+// written as empty-element tags. Decoding the result with DecodeLexer produces a Lexer equal to lex
+// except for the order of those lists.
+func EncodeLexer(w io.Writer, lex *Lexer) error {
+	canon := *lex
+	canon.Config.Aliases = sortedCopy(lex.Config.Aliases)
+	canon.Config.Filenames = sortedCopy(lex.Config.Filenames)
+	canon.Config.MimeTypes = sortedCopy(lex.Config.MimeTypes)
+
+	var buf bytes.Buffer
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	err := enc.Encode(&canon)
+	if err != nil {
+		return err
+	}
+
+	out := emptyElementRegexp.ReplaceAllFunc(buf.Bytes(), func(m []byte) []byte {
+		parts := emptyElementRegexp.FindSubmatch(m)
+		if !bytes.Equal(parts[1], parts[3]) {
+			return m
+		}
+		return []byte(fmt.Sprintf("<%s%s/>", parts[1], parts[2]))
+	})
+
+	_, err = w.Write(out)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// emptyElementRegexp matches an element with no content, like <token type="Text"></token>. Attribute
+// values never contain < or > since the encoder escapes them.
+var emptyElementRegexp = regexp.MustCompile(`<(\w+)([^<>]*)></(\w+)>`)
+
+func sortedCopy(s []string) []string {
+	if s == nil {
+		return nil
+	}
+	c := make([]string, len(s))
+	copy(c, s)
+	sort.Strings(c)
+	return c
+}
+
 type Combined struct {
-	States []string `xml:"state,attr"`
+	States []string `xml:"state,attr" json:"states" yaml:"states"`
 }
@@ -2,6 +2,7 @@ package config
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -136,3 +137,318 @@ func TestXmlDecode(t *testing.T) {
 	assert.Equal(expected, lex.Rules)
 
 }
+
+func TestXmlDecodeRegexpFlags(t *testing.T) {
+	inp := `
+<lexer>
+  <config>
+    <name>SQL</name>
+    <case_insensitive>true</case_insensitive>
+    <dot_all>true</dot_all>
+    <not_multiline>true</not_multiline>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="SELECT" case_insensitive="false">
+        <token type="Keyword"/>
+      </rule>
+      <rule pattern=".">
+        <token type="Text"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	buf := bytes.NewBuffer([]byte(inp))
+	assert := assert.New(t)
+
+	lex, err := DecodeLexer(buf)
+	if err != nil {
+		t.Fatalf("Decoding XML failed: %v\n", err)
+	}
+
+	assert.True(lex.Config.CaseInsensitive)
+	assert.True(lex.Config.DotAll)
+	assert.True(lex.Config.NotMultiline)
+
+	rules := lex.Rules.States[0].Rules
+	if assert.NotNil(rules[0].CaseInsensitive) {
+		assert.False(*rules[0].CaseInsensitive)
+	}
+	assert.Nil(rules[0].DotAll)
+	assert.Nil(rules[0].NotMultiline)
+	assert.Nil(rules[1].CaseInsensitive)
+}
+
+func TestXmlDecodeAnalyse(t *testing.T) {
+	inp := `
+<lexer>
+  <config>
+    <name>Bash</name>
+    <analyse first="true">
+      <regex pattern="^#!/bin/bash" score="1.0"/>
+      <regex pattern="echo" score="0.25"/>
+    </analyse>
+  </config>
+</lexer>`
+
+	buf := bytes.NewBuffer([]byte(inp))
+	assert := assert.New(t)
+
+	lex, err := DecodeLexer(buf)
+	if err != nil {
+		t.Fatalf("Decoding XML failed: %v\n", err)
+	}
+
+	expected := &Analyse{
+		First: true,
+		Regexes: []Regex{
+			{Pattern: "^#!/bin/bash", Score: 1.0},
+			{Pattern: "echo", Score: 0.25},
+		},
+	}
+	assert.Equal(expected, lex.Config.Analyse)
+}
+
+func TestXmlDecodeMutators(t *testing.T) {
+	inp := `
+<lexer>
+  <config>
+    <name>Test</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="x">
+        <token type="Keyword"/>
+        <mutators>
+          <pop depth="1"/>
+          <push state="a"/>
+          <push/>
+        </mutators>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	buf := bytes.NewBuffer([]byte(inp))
+	assert := assert.New(t)
+
+	lex, err := DecodeLexer(buf)
+	if err != nil {
+		t.Fatalf("Decoding XML failed: %v\n", err)
+	}
+
+	expected := &Mutators{
+		Mutators: []Mutator{
+			{V: &Pop{Depth: 1}},
+			{V: &Push{State: "a"}},
+			{V: &Push{}},
+		},
+	}
+	assert.Equal(expected, lex.Rules.States[0].Rules[0].Mutators)
+}
+
+func TestXmlDecodePositions(t *testing.T) {
+	inp := `<lexer>
+  <config>
+    <name>Positions</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="a"><token type="Text"/></rule>
+      <rule pattern="é"><token type="Text"/></rule> <rule pattern="b"><token type="Text"/></rule>
+    </state>
+    <state name="empty"/>
+    <state name="other">
+      <rule>
+        <include state="root"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	assert := assert.New(t)
+
+	lex, pos, err := DecodeLexerWithPositions(bytes.NewBufferString(inp))
+	if err != nil {
+		t.Fatalf("Decoding XML failed: %v\n", err)
+	}
+
+	assert.Len(lex.Rules.States, 3)
+	assert.Equal([]Position{{Offset: 72, Line: 6, Column: 5}, {Offset: 260, Line: 10, Column: 5}, {Offset: 286, Line: 11, Column: 5}}, pos.States)
+
+	assert.Len(pos.Rules, 3)
+	assert.Equal([]Position{{Line: 7, Column: 7}, {Line: 8, Column: 7}, {Line: 8, Column: 53}}, lines(pos.Rules[0]))
+	assert.Empty(pos.Rules[1])
+	assert.Equal([]Position{{Line: 12, Column: 7}}, lines(pos.Rules[2]))
+
+	p, ok := pos.Rule(0, 2)
+	assert.True(ok)
+	assert.Equal(p, pos.Rules[0][2])
+	_, ok = pos.Rule(1, 0)
+	assert.False(ok)
+
+	var none *Positions
+	_, ok = none.State(0)
+	assert.False(ok)
+}
+
+// lines returns the positions without their offsets.
+func lines(pos []Position) []Position {
+	var res []Position
+	for _, p := range pos {
+		p.Offset = 0
+		res = append(res, p)
+	}
+	return res
+}
+
+func TestXmlDecodeStrict(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   string
+		message string
+		line    int
+		column  int
+		state   string
+		rule    int
+	}{
+		{
+			name: "valid",
+			rules: `<state name="root">
+      <rule pattern="(a)(b)">
+        <bygroups><token type="Name"/><usingself state="root"/></bygroups>
+      </rule>
+      <rule pattern="c">
+        <token type="Text"/>
+        <mutators><pop depth="1"/><push state="root"/></mutators>
+      </rule>
+      <rule pattern="d" case_insensitive="true">
+        <token type="Text"/>
+        <combined state="root" state="root"/>
+      </rule>
+    </state>`,
+		},
+		{
+			name: "unknown element",
+			rules: `<state name="root">
+      <rule pattern="a"><token type="Text"/></rule>
+      <rule pattern="b"><usingSelf state="root"/></rule>
+    </state>`,
+			message: "unknown element <usingSelf> in <rule>",
+			line:    8, column: 25, state: "root", rule: 1,
+		},
+		{
+			name: "unknown attribute",
+			rules: `<state name="root">
+      <rule pattern="a"><token type="Text"/></rule>
+      <rule pattern="b"><token typ="Text"/></rule>
+    </state>`,
+			message: "unknown attribute typ on <token>",
+			line:    8, column: 25, state: "root", rule: 1,
+		},
+		{
+			name: "repeated attribute",
+			rules: `<state name="root">
+      <rule pattern="a"><push state="x" state="y"/></rule>
+    </state>`,
+			message: "the attribute state is given more than once on <push>",
+			line:    7, column: 25, state: "root", rule: 0,
+		},
+		{
+			name:    "text",
+			rules:   `<state name="root"><rule pattern="a">None</rule></state>`,
+			message: `unexpected text "None" in <rule>`,
+			line:    6, column: 42, state: "root", rule: 0,
+		},
+		{
+			name:    "outside a state",
+			rules:   `<rule pattern="a"/>`,
+			message: "unknown element <rule> in <rules>",
+			line:    6, column: 5, rule: -1,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			inp := `<lexer>
+  <config>
+    <name>Strict</name>
+  </config>
+  <rules>
+    ` + tc.rules + `
+  </rules>
+</lexer>`
+
+			_, _, err := DecodeLexerStrict(bytes.NewBufferString(inp))
+			if tc.message == "" {
+				assert.Nil(t, err)
+				return
+			}
+
+			schemaErr, ok := err.(*SchemaError)
+			if !ok {
+				t.Fatalf("Expected a SchemaError but got %v", err)
+			}
+			assert.Equal(t, tc.message, schemaErr.Message)
+			assert.Equal(t, tc.line, schemaErr.Line)
+			assert.Equal(t, tc.column, schemaErr.Column)
+			assert.Equal(t, tc.state, schemaErr.State)
+			assert.Equal(t, tc.rule, schemaErr.Rule)
+
+			// Without strict decoding the problem is ignored.
+			_, err = DecodeLexer(bytes.NewBufferString(inp))
+			assert.Nil(t, err)
+		})
+	}
+}
+
+func TestXmlDecodeVariables(t *testing.T) {
+	inp := `
+<lexer>
+  <config>
+    <name>Test</name>
+  </config>
+  <variables>
+    <var name="ident">[A-Za-z_]\w*</var>
+    <var name="call">{{ident}}\(</var>
+  </variables>
+  <rules>
+    <state name="root">
+      <rule pattern="{{call}}">
+        <token type="NameFunction"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	assert := assert.New(t)
+
+	expected := []Var{
+		{Name: "ident", Value: `[A-Za-z_]\w*`},
+		{Name: "call", Value: `{{ident}}\(`},
+	}
+
+	lex, _, err := DecodeLexerStrict(bytes.NewBufferString(inp))
+	if err != nil {
+		t.Fatalf("Decoding XML failed: %v\n", err)
+	}
+	assert.Equal(expected, lex.Variables)
+
+	var buf bytes.Buffer
+	err = EncodeLexer(&buf, lex)
+	if err != nil {
+		t.Fatalf("Encoding XML failed: %v\n", err)
+	}
+
+	lex, err = DecodeLexer(&buf)
+	if err != nil {
+		t.Fatalf("Decoding the encoded XML failed: %v\n", err)
+	}
+	assert.Equal(expected, lex.Variables)
+
+	// A variable may not contain elements.
+	bad := strings.Replace(inp, `[A-Za-z_]\w*`, `<token type="Name"/>`, 1)
+	_, _, err = DecodeLexerStrict(bytes.NewBufferString(bad))
+	assert.NotNil(err)
+}
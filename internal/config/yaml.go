@@ -0,0 +1,100 @@
+package config
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The YAML form of a lexer has the same structure as the JSON form. See json.go.
+
+func DecodeLexerYAML(rdr io.Reader) (lex *Lexer, err error) {
+	dec := yaml.NewDecoder(rdr)
+
+	err = dec.Decode(&lex)
+	if err == nil && lex == nil {
+		err = errNoLexer
+	}
+	return
+}
+
+// EncodeLexerYAML writes lex as YAML.
+func EncodeLexerYAML(w io.Writer, lex *Lexer) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	err := enc.Encode(lex)
+	if err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+func (b ByGroups) MarshalYAML() (interface{}, error) {
+	return b.ByGroupsElements, nil
+}
+
+func (b *ByGroups) UnmarshalYAML(value *yaml.Node) error {
+	return value.Decode(&b.ByGroupsElements)
+}
+
+func (m ByGroupsElement) MarshalYAML() (interface{}, error) {
+	name, err := m.name()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{name: m.V}, nil
+}
+
+func (m *ByGroupsElement) UnmarshalYAML(value *yaml.Node) (err error) {
+	name, node, err := singleYAMLField(value)
+	if err != nil {
+		return err
+	}
+
+	m.V, err = newByGroupsElementValue(name)
+	if err != nil {
+		return err
+	}
+	return node.Decode(m.V)
+}
+
+func (m Mutators) MarshalYAML() (interface{}, error) {
+	return m.Mutators, nil
+}
+
+func (m *Mutators) UnmarshalYAML(value *yaml.Node) error {
+	return value.Decode(&m.Mutators)
+}
+
+func (m Mutator) MarshalYAML() (interface{}, error) {
+	name, err := m.name()
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{name: m.V}, nil
+}
+
+func (m *Mutator) UnmarshalYAML(value *yaml.Node) (err error) {
+	name, node, err := singleYAMLField(value)
+	if err != nil {
+		return err
+	}
+
+	m.V, err = newMutatorValue(name)
+	if err != nil {
+		return err
+	}
+	return node.Decode(m.V)
+}
+
+// singleYAMLField checks that value is a mapping with exactly one key, and returns
+// the key and its value.
+func singleYAMLField(value *yaml.Node) (name string, node *yaml.Node, err error) {
+	if value.Kind != yaml.MappingNode || len(value.Content) != 2 {
+		err = fmt.Errorf("line %d: expected a mapping with exactly one key", value.Line)
+		return
+	}
+
+	return value.Content[0].Value, value.Content[1], nil
+}
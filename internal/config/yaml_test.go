@@ -0,0 +1,116 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestYamlDecode(t *testing.T) {
+	inp := `
+config:
+  name: C
+  aliases: [c]
+  filenames:
+    - "*.c"
+    - "*.h"
+  ensure_nl: true
+rules:
+  states:
+    - name: statement
+      rules:
+        - include: {state: whitespace}
+        - pattern: ;
+          token: {type: Punctuation}
+          pop: {depth: 1}
+        - pattern: '"'
+          bygroups:
+            - usingself: {state: root}
+            - token: {type: NameFunction}
+          combined: {states: [a, b]}
+        - pattern: x
+          case_insensitive: true
+          mutators:
+            - pop: {depth: 1}
+            - push: {state: a}
+`
+
+	assert := assert.New(t)
+
+	lex, err := DecodeLexerYAML(strings.NewReader(inp))
+	if err != nil {
+		t.Fatalf("Decoding YAML failed: %v\n", err)
+	}
+
+	jsonLex, err := DecodeLexerJSON(strings.NewReader(`
+{
+  "config": {"name": "C", "aliases": ["c"], "filenames": ["*.c", "*.h"], "ensure_nl": true},
+  "rules": {
+    "states": [
+      {
+        "name": "statement",
+        "rules": [
+          {"include": {"state": "whitespace"}},
+          {"pattern": ";", "token": {"type": "Punctuation"}, "pop": {"depth": 1}},
+          {
+            "pattern": "\"",
+            "bygroups": [{"usingself": {"state": "root"}}, {"token": {"type": "NameFunction"}}],
+            "combined": {"states": ["a", "b"]}
+          },
+          {"pattern": "x", "case_insensitive": true, "mutators": [{"pop": {"depth": 1}}, {"push": {"state": "a"}}]}
+        ]
+      }
+    ]
+  }
+}`))
+	if err != nil {
+		t.Fatalf("Decoding JSON failed: %v\n", err)
+	}
+
+	assert.Equal(jsonLex, lex)
+}
+
+func TestYamlDecodeNull(t *testing.T) {
+	for _, inp := range []string{"~", "null"} {
+		lex, err := DecodeLexerYAML(strings.NewReader(inp))
+		assert.Nil(t, lex)
+		assert.Equal(t, errNoLexer, err, inp)
+	}
+}
+
+func TestYamlRoundTrip(t *testing.T) {
+	paths, err := filepath.Glob("../../lexers/embedded/*.xml")
+	if err != nil {
+		t.Fatalf("Listing lexers failed: %v", err)
+	}
+
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatalf("Opening %s failed: %v", path, err)
+		}
+		lex, err := DecodeLexer(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Decoding %s failed: %v", path, err)
+		}
+
+		var buf bytes.Buffer
+		err = EncodeLexerYAML(&buf, lex)
+		if err != nil {
+			t.Fatalf("Encoding %s as YAML failed: %v", path, err)
+		}
+
+		lex2, err := DecodeLexerYAML(&buf)
+		if err != nil {
+			t.Fatalf("Decoding YAML for %s failed: %v", path, err)
+		}
+
+		lex2.XMLName = lex.XMLName
+		assert.Equal(t, lex, lex2, "lexer %s", path)
+	}
+}
@@ -0,0 +1,187 @@
+// Package grammar contains the parts of converting TextMate-style grammars into syn Lexers that don't
+// depend on the format the grammar is written in.
+package grammar
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/dlclark/regexp2"
+	"github.com/jeffwilliams/syn"
+)
+
+// Lexer is a lexer being converted from a grammar. Its states are added as the grammar is converted,
+// and then it is built into a syn Lexer using a LexerDef.
+type Lexer struct {
+	States []*State
+	index  map[string]*State
+	// children counts the states created within each state, and is used to name them.
+	children map[string]int
+	warn     func(path, message string)
+}
+
+// State is a state of a Lexer.
+type State struct {
+	Name  string
+	Rules []Rule
+}
+
+// Rule is a rule of a State. Either Include or Pattern is set.
+type Rule struct {
+	// Path locates the part of the grammar that the rule was converted from.
+	Path    string
+	Include string
+	Pattern string
+	Actions []syn.RuleAction
+}
+
+// NewLexer returns a new Lexer. warn is called with a description of each part of the grammar that can't be
+// converted or is converted only approximately.
+func NewLexer(warn func(path, message string)) *Lexer {
+	return &Lexer{
+		index:    map[string]*State{},
+		children: map[string]int{},
+		warn:     warn,
+	}
+}
+
+// Warn reports a part of the grammar that can't be converted or is converted only approximately.
+func (l *Lexer) Warn(path, format string, args ...interface{}) {
+	l.warn(path, fmt.Sprintf(format, args...))
+}
+
+// AddState adds a new state with the given name.
+func (l *Lexer) AddState(name string) *State {
+	st := &State{Name: name}
+	l.States = append(l.States, st)
+	l.index[name] = st
+	return st
+}
+
+// State returns the state with the given name, or nil if there is none.
+func (l *Lexer) State(name string) *State {
+	return l.index[name]
+}
+
+// NewChildStateName returns a new name for an unnamed state created within the named state.
+func (l *Lexer) NewChildStateName(parent string) string {
+	l.children[parent]++
+	return fmt.Sprintf("%s.%d", parent, l.children[parent])
+}
+
+// MatchRule converts the pattern and returns a rule that emits tokens for its match. captures gives the token
+// types of the capture groups that have a scope, and typ is the token type for the rest of the match. If the
+// pattern can't be used, a warning is reported and ok is false.
+func (l *Lexer) MatchRule(path, pattern string, captures map[int]syn.TokenType, typ syn.TokenType) (r Rule, ok bool) {
+	r.Path = path
+
+	if len(captures) > 0 {
+		newPattern, groups, nested, err := SplitByCaptures(pattern)
+		if err == nil {
+			sort.Ints(nested)
+			for _, n := range nested {
+				if _, ok := captures[n]; ok {
+					l.Warn(path, "the scope of capture %d is ignored since the group is repeated or within another group", n)
+				}
+			}
+
+			var groupActions []syn.GroupAction
+			for _, n := range groups {
+				t, ok := captures[n]
+				if !ok {
+					t = typ
+				}
+				groupActions = append(groupActions, syn.Emit(t))
+			}
+
+			r.Pattern = newPattern
+			r.Actions = []syn.RuleAction{syn.ByGroups(groupActions...)}
+			ok = l.checkRegex(newPattern, path)
+			return
+		}
+
+		l.Warn(path, "the captures are ignored since %s", err)
+	}
+
+	newPattern, err := ConvertRegex(pattern)
+	if err != nil {
+		l.Warn(path, "the pattern is invalid: %s", err)
+		return
+	}
+
+	r.Pattern = newPattern
+	r.Actions = []syn.RuleAction{syn.Emit(typ)}
+	ok = l.checkRegex(newPattern, path)
+	return
+}
+
+func (l *Lexer) checkRegex(pattern, path string) bool {
+	_, err := regexp2.Compile(pattern, 0)
+	if err != nil {
+		l.Warn(path, "the pattern is not supported: %s", err)
+		return false
+	}
+	return true
+}
+
+// FallbackRule returns a rule that emits any character as a token of type typ. It is placed last in
+// the states that are pushed so that text that no pattern matches is given the scope of the enclosing
+// pattern or context, rather than being an error.
+func FallbackRule(typ syn.TokenType) Rule {
+	return Rule{Pattern: `[\s\S]`, Actions: []syn.RuleAction{syn.Emit(typ)}}
+}
+
+// BreakIncludeCycles removes includes that would make a state include itself, which the grammar formats
+// tolerate but syn doesn't.
+func (l *Lexer) BreakIncludeCycles() {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := map[string]int{}
+
+	var visit func(st *State)
+	visit = func(st *State) {
+		marks[st.Name] = visiting
+
+		rules := st.Rules[:0]
+		for _, r := range st.Rules {
+			if r.Include != "" {
+				switch marks[r.Include] {
+				case visiting:
+					l.Warn(r.Path, "the include of %s is removed since it includes itself", r.Include)
+					continue
+				case unvisited:
+					visit(l.index[r.Include])
+				}
+			}
+			rules = append(rules, r)
+		}
+		st.Rules = rules
+
+		marks[st.Name] = visited
+	}
+
+	for _, st := range l.States {
+		if marks[st.Name] == unvisited {
+			visit(st)
+		}
+	}
+}
+
+// Build adds the states of the Lexer to def and builds it.
+func (l *Lexer) Build(def *syn.LexerDef) (*syn.Lexer, error) {
+	for _, st := range l.States {
+		def.State(st.Name)
+		for _, r := range st.Rules {
+			if r.Include != "" {
+				def.Include(r.Include)
+				continue
+			}
+			def.Rule(r.Pattern, r.Actions...)
+		}
+	}
+
+	return def.Build()
+}
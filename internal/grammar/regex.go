@@ -0,0 +1,439 @@
+package grammar
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// TextMate-style grammars use Oniguruma regular expressions, while syn uses regexp2. The two are mostly
+// compatible. The code here converts the few constructs that differ, and rewrites patterns that have
+// captures so that the capture groups cover the whole match, which is what syn's bygroups needs.
+
+type regexTokenKind int
+
+const (
+	// An escape, character class, literal character, anchor, comment or inline option setting
+	regexAtom regexTokenKind = iota
+	regexOpen
+	regexClose
+	regexAlternation
+	regexQuantifier
+)
+
+type regexToken struct {
+	kind regexTokenKind
+	text string
+	// capture is the number of the group for a regexOpen that starts a capturing group, and 0 otherwise.
+	capture int
+	// options is true for an atom that sets options for the rest of the enclosing group, like (?i)
+	options bool
+	// backref is true for an atom that is a backreference
+	backref bool
+	// zeroWidth is true for an atom that never matches any text, like an anchor or a comment, and
+	// for a regexOpen that starts a lookaround.
+	zeroWidth bool
+}
+
+// scanRegex splits the regular expression into tokens, converting Oniguruma-only escapes to their
+// equivalents as it goes. It returns the tokens and the number of capturing groups.
+func scanRegex(pattern string) (toks []regexToken, groups int, err error) {
+	s := []rune(pattern)
+	extended := false
+	depth := 0
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, 0, fmt.Errorf("pattern ends with a backslash")
+			}
+			tok := regexToken{kind: regexAtom}
+			tok.text, tok.backref = convertEscape(s[i+1], false)
+			tok.zeroWidth = strings.ContainsRune("bBAGzZ", s[i+1])
+			i += 2
+			if s[i-1] == 'k' && i < len(s) && (s[i] == '<' || s[i] == '\'') {
+				closer := '>'
+				if s[i] == '\'' {
+					closer = '\''
+				}
+				end := indexRune(s, i+1, closer)
+				if end < 0 {
+					return nil, 0, fmt.Errorf("unterminated named backreference")
+				}
+				tok.text += string(s[i : end+1])
+				i = end + 1
+			}
+			toks = append(toks, tok)
+		case c == '[':
+			end, text, err := scanClass(s, i)
+			if err != nil {
+				return nil, 0, err
+			}
+			toks = append(toks, regexToken{kind: regexAtom, text: text})
+			i = end
+		case c == '(':
+			if strings.HasPrefix(string(s[i:]), "(?#") {
+				end := indexRune(s, i, ')')
+				if end < 0 {
+					return nil, 0, fmt.Errorf("unterminated comment")
+				}
+				toks = append(toks, regexToken{kind: regexAtom, text: string(s[i : end+1]), zeroWidth: true})
+				i = end + 1
+				continue
+			}
+
+			if opts, n := scanInlineOptions(s, i); n > 0 {
+				if strings.Contains(strings.SplitN(opts, "-", 2)[0], "x") {
+					extended = true
+				}
+				toks = append(toks, regexToken{kind: regexAtom, text: string(s[i : i+n]), options: true, zeroWidth: true})
+				i += n
+				continue
+			}
+
+			open, capturing := scanGroupOpen(s, i)
+			tok := regexToken{kind: regexOpen, text: open, zeroWidth: isLookaround(open)}
+			if capturing {
+				groups++
+				tok.capture = groups
+			}
+			toks = append(toks, tok)
+			depth++
+			i += len([]rune(open))
+		case c == ')':
+			if depth == 0 {
+				return nil, 0, fmt.Errorf("unmatched )")
+			}
+			depth--
+			toks = append(toks, regexToken{kind: regexClose, text: ")"})
+			i++
+		case c == '|':
+			toks = append(toks, regexToken{kind: regexAlternation, text: "|"})
+			i++
+		case c == '*' || c == '+' || c == '?' || (c == '{' && isCountedQuantifier(s, i)):
+			end := i + 1
+			if c == '{' {
+				end = indexRune(s, i, '}') + 1
+			}
+			if end < len(s) && (s[end] == '?' || s[end] == '+') {
+				end++
+			}
+			toks = append(toks, regexToken{kind: regexQuantifier, text: string(s[i:end])})
+			i = end
+		case extended && c == '#':
+			end := indexRune(s, i, '\n')
+			if end < 0 {
+				end = len(s) - 1
+			}
+			toks = append(toks, regexToken{kind: regexAtom, text: string(s[i : end+1]), zeroWidth: true})
+			i = end + 1
+		default:
+			zeroWidth := c == '^' || c == '$' || (extended && unicode.IsSpace(c))
+			toks = append(toks, regexToken{kind: regexAtom, text: string(c), zeroWidth: zeroWidth})
+			i++
+		}
+	}
+
+	if depth != 0 {
+		return nil, 0, fmt.Errorf("unmatched (")
+	}
+	return
+}
+
+// convertEscape returns the regexp2 equivalent of the escape \c, and whether it is a backreference.
+func convertEscape(c rune, inClass bool) (text string, backref bool) {
+	switch c {
+	case 'h':
+		if inClass {
+			return "0-9a-fA-F", false
+		}
+		return "[0-9a-fA-F]", false
+	case 'H':
+		if inClass {
+			// There is no way to express this within a class in regexp2, so it is left to fail to compile.
+			return `\H`, false
+		}
+		return "[^0-9a-fA-F]", false
+	case 'k':
+		return `\k`, !inClass
+	}
+
+	if c >= '1' && c <= '9' && !inClass {
+		return `\` + string(c), true
+	}
+	return `\` + string(c), false
+}
+
+// scanClass scans the character class starting at s[start], which may contain nested classes.
+// It returns the index just past the class and the converted text of the class.
+func scanClass(s []rune, start int) (end int, text string, err error) {
+	var b strings.Builder
+	depth := 0
+	i := start
+	for i < len(s) {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			t, _ := convertEscape(s[i+1], true)
+			b.WriteString(t)
+			i += 2
+			continue
+		case c == '[':
+			depth++
+			b.WriteRune(c)
+			i++
+			// A ] right after the opening [ or [^ is a literal.
+			if i < len(s) && s[i] == '^' {
+				b.WriteRune('^')
+				i++
+			}
+			if i < len(s) && s[i] == ']' {
+				b.WriteRune(']')
+				i++
+			}
+			continue
+		case c == ']':
+			depth--
+			b.WriteRune(c)
+			i++
+			if depth == 0 {
+				return i, b.String(), nil
+			}
+			continue
+		}
+		b.WriteRune(c)
+		i++
+	}
+	return 0, "", fmt.Errorf("unterminated character class")
+}
+
+// scanInlineOptions returns the options and the length of an option setting like (?i) or (?x-s)
+// at s[start]. The length is 0 if there is none.
+func scanInlineOptions(s []rune, start int) (opts string, n int) {
+	if start+2 >= len(s) || s[start+1] != '?' {
+		return "", 0
+	}
+	i := start + 2
+	for i < len(s) && strings.ContainsRune("imsxn-", s[i]) {
+		i++
+	}
+	if i == start+2 || i >= len(s) || s[i] != ')' {
+		return "", 0
+	}
+	return string(s[start+2 : i]), i - start + 1
+}
+
+// scanGroupOpen returns the text that opens the group at s[start], like ( or (?: or (?<name>, and
+// whether the group is a capturing group.
+func scanGroupOpen(s []rune, start int) (open string, capturing bool) {
+	rest := string(s[start:])
+	if !strings.HasPrefix(rest, "(?") {
+		return "(", true
+	}
+
+	for _, prefix := range []string{"(?<=", "(?<!", "(?=", "(?!", "(?>", "(?:"} {
+		if strings.HasPrefix(rest, prefix) {
+			return prefix, false
+		}
+	}
+
+	for _, p := range [][2]string{{"(?P<", ">"}, {"(?<", ">"}, {"(?'", "'"}} {
+		if strings.HasPrefix(rest, p[0]) {
+			end := strings.Index(rest[len(p[0]):], p[1])
+			if end >= 0 {
+				return rest[:len(p[0])+end+1], true
+			}
+		}
+	}
+
+	// An option group like (?i:...)
+	i := start + 2
+	for i < len(s) && strings.ContainsRune("imsxn-", s[i]) {
+		i++
+	}
+	if i < len(s) && s[i] == ':' {
+		return string(s[start : i+1]), false
+	}
+	return "(?", false
+}
+
+func isLookaround(open string) bool {
+	switch open {
+	case "(?=", "(?!", "(?<=", "(?<!":
+		return true
+	}
+	return false
+}
+
+func isCountedQuantifier(s []rune, start int) bool {
+	end := indexRune(s, start, '}')
+	if end < 0 {
+		return false
+	}
+
+	body := string(s[start+1 : end])
+	if body == "" || body == "," {
+		return false
+	}
+	for _, c := range body {
+		if (c < '0' || c > '9') && c != ',' {
+			return false
+		}
+	}
+	return true
+}
+
+func indexRune(s []rune, start int, r rune) int {
+	for i := start; i < len(s); i++ {
+		if s[i] == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// ConvertRegex converts an Oniguruma regular expression to regexp2 syntax without changing
+// its groups.
+func ConvertRegex(pattern string) (string, error) {
+	toks, _, err := scanRegex(pattern)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, t := range toks {
+		b.WriteString(t.text)
+	}
+	return b.String(), nil
+}
+
+// SplitByCaptures rewrites pattern so that the match is covered by a sequence of capture groups, one
+// for each top-level capture group of the original pattern and one for each run of text between them.
+// Text between the groups that is only anchors or lookarounds is not put in a group. It returns the new
+// pattern and, for each of its groups, the number of the group in the original
+// pattern or 0 for the groups around the text between them.
+//
+// Captures nested within other groups are made non-capturing and reported in nested, since the text they
+// match is part of a single token in syn. A top-level group that is repeated is treated as text between groups.
+func SplitByCaptures(pattern string) (newPattern string, groups []int, nested []int, err error) {
+	toks, _, err := scanRegex(pattern)
+	if err != nil {
+		return
+	}
+
+	depth := 0
+	for _, t := range toks {
+		switch {
+		case t.kind == regexOpen:
+			depth++
+		case t.kind == regexClose:
+			depth--
+		case t.kind == regexAlternation && depth == 0:
+			err = fmt.Errorf("the pattern has alternatives at the top level")
+			return
+		case t.backref:
+			err = fmt.Errorf("the pattern contains a backreference")
+			return
+		}
+	}
+
+	// run holds the text between capture groups. Unless it can match some text it isn't put in a group,
+	// which would only produce empty tokens.
+	var b, run strings.Builder
+	runMatchesText := false
+	flush := func() {
+		if !runMatchesText {
+			b.WriteString(run.String())
+		} else {
+			b.WriteString("(")
+			b.WriteString(run.String())
+			b.WriteString(")")
+			groups = append(groups, 0)
+		}
+		run.Reset()
+		runMatchesText = false
+	}
+
+	for i := 0; i < len(toks); {
+		t := toks[i]
+		end := i + 1
+		if t.kind == regexOpen {
+			end = closingToken(toks, i) + 1
+		}
+		quantified := end < len(toks) && toks[end].kind == regexQuantifier
+		if quantified {
+			end++
+		}
+
+		switch {
+		case t.options:
+			// Options apply to the rest of the enclosing group, so they can't be moved inside a new group.
+			flush()
+			b.WriteString(t.text)
+		case t.kind == regexOpen && t.capture > 0 && !quantified:
+			flush()
+			b.WriteString("(")
+			nested = appendWithoutCaptures(&b, toks[i+1:end-1], nested)
+			b.WriteString(")")
+			groups = append(groups, t.capture)
+		default:
+			nested = appendWithoutCaptures(&run, toks[i:end], nested)
+			if !t.zeroWidth {
+				runMatchesText = true
+			}
+		}
+		i = end
+	}
+	flush()
+
+	newPattern = b.String()
+	return
+}
+
+// appendWithoutCaptures writes the text of the tokens, making capturing groups non-capturing. The numbers
+// of those groups are appended to nested.
+func appendWithoutCaptures(b *strings.Builder, toks []regexToken, nested []int) []int {
+	for _, t := range toks {
+		if t.kind == regexOpen && t.capture > 0 {
+			b.WriteString("(?:")
+			nested = append(nested, t.capture)
+			continue
+		}
+		b.WriteString(t.text)
+	}
+	return nested
+}
+
+// closingToken returns the index of the regexClose token that matches the regexOpen token at toks[open].
+func closingToken(toks []regexToken, open int) int {
+	depth := 0
+	for i := open; i < len(toks); i++ {
+		switch toks[i].kind {
+		case regexOpen:
+			depth++
+		case regexClose:
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(toks) - 1
+}
+
+// HasBackref returns true if the pattern contains a backreference.
+func HasBackref(pattern string) bool {
+	toks, _, err := scanRegex(pattern)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range toks {
+		if t.backref {
+			return true
+		}
+	}
+	return false
+}
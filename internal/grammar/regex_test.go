@@ -0,0 +1,39 @@
+package grammar
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitByCaptures(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		pattern string
+		split   string
+		groups  []int
+		nested  []int
+		err     bool
+	}{
+		{pattern: `(a)\s+(b)`, split: `(a)(\s+)(b)`, groups: []int{1, 0, 2}},
+		{pattern: `(?i)(a)b`, split: `(?i)(a)(b)`, groups: []int{1, 0}},
+		{pattern: `(a(b))(c)+d`, split: `(a(?:b))((?:c)+d)`, groups: []int{1, 0}, nested: []int{2, 3}},
+		{pattern: `(?:x|y)(z)`, split: `((?:x|y))(z)`, groups: []int{0, 1}},
+		{pattern: `[()](\h+)`, split: `([()])([0-9a-fA-F]+)`, groups: []int{0, 1}},
+		{pattern: `(a)|(b)`, err: true},
+		{pattern: `(a)\1`, err: true},
+	}
+
+	for _, tc := range tests {
+		split, groups, nested, err := SplitByCaptures(tc.pattern)
+		if tc.err {
+			assert.NotNil(err, "pattern %s", tc.pattern)
+			continue
+		}
+		assert.Nil(err, "pattern %s", tc.pattern)
+		assert.Equal(tc.split, split, "pattern %s", tc.pattern)
+		assert.Equal(tc.groups, groups, "pattern %s", tc.pattern)
+		assert.Equal(tc.nested, nested, "pattern %s", tc.pattern)
+	}
+}
@@ -3,8 +3,6 @@ package syn
 import (
 	"bytes"
 	"fmt"
-
-	"github.com/dlclark/regexp2"
 )
 
 type Iterator interface {
@@ -33,12 +31,14 @@ type iterator struct {
 	sublexers []*iterator
 	rules     rules
 	depth     int
+	// registry is used to find the lexers referred to by <using> elements.
+	registry *LexerRegistry
 }
 
 func newIterator(text []rune, rulez rules) *iterator {
 	iter := &iterator{
 		text:  text,
-		state: lexerState{stack: newStack()},
+		state: lexerState{stack: newStack(), rules: rulez, length: len(text)},
 		rules: rulez,
 	}
 
@@ -106,6 +106,8 @@ func (i *iterator) Next() (Token, error) {
 		return i.nextInWithinGroupsStage()
 	case stageRunningSublexer:
 		return i.nextInSublexer()
+	case stageWithinDelimited:
+		return i.nextInWithinDelimitedStage()
 	default:
 		return Token{}, fmt.Errorf("Unsupported lexer stage %d", i.state.stage)
 	}
@@ -120,7 +122,8 @@ func (i *iterator) nextInReadyToMatchStage() (tok Token, err error) {
 
 	state := i.state.stack.Top()
 	debugf("iterator.nextInReadyToMatchStage(%d): Matching a full rule in top state %s", i.depth, state.name)
-	match, rule := state.match(i.text[i.state.index:])
+	text := i.text[i.state.index:]
+	match, rule := state.match(i.text, i.state.index, i.state.stack)
 	if match == nil {
 		debugf("iterator.nextInReadyToMatchStage(%d): No rule in the rule sequence matched", i.depth)
 		i.state.index++
@@ -140,14 +143,29 @@ func (i *iterator) nextInReadyToMatchStage() (tok Token, err error) {
 		return Token{Type: Error, Value: nil, Start: i.state.index - 1, End: i.state.index}, nil
 	}
 
+	if rule.delimited != nil {
+		i.state.rule = rule
+		i.state.delimitedDepth = 0
+		i.state.stage = stageWithinDelimited
+		return i.Next()
+	}
+
+	if rule.call != nil {
+		return i.nextForCall(rule, match)
+	}
+
 	if rule.byGroups != nil {
 		i.prepareToIterateGroups(rule, match)
 		return i.Next()
 	}
 
-	if rule.IsUseSelf() {
-		groupText := i.groupText(match.GroupByNumber(0))
-		i.prepareToUseSublexer(rule, groupText, 0, rule.useSelfState)
+	if rule.IsUseSelf() || rule.IsUsing() {
+		i.setCapturesFromMatch(match)
+		groupText := i.groupText(match.groups[0])
+		err = i.prepareToUseSublexer(rule, groupText, 0, rule.useSelfState, rule.usingLexer)
+		if err != nil {
+			return
+		}
 		return i.Next()
 	}
 
@@ -158,13 +176,12 @@ func (i *iterator) nextInReadyToMatchStage() (tok Token, err error) {
 		debugf("iterator.nextInReadyToMatchStage(%d): will return token for entire match\n", i.depth)
 		// Use entire match
 		tok = i.tokenOfEntireMatch(rule.tok, match)
-		g := match.GroupByNumber(0)
-		debugf("iterator.nextInReadyToMatchStage(%d): Moving index from %d to %d (some text there is: '%s')", i.depth, i.state.index, i.state.index+g.Length,
-			aLittleText(i.text, i.state.index+g.Length))
-		i.state.index += g.Length
+		debugf("iterator.nextInReadyToMatchStage(%d): Moving index from %d to %d (some text there is: '%s')", i.depth, i.state.index, i.state.index+match.length(),
+			aLittleText(i.text, i.state.index+match.length()))
+		i.state.index += match.length()
 	}
 
-	err = i.handleRuleState(rule)
+	err = i.handleRuleState(rule, match.groups, text)
 	if err != nil {
 		return
 	}
@@ -178,7 +195,7 @@ func (i *iterator) nextInReadyToMatchStage() (tok Token, err error) {
 	return
 }
 
-func (i *iterator) prepareToIterateGroups(matchingRule *rule, match *regexp2.Match) {
+func (i *iterator) prepareToIterateGroups(matchingRule *rule, match *match) {
 	i.state.rule = matchingRule
 	i.setCapturesFromMatch(match)
 	i.state.groupIndex = 0
@@ -186,12 +203,33 @@ func (i *iterator) prepareToIterateGroups(matchingRule *rule, match *regexp2.Mat
 	i.state.byGroups = matchingRule.byGroups
 }
 
-func (it *iterator) setCapturesFromMatch(match *regexp2.Match) {
-	it.state.groups = make([]capture, match.GroupCount())
-	for i, g := range match.Groups() {
-		debugf("iterator.setCapturesFromMatch(%d): group %d in match is at %d of length %d", it.depth, i, g.Index, g.Length)
-		it.state.groups[i].start = g.Index
-		it.state.groups[i].length = g.Length
+// nextForCall returns the first token returned by the function of the call rule that matched. The rest of the
+// tokens are returned like the groups of a bygroups rule.
+func (i *iterator) nextForCall(rule *rule, match *match) (Token, error) {
+	if len(match.call.types) == 0 {
+		debugf("iterator.nextForCall(%d): the function %s returned no tokens", i.depth, rule.call.name)
+		i.state.index += match.length()
+		err := i.applyMutators(match.call.mutators, nil, nil)
+		if err != nil {
+			return Token{}, err
+		}
+		return i.Next()
+	}
+
+	i.prepareToIterateGroups(rule, match)
+	i.state.byGroups = make([]byGroupElement, len(match.call.types))
+	for j, typ := range match.call.types {
+		i.state.byGroups[j].tok = typ
+	}
+	i.state.callMutators = match.call.mutators
+	return i.Next()
+}
+
+func (it *iterator) setCapturesFromMatch(match *match) {
+	it.state.groups = make([]capture, len(match.groups))
+	for i, g := range match.groups {
+		debugf("iterator.setCapturesFromMatch(%d): group %d in match is at %d of length %d", it.depth, i, g.start, g.length)
+		it.state.groups[i] = g
 	}
 }
 
@@ -203,9 +241,23 @@ func (it *iterator) nextInWithinGroupsStage() (tok Token, err error) {
 
 	text := it.text[it.state.index:]
 	groupText := text[capture.start:capture.end()]
-	if byGroup.IsUseSelf() {
-		debugf("Lexer.nextInWithinGroupsStage(%d): bygroups %d is a use-self. Creating sub lexer\n", it.depth, it.state.groupIndex)
-		it.prepareToUseSublexer(it.state.rule, groupText, capture.start, byGroup.useSelfState)
+	if byGroup.IsUsingByGroup() {
+		if name := it.sublexerNameForGroup(&byGroup); name != "" {
+			debugf("Lexer.nextInWithinGroupsStage(%d): bygroups %d is a usingbygroup for lexer %s. Creating sub lexer\n", it.depth, it.state.groupIndex, name)
+			err = it.prepareToUseSublexer(it.state.rule, groupText, capture.start, "", name)
+			if err != nil {
+				return
+			}
+			return it.Next()
+		}
+	}
+
+	if byGroup.IsUseSelf() || byGroup.IsUsing() {
+		debugf("Lexer.nextInWithinGroupsStage(%d): bygroups %d is a use-self or using. Creating sub lexer\n", it.depth, it.state.groupIndex)
+		err = it.prepareToUseSublexer(it.state.rule, groupText, capture.start, byGroup.useSelfState, byGroup.usingLexer)
+		if err != nil {
+			return
+		}
 		return it.Next()
 	}
 
@@ -217,7 +269,7 @@ func (it *iterator) nextInWithinGroupsStage() (tok Token, err error) {
 
 	if it.state.groupIndex >= len(it.state.byGroups) {
 		debugf("iterator.nextInWithinGroupsStage(%d): reached end of the groups, will switch to full match stage\n", it.depth)
-		err = it.handleRuleState(it.state.rule)
+		err = it.handleRuleState(it.state.rule, it.state.groups, text)
 		if err != nil {
 			return
 		}
@@ -229,28 +281,116 @@ func (it *iterator) nextInWithinGroupsStage() (tok Token, err error) {
 	return tok, nil
 }
 
-func (it *iterator) prepareToUseSublexer(rule *rule, groupText []rune, captureStart int, state string) {
-	lex := newIterator(groupText, it.rules)
-	lex.setOffset(it.state.index + captureStart)
+// nextInWithinDelimitedStage returns a token for the next line of the delimited region of the rule that
+// matched, or for the rest of the region if it ends on this line.
+func (it *iterator) nextInWithinDelimitedStage() (tok Token, err error) {
+	if it.state.index >= len(it.text) {
+		debugf("iterator.nextInWithinDelimitedStage(%d): The delimited region is not closed before the end of the text. Returning EOFType", it.depth)
+		return Token{Type: EOFType, Value: nil}, nil
+	}
+
+	rule := it.state.rule
+	text := it.text[it.state.index:]
+	n, depth := rule.delimited.scan(text, it.state.delimitedDepth)
+	debugf("iterator.nextInWithinDelimitedStage(%d): scanned %d runes of the delimited region, depth is now %d", it.depth, n, depth)
+
+	if n > 0 {
+		start, end := it.boundsOfGroup(0, n)
+		tok = Token{Type: rule.delimited.tok, Value: text[:n], Start: start, End: end}
+		it.state.index += n
+	}
+	it.state.delimitedDepth = depth
+
+	if depth == 0 {
+		debugf("iterator.nextInWithinDelimitedStage(%d): reached the end of the delimited region\n", it.depth)
+		err = it.handleRuleState(rule, nil, nil)
+		if err != nil {
+			return
+		}
+		it.state.stage = stageReadyToMatch
+		it.state.rule = nil
+	}
+
+	if n == 0 {
+		return it.Next()
+	}
+	return tok, nil
+}
+
+// prepareToUseSublexer creates a sublexer to lex groupText. If lexerName is empty the sublexer
+// uses the same rules as this iterator and starts in the state named state (usingself), otherwise it uses
+// the rules of the named lexer from the registry and starts in that lexer's root state (using).
+//
+// A usingself sublexer lexes the group within the text before it, so that anchors like ^ and lookbehinds
+// see the same context as the rules of this iterator. A sublexer for another lexer sees only the group.
+func (it *iterator) prepareToUseSublexer(rule *rule, groupText []rune, captureStart int, state, lexerName string) error {
+	rulez := it.rules
+	if lexerName != "" {
+		var err error
+		rulez, err = it.rulesOfLexer(lexerName)
+		if err != nil {
+			return err
+		}
+	}
+
+	var lex *iterator
+	if lexerName == "" {
+		start := it.state.index + captureStart
+		lex = newIterator(it.text[:start+len(groupText)], rulez)
+		lex.state.index = start
+		lex.setOffset(it.state.offset)
+	} else {
+		lex = newIterator(groupText, rulez)
+		lex.setOffset(it.state.offset + it.state.index + captureStart)
+	}
+	lex.registry = it.registry
 	lex.depth = it.depth + 1
-	lex.pushState(state)
+	if state != "" {
+		lex.pushState(state)
+	}
 	it.state.stage = stageRunningSublexer
 	it.sublexers = append(it.sublexers, lex)
 	it.state.rule = rule
+	return nil
+}
+
+// sublexerNameForGroup returns the name of the registered lexer that is named by the text of the
+// group that byGroup refers to, or the empty string if there is no such lexer.
+func (it *iterator) sublexerNameForGroup(byGroup *byGroupElement) string {
+	if it.registry == nil || byGroup.sublexerNameGroup >= len(it.state.groups) {
+		return ""
+	}
+
+	c := it.state.groups[byGroup.sublexerNameGroup]
+	text := it.text[it.state.index:]
+	name := string(text[c.start:c.end()])
+	if name == "" || it.registry.Get(name) == nil {
+		return ""
+	}
+	return name
+}
+
+func (it *iterator) rulesOfLexer(name string) (rules, error) {
+	if it.registry == nil {
+		return rules{}, fmt.Errorf("syn.iterator: a rule refers to the lexer %s but the lexer is not in a registry", name)
+	}
+
+	lexer := it.registry.Get(name)
+	if lexer == nil {
+		return rules{}, fmt.Errorf("syn.iterator: a rule refers to a lexer %s that isn't registered", name)
+	}
+	return lexer.rules, nil
 }
 
 func (it *iterator) completeGroupIteration() error {
-	err := it.handleRuleState(it.state.rule)
+	err := it.handleRuleState(it.state.rule, it.state.groups, it.text[it.state.index:])
 	if err != nil {
 		return err
 	}
 	it.state.stage = stageReadyToMatch
-	if len(it.state.byGroups) == 0 {
-		// byGroups has zero elements when this is a usingself that is not within groups; it's against the complete match of the rule's pattern
-		it.state.index += len(it.text)
-	} else {
-		it.state.index += it.state.groups[0].length // Move past the length of the match
-	}
+	// byGroups has zero elements when this is a usingself or using that is not within groups; it's against
+	// the complete match of the rule's pattern. In either case group 0 is the complete match.
+	it.state.index += it.state.groups[0].length // Move past the length of the match
 	it.clearGroupIterationInfo()
 	return nil
 }
@@ -259,6 +399,7 @@ func (it *iterator) clearGroupIterationInfo() {
 	it.state.groups = it.state.groups[:0]
 	it.state.groupIndex = 0
 	it.state.byGroups = nil
+	it.state.callMutators = nil
 	it.state.rule = nil
 }
 
@@ -318,14 +459,10 @@ func (i *iterator) pushRootStateIfNeeded() {
 	}
 }
 
-func (it *iterator) tokenOfEntireMatch(typ TokenType, match *regexp2.Match) Token {
-	s, e := it.boundsOfCapture(&match.Group.Capture)
-	return Token{Type: typ, Value: it.groupText(match.GroupByNumber(0)), Start: s, End: e}
-}
-
-func (it *iterator) boundsOfCapture(match *regexp2.Capture) (start, end int) {
-	return it.state.index + it.state.offset + match.Index,
-		it.state.index + it.state.offset + match.Index + match.Length
+func (it *iterator) tokenOfEntireMatch(typ TokenType, match *match) Token {
+	g := match.groups[0]
+	s, e := it.boundsOfGroup(g.start, g.length)
+	return Token{Type: typ, Value: it.groupText(g), Start: s, End: e}
 }
 
 func (it *iterator) boundsOfGroup(index, length int) (start, end int) {
@@ -333,7 +470,17 @@ func (it *iterator) boundsOfGroup(index, length int) (start, end int) {
 		it.state.index + it.state.offset + index + length
 }
 
-func (it *iterator) handleRuleState(rule *rule) error {
+// handleRuleState applies the pushes and pops of rule to the state stack. groups are the groups of the rule's match,
+// which are positions in text.
+func (it *iterator) handleRuleState(rule *rule, groups []capture, text []rune) error {
+	if rule.call != nil {
+		return it.applyMutators(it.state.callMutators, groups, text)
+	}
+
+	if len(rule.mutators) > 0 {
+		return it.applyMutators(rule.mutators, groups, text)
+	}
+
 	if rule.popDepth == 0 && rule.pushState == "" {
 		return nil
 	}
@@ -353,9 +500,55 @@ func (it *iterator) handleRuleState(rule *rule) error {
 	return nil
 }
 
-func (it *iterator) groupText(g *regexp2.Group) []rune {
+// applyMutators applies the mutators to the state stack in order. The mutators are applied
+// atomically: if any of them fails the stack is left unchanged. groups are the groups of the match
+// of the rule, which are positions in text, and are used by pushes that capture a group.
+func (it *iterator) applyMutators(mutators []mutator, groups []capture, text []rune) error {
+	current := it.state.stack.Top()
+	stk := it.state.stack.Clone()
+
+	for _, m := range mutators {
+		var s state
+		switch {
+		case m.pushCurrent:
+			debugf("iterator.applyMutators(%d): pushing current state %s", it.depth, current.name)
+			s = current
+		case m.pushState != "":
+			var ok bool
+			s, ok = it.rules.rules[m.pushState]
+			if !ok {
+				return fmt.Errorf("syn.iterator: a rule refers to a state %s that doesn't exist", m.pushState)
+			}
+			debugf("iterator.applyMutators(%d): pushing state %s", it.depth, m.pushState)
+		default:
+			debugf("iterator.applyMutators(%d): Popping %d states", it.depth, m.popDepth)
+			stk.Pop(m.popDepth)
+			continue
+		}
+
+		if m.capture != "" {
+			if m.group >= len(groups) {
+				return fmt.Errorf("syn.iterator: a rule captures group %d, but its match has only %d groups", m.group, len(groups)-1)
+			}
+			g := groups[m.group]
+			vars := make(map[string]string, len(s.vars)+1)
+			for k, v := range s.vars {
+				vars[k] = v
+			}
+			vars[m.capture] = string(text[g.start:g.end()])
+			debugf("iterator.applyMutators(%d): capturing %q as %s", it.depth, vars[m.capture], m.capture)
+			s.vars = vars
+		}
+		stk.Push(s)
+	}
+
+	it.state.stack = stk
+	return nil
+}
+
+func (it *iterator) groupText(g capture) []rune {
 	text := it.text[it.state.index:]
-	return text[g.Index : g.Index+g.Length]
+	return text[g.start:g.end()]
 }
 
 // State returns a representation of the state of the iterator. If the result of State() is saved
@@ -364,32 +557,45 @@ func (it *iterator) groupText(g *regexp2.Group) []rune {
 //
 // The state is invalidated if the text that the Iterator is iterating is changed.
 func (it *iterator) State() IteratorState {
-	states := make(lexerStates, len(it.sublexers)+1)
-	states[0] = it.state
-	states[0].stack = it.state.stack.Clone()
-	for i, sl := range it.sublexers {
-		states[i+1] = sl.state
-		states[i+1].stack = sl.state.stack.Clone()
+	var states lexerStates
+	for cur := it; cur != nil; cur = cur.activeSublexer() {
+		st := cur.state
+		st.stack = cur.state.stack.Clone()
+		states = append(states, st)
 	}
 
 	return states
 }
 
+// activeSublexer returns the sublexer that is currently lexing a subset of the text for this
+// iterator, or nil if there is none.
+func (it *iterator) activeSublexer() *iterator {
+	if len(it.sublexers) == 0 {
+		return nil
+	}
+	return it.sublexers[len(it.sublexers)-1]
+}
+
 func (it *iterator) SetState(s IteratorState) {
 
 	state := s.(lexerStates)
 
-	// The lexers and sublexers all use the same rules because the only way to make
-	// a sublexer is through usingself (for now).
-	// So we can just clone the rules from the base lexer to all the sublexers.
 	it.state = state[0]
+	it.state.stack = state[0].stack.Clone()
+	it.sublexers = nil
 
-	it.sublexers = make([]*iterator, len(state)-1)
-	for i, state := range state[1:] {
-		// TODO: we can't set the text that we're parsing as part of the state
-		it.sublexers[i] = newIterator(it.text, it.rules)
-		it.depth = i + 1
-		it.sublexers[i].state = state
+	// Each sublexer lexes the subset of the text that begins at its offset, using the rules
+	// that were saved with its state; they may belong to a different lexer if the sublexer was
+	// created by a <using> element.
+	parent := it
+	for i, st := range state[1:] {
+		sub := newIterator(it.text[st.offset:st.offset+st.length], st.rules)
+		sub.registry = it.registry
+		sub.depth = i + 1
+		sub.state = st
+		sub.state.stack = st.stack.Clone()
+		parent.sublexers = []*iterator{sub}
+		parent = sub
 	}
 }
 
@@ -405,6 +611,7 @@ const (
 	stageReadyToMatch = iota
 	stageWithinGroups
 	stageRunningSublexer
+	stageWithinDelimited
 )
 
 // lexerState represents the state of the Lexer at some intermediate position in the lexing.
@@ -419,25 +626,65 @@ type lexerState struct {
 	// offset is the absolute offset of where the beginning of the text parsed by the current lexer
 	// represents. It's used when a sublexer is used to lex a subsequence of the text.
 	offset int
+	// length is the length of the text parsed by the current lexer.
+	length int
+	// rules are the rules of the lexer that is in this state. They differ from the parent lexer's rules
+	// when a sublexer was created by a <using> element.
+	rules rules
 
 	groups     []capture        // Groups from the last match. Used when we need to iterate over bygroups. Each entry is a start/end of group.
 	groupIndex int              // index for current group we are iterating over
 	byGroups   []byGroupElement // The "by groups" items defined in the rule that specify how to handle each group from the match
-	rule       *rule            // Rule we are matching the groups for
-	offsetIter offsetIterator
+	rule       *rule            // Rule we are matching the groups or the delimited region for
+	// delimitedDepth is the number of nested delimited regions that the current position is within.
+	delimitedDepth int
+	// callMutators are the changes to the state stack returned by the function of the call rule whose
+	// tokens are being returned.
+	callMutators []mutator
+	offsetIter   offsetIterator
 }
 
 func (ls lexerState) equal(o *lexerState) bool {
 	// We don't compare all fields here, only enough to tell if the
 	// lexer would be in the same state in both cases.
-	return ls.stacksEqual(o) &&
+	return ls.rules.same(o.rules) &&
+		ls.stacksEqual(o) &&
 		ls.index == o.index &&
 		ls.stage == o.stage &&
 		ls.offset == o.offset &&
 		ls.groupsEqual(o) &&
 		ls.groupIndex == o.groupIndex &&
+		ls.delimitedDepth == o.delimitedDepth &&
 		// NOTE: this next line compares the pointers to the rule; fine as long as the rule is created from the same lexer
-		ls.rule == o.rule
+		ls.rule == o.rule &&
+		ls.callResultsEqual(o)
+}
+
+// callResultsEqual compares the token types and stack changes returned by the function of a call rule
+// whose tokens are being returned. They come from the function rather than the rule, so the same rule
+// may have different ones.
+func (ls lexerState) callResultsEqual(o *lexerState) bool {
+	if ls.rule == nil || ls.rule.call == nil {
+		return true
+	}
+
+	if len(ls.byGroups) != len(o.byGroups) || len(ls.callMutators) != len(o.callMutators) {
+		return false
+	}
+
+	for i, e := range ls.byGroups {
+		if e.tok != o.byGroups[i].tok {
+			return false
+		}
+	}
+
+	for i, m := range ls.callMutators {
+		if m != o.callMutators[i] {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (ls lexerState) stacksEqual(o *lexerState) bool {
@@ -446,7 +693,21 @@ func (ls lexerState) stacksEqual(o *lexerState) bool {
 	}
 
 	for i, e := range ls.stack.data {
-		if e.name != o.stack.data[i].name {
+		if e.name != o.stack.data[i].name || !varsEqual(e.vars, o.stack.data[i].vars) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func varsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
 			return false
 		}
 	}
@@ -477,6 +738,7 @@ func (ls lexerState) String() string {
 	fmt.Fprintf(&buf, "  offset: %d\n", ls.offset)
 	fmt.Fprintf(&buf, "  groups: %#v\n", ls.groups)
 	fmt.Fprintf(&buf, "  groupIndex: %d\n", ls.groupIndex)
+	fmt.Fprintf(&buf, "  delimitedDepth: %d\n", ls.delimitedDepth)
 	fmt.Fprintf(&buf, "  rule: %v\n", ls.rule)
 
 	return buf.String()
@@ -13,11 +13,16 @@ package syn
 
 import (
 	"bytes"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/dlclark/regexp2"
@@ -26,7 +31,23 @@ import (
 
 type Lexer struct {
 	config *config.Lexer
-	rules  rules
+	// source is the definition of the lexer as it was written, for a lexer that refers to other lexers. The
+	// lexer is built from config, which is source combined with the definitions of the lexers it refers to.
+	source *config.Lexer
+	// pending is true for a lexer that refers to other lexers, until LexerRegistry.Resolve builds it.
+	pending  bool
+	rules    rules
+	registry *LexerRegistry
+	// delegate is set for lexers created by NewDelegatingLexer.
+	delegate *delegation
+	analyser *analyser
+	// options are the values of the options of the lexer that it was built with.
+	options map[string]string
+	// base is the lexer that a lexer made by WithOptions is a variant of. The variants of a lexer are cached
+	// in its base.
+	base       *Lexer
+	variantsMu sync.Mutex
+	variants   map[string]*Lexer
 }
 
 func newLexer(r rules) *Lexer {
@@ -42,7 +63,8 @@ func NewLexerFromXMLFile(xmlLexerConfigFile string) (*Lexer, error) {
 		return nil, err
 	}
 
-	return NewLexerFromXML(f)
+	lex, err := NewLexerFromXML(f)
+	return lex, inFile(err, xmlLexerConfigFile)
 }
 
 // NewLexerFromXML creates a new lexer given an XML file containing a definition of a lexer. The file is opened
@@ -53,36 +75,268 @@ func NewLexerFromXMLFS(fsys fs.FS, xmlLexerConfigFile string) (*Lexer, error) {
 		return nil, err
 	}
 
-	return NewLexerFromXML(f)
+	lex, err := NewLexerFromXML(f)
+	return lex, inFile(err, xmlLexerConfigFile)
 }
 
-// NewLexerFromXML creates a new lexer given an XML definition of a lexer.
+// NewLexerFromXML creates a new lexer given an XML definition of a lexer. If the definition can't be
+// loaded the error is a *LexerDefinitionError, which gives the line and column of the problem when they are known.
+//
+// A lexer that extends another lexer, or includes states of other lexers, is only built when it is registered
+// in a LexerRegistry and LexerRegistry.Resolve is called. Until then its Iterators return an error.
 func NewLexerFromXML(rdr io.Reader) (*Lexer, error) {
-	lexModel, err := config.DecodeLexer(rdr)
+	lexModel, pos, err := config.DecodeLexerWithPositions(rdr)
+	if err != nil {
+		return nil, xmlDecodeError(err)
+	}
+
+	return newLexerFromModel(lexModel, pos)
+}
+
+// NewLexerFromXMLStrict is like NewLexerFromXML, but returns an error for any element or attribute in the
+// definition that is not understood, rather than silently ignoring it. This catches misspellings like
+// <usingSelf> or <token typ="Text">, which otherwise produce a lexer that doesn't behave as intended.
+func NewLexerFromXMLStrict(rdr io.Reader) (*Lexer, error) {
+	lexModel, pos, err := config.DecodeLexerStrict(rdr)
+	if err != nil {
+		return nil, xmlDecodeError(err)
+	}
+
+	return newLexerFromModel(lexModel, pos)
+}
+
+// xmlDecodeError converts an error from decoding an XML lexer definition to a LexerDefinitionError.
+func xmlDecodeError(err error) error {
+	defErr := &LexerDefinitionError{Rule: -1, Err: err}
+
+	var syntaxErr *xml.SyntaxError
+	var schemaErr *config.SchemaError
+	switch {
+	case errors.As(err, &syntaxErr):
+		defErr.Line = syntaxErr.Line
+	case errors.As(err, &schemaErr):
+		defErr.Line, defErr.Column = schemaErr.Line, schemaErr.Column
+		defErr.State, defErr.Rule = schemaErr.State, schemaErr.Rule
+	}
+	return defErr
+}
+
+// NewLexerFromJSON creates a new lexer given a JSON definition of a lexer. The JSON definition
+// has the same structure as the XML definition. Like NewLexerFromXML, it returns a lexer that refers to
+// other lexers unbuilt, to be built by LexerRegistry.Resolve.
+func NewLexerFromJSON(rdr io.Reader) (*Lexer, error) {
+	lexModel, err := config.DecodeLexerJSON(rdr)
 	if err != nil {
 		return nil, err
 	}
 
+	return newLexerFromModel(lexModel, nil)
+}
+
+// NewLexerFromYAML creates a new lexer given a YAML definition of a lexer. The YAML definition
+// has the same structure as the XML definition. Like NewLexerFromXML, it returns a lexer that refers to
+// other lexers unbuilt, to be built by LexerRegistry.Resolve.
+func NewLexerFromYAML(rdr io.Reader) (*Lexer, error) {
+	lexModel, err := config.DecodeLexerYAML(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLexerFromModel(lexModel, nil)
+}
+
+// NewLexerFromFile creates a new lexer given a file containing a definition of a lexer. The format
+// of the file is determined by its extension, which must be one of .xml, .json, .yaml or .yml.
+func NewLexerFromFile(lexerConfigFile string) (*Lexer, error) {
+	lex, err := NewLexerFromFS(os.DirFS(filepath.Dir(lexerConfigFile)), filepath.Base(lexerConfigFile))
+	return lex, inFile(err, lexerConfigFile)
+}
+
+// NewLexerFromFS creates a new lexer given a file containing a definition of a lexer. The file is opened
+// using the specified FS. The format of the file is determined by its extension, which must be one of
+// .xml, .json, .yaml or .yml.
+func NewLexerFromFS(fsys fs.FS, lexerConfigFile string) (*Lexer, error) {
+	var newLexer func(io.Reader) (*Lexer, error)
+	switch strings.ToLower(path.Ext(lexerConfigFile)) {
+	case ".xml":
+		newLexer = NewLexerFromXML
+	case ".json":
+		newLexer = NewLexerFromJSON
+	case ".yaml", ".yml":
+		newLexer = NewLexerFromYAML
+	default:
+		return nil, fmt.Errorf("The lexer definition file %s has an unsupported extension", lexerConfigFile)
+	}
+
+	f, err := fsys.Open(lexerConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lex, err := newLexer(f)
+	return lex, inFile(err, lexerConfigFile)
+}
+
+// IsLexerDefinitionFile returns true if the name of the file has the extension of a format that
+// NewLexerFromFS supports.
+func IsLexerDefinitionFile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".xml", ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// newLexerFromModel builds a lexer from its definition. pos holds the positions of the states and rules
+// in the file they were read from, and may be nil.
+func newLexerFromModel(lexModel *config.Lexer, pos *config.Positions) (*Lexer, error) {
+	if refersToOtherLexers(lexModel) {
+		// The lexer is built when the registry resolves the lexers it refers to.
+		return &Lexer{rules: newRules(), config: lexModel, pending: true}, nil
+	}
+
 	bld := newLexerBuilder(lexModel)
+	bld.pos = pos
 	lex, err := bld.Build()
 	if err != nil {
 		return nil, err
 	}
 
-	debugf("NewLexerFromXML: lexer rules:\n%s\n", lex.rules)
+	debugf("newLexerFromModel: lexer rules:\n%s\n", lex.rules)
 
 	return lex, nil
+}
 
+// LexerDefinitionError is an error in the definition of a lexer. It locates the problem as precisely as
+// is known: the fields that don't apply or aren't known are left empty.
+type LexerDefinitionError struct {
+	// File is the name of the file the definition was read from.
+	File string
+	// Line and Column locate the state or rule in the file. They are numbered from 1.
+	Line   int
+	Column int
+	// State is the name of the state the error is in.
+	State string
+	// Rule is the index of the rule within the state, or -1 if the error is not in a particular rule.
+	Rule int
+	// Pattern is the pattern of the rule.
+	Pattern string
+	Err     error
 }
 
+func (e *LexerDefinitionError) Error() string {
+	var buf strings.Builder
+	if e.File != "" {
+		buf.WriteString(e.File)
+		if e.Line > 0 {
+			fmt.Fprintf(&buf, ":%d", e.Line)
+		}
+		if e.Column > 0 {
+			fmt.Fprintf(&buf, ":%d", e.Column)
+		}
+		buf.WriteString(": ")
+	} else if e.Line > 0 {
+		fmt.Fprintf(&buf, "line %d", e.Line)
+		if e.Column > 0 {
+			fmt.Fprintf(&buf, ", column %d", e.Column)
+		}
+		buf.WriteString(": ")
+	}
+
+	if e.State != "" {
+		fmt.Fprintf(&buf, "For state %s: ", e.State)
+	}
+	if e.Rule >= 0 {
+		fmt.Fprintf(&buf, "rule index %d: ", e.Rule)
+	}
+	buf.WriteString(e.Err.Error())
+	if e.Pattern != "" {
+		fmt.Fprintf(&buf, " (pattern %q)", e.Pattern)
+	}
+	return buf.String()
+}
+
+func (e *LexerDefinitionError) Unwrap() error {
+	return e.Err
+}
+
+// inFile sets the File of err to file if err is a LexerDefinitionError.
+func inFile(err error, file string) error {
+	var defErr *LexerDefinitionError
+	if errors.As(err, &defErr) {
+		defErr.File = file
+	}
+	return err
+}
+
+// WriteXML writes the definition of the lexer to w as XML in a canonical form: the aliases, filenames
+// and MIME types are sorted, and the elements are consistently indented. The output can be read back using
+// NewLexerFromXML.
+func (l *Lexer) WriteXML(w io.Writer) error {
+	if l.config == nil {
+		return fmt.Errorf("The lexer has no definition to write")
+	}
+	if l.source != nil {
+		return config.EncodeLexer(w, l.source)
+	}
+	return config.EncodeLexer(w, l.config)
+}
+
+// Tokenise returns an Iterator over the tokens of text. The Iterator of a lexer that refers to other
+// lexers and has not yet been built by LexerRegistry.Resolve returns an error from Next.
 func (l *Lexer) Tokenise(text []rune) Iterator {
+	if l.delegate != nil {
+		return l.delegate.tokenise(text)
+	}
+	if l.pending {
+		return errorIterator{err: fmt.Errorf("The lexer %s refers to other lexers, and can't be used until it is "+
+			"registered in a LexerRegistry and resolved with LexerRegistry.Resolve", l.config.Config.Name)}
+	}
 	return l.tokeniseAt(text, nil)
 }
 
+// errorIterator is an Iterator that returns err from Next.
+type errorIterator struct {
+	err error
+}
+
+func (it errorIterator) Next() (Token, error) {
+	return Token{}, it.err
+}
+
+func (it errorIterator) State() IteratorState {
+	return errorIteratorState{}
+}
+
+func (it errorIterator) SetState(state IteratorState) {
+}
+
+// errorIteratorState is the IteratorState of an errorIterator, which has no state.
+type errorIteratorState struct{}
+
+func (s errorIteratorState) Equal(o IteratorState) bool {
+	_, ok := o.(errorIteratorState)
+	return ok
+}
+
+func (s errorIteratorState) SetIndex(i int) {
+}
+
+func (s errorIteratorState) AddToIndex(i int) {
+}
+
 // tokeniseAt is currently broken. It only works when state is nil.
 func (l *Lexer) tokeniseAt(text []rune, state IteratorState) Iterator {
+	origText := text
+	addedNL := false
+	if l.config != nil && l.config.Config.EnsureNL {
+		text, addedNL = withTrailingNL(text)
+	}
+
 	stripped, offsetMap := ensureLF(text)
 	innerIter := newIterator(stripped, l.rules)
+	innerIter.registry = l.registry
 	// TODO: when we use coalesce and we save the state, the coalescer state is actually
 	// 1 or more tokens ahead of what has been returned during iteration so far, and the
 	// coalescer's stored token(s) match the previous unmodified text.
@@ -101,16 +355,151 @@ func (l *Lexer) tokeniseAt(text []rune, state IteratorState) Iterator {
 		}
 		outerIter.SetState(state)
 	}
+
+	if addedNL {
+		outerIter = hideVirtualNL(origText, outerIter)
+	}
 	return outerIter
 }
 
+// SetRegistry sets the registry used to look up the lexers that this lexer delegates to using
+// the <using> element. It is called by LexerRegistry.Register.
+func (l *Lexer) SetRegistry(registry *LexerRegistry) *Lexer {
+	l.registry = registry
+	return l
+}
+
 func (l *Lexer) cfg() *config.Lexer {
 	return l.config
 }
 
+// Extends returns the name of the lexer that l extends, if l has not yet been combined with it.
+// Such a lexer can't be used until LexerRegistry.Resolve builds it.
+func (l *Lexer) Extends() string {
+	if l.config == nil || l.config.Extends == nil {
+		return ""
+	}
+	return l.config.Extends.Lexer
+}
+
+// refersToOtherLexers returns true if the lexer defined by cfg can't be built without the definitions
+// of other lexers: either it extends another lexer, or it includes states of other lexers.
+func refersToOtherLexers(cfg *config.Lexer) bool {
+	return cfg.Extends != nil || hasLexerIncludes(cfg)
+}
+
+// extend combines the definition of l, which extends the lexer parent, with the definition of parent.
+// The lexer still has to be built.
+func (l *Lexer) extend(parent *Lexer) error {
+	cfg, err := config.Extend(parent.config, l.config)
+	if err != nil {
+		return fmt.Errorf("The lexer %s can't extend the lexer %s: %w", l.config.Config.Name, parent.config.Config.Name, err)
+	}
+
+	l.source = l.config
+	l.config = cfg
+	return nil
+}
+
+// build builds a pending lexer, looking up the lexers it includes states of in registry.
+func (l *Lexer) build(registry *LexerRegistry) error {
+	bld := newLexerBuilder(l.config)
+	bld.registry = registry
+	built, err := bld.Build()
+	if err != nil {
+		return fmt.Errorf("Building the lexer %s failed: %w", l.config.Config.Name, err)
+	}
+
+	if l.source == nil && built.config != l.config {
+		l.source = l.config
+	}
+	l.config = built.config
+	l.rules = built.rules
+	l.analyser = built.analyser
+	l.options = built.options
+	l.pending = false
+	return nil
+}
+
+// WithOptions returns a variant of the lexer in which the options of the lexer have the values in opts, as in
+// map[string]string{"dialect": "mysql"}. The rules whose if conditions don't hold for the values are left out of
+// the variant. Options that are not in opts keep the values they have in l, and names in opts that are not options
+// of the lexer are ignored.
+//
+// Variants are cached, so WithOptions returns the same Lexer each time it is called with the same values, and
+// returns the lexer it was made from if the values are the ones that lexer has. WithOptions returns nil if the
+// variant can't be built, or if l refers to other lexers and hasn't yet been built by LexerRegistry.Resolve.
+func (l *Lexer) WithOptions(opts map[string]string) *Lexer {
+	if l.config == nil {
+		// A delegating lexer has no options.
+		return l
+	}
+	if l.pending {
+		return nil
+	}
+
+	base := l
+	if l.base != nil {
+		base = l.base
+	}
+
+	set := make(map[string]string, len(l.options)+len(opts))
+	for name, v := range l.options {
+		set[name] = v
+	}
+	for name, v := range opts {
+		set[name] = v
+	}
+	values := optionValues(base.config, set)
+
+	key := optionsKey(values)
+	if key == optionsKey(base.options) {
+		return base
+	}
+
+	base.variantsMu.Lock()
+	defer base.variantsMu.Unlock()
+	if v, ok := base.variants[key]; ok {
+		return v
+	}
+
+	bld := newLexerBuilder(base.config)
+	bld.registry = base.registry
+	bld.options = values
+	v, err := bld.Build()
+	if err != nil {
+		return nil
+	}
+	v.source = base.source
+	v.registry = base.registry
+	v.base = base
+
+	if base.variants == nil {
+		base.variants = map[string]*Lexer{}
+	}
+	base.variants[key] = v
+	return v
+}
+
+// Options returns the values of the options of the lexer.
+func (l *Lexer) Options() map[string]string {
+	values := make(map[string]string, len(l.options))
+	for name, v := range l.options {
+		values[name] = v
+	}
+	return values
+}
+
 type lexerBuilder struct {
 	cfg   *config.Lexer
 	lexer *Lexer
+	// pos holds the positions of the states and rules of cfg in the file it was read from. It is nil if they are not known.
+	pos *config.Positions
+	// registry is used to find the lexers whose states cfg includes. It may be nil if cfg includes no such states.
+	registry *LexerRegistry
+	// options are the values of the options that the lexer is built with. Options that are not in it have their
+	// default values.
+	options map[string]string
 }
 
 func newLexerBuilder(cfg *config.Lexer) lexerBuilder {
@@ -125,53 +514,101 @@ func newLexerBuilder(cfg *config.Lexer) lexerBuilder {
 
 func (lb *lexerBuilder) Build() (*Lexer, error) {
 
-	err := lb.validate()
+	err := lb.importLexerIncludes()
 	if err != nil {
 		return nil, err
 	}
 
+	err = lb.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	lb.options = optionValues(lb.cfg, lb.options)
+	lb.lexer.options = lb.options
+
 	err = lb.build()
 	if err != nil {
 		return nil, err
 	}
 
-	lb.resolveIncludes()
+	err = lb.resolveIncludes()
+	if err != nil {
+		return nil, err
+	}
+
+	lb.combineRules()
+
+	err = lb.buildAnalyser()
+	if err != nil {
+		return nil, err
+	}
 
 	return lb.lexer, nil
 }
 
 func (lb *lexerBuilder) validate() error {
 	foundRoot := false
-	for _, s := range lb.cfg.Rules.States {
+	for i, s := range lb.cfg.Rules.States {
 		if s.Name == "root" {
 			foundRoot = true
 		}
+		if s.Mode != "" {
+			return lb.errorAt(i, -1, fmt.Errorf("The state has a mode, but the lexer doesn't extend another lexer"))
+		}
 	}
 
 	if !foundRoot {
-		return fmt.Errorf("No 'root' state is defined")
+		return &LexerDefinitionError{Rule: -1, Err: fmt.Errorf("No 'root' state is defined")}
 	}
 
 	var missing []string
+	// The error is located at the first rule that pushes a missing state.
+	firstState, firstRule := -1, -1
 
 	stateNames := map[string]struct{}{}
 	for _, state := range lb.cfg.Rules.States {
 		stateNames[state.Name] = struct{}{}
 	}
 
-	for _, state := range lb.cfg.Rules.States {
-		for _, rule := range state.Rules {
-			if rule.Push == nil || rule.Push.State == "" {
-				continue
-			}
+	for i, state := range lb.cfg.Rules.States {
+		for j, rule := range state.Rules {
+			for _, push := range pushesOf(&rule) {
+				if push.State == "" {
+					continue
+				}
 
-			if _, ok := stateNames[rule.Push.State]; !ok {
-				missing = append(missing, rule.Push.State)
+				if _, ok := stateNames[push.State]; !ok {
+					missing = append(missing, push.State)
+					if firstState < 0 {
+						firstState, firstRule = i, j
+					}
+				}
 			}
 		}
 	}
 
-	return lb.makeMissingError(missing)
+	err := lb.makeMissingError(missing)
+	if err != nil {
+		return lb.errorAt(firstState, firstRule, err)
+	}
+	return nil
+}
+
+// pushesOf returns the push elements of the rule cr, including those within a mutators element.
+func pushesOf(cr *config.Rule) (pushes []*config.Push) {
+	if cr.Push != nil {
+		pushes = append(pushes, cr.Push)
+	}
+
+	if cr.Mutators != nil {
+		for _, m := range cr.Mutators.Mutators {
+			if p, ok := m.V.(*config.Push); ok {
+				pushes = append(pushes, p)
+			}
+		}
+	}
+	return
 }
 
 func (r lexerBuilder) makeMissingError(missing []string) error {
@@ -183,66 +620,183 @@ func (r lexerBuilder) makeMissingError(missing []string) error {
 }
 
 func (lb *lexerBuilder) build() error {
-	for _, xmlState := range lb.cfg.Rules.States {
+	for i, xmlState := range lb.cfg.Rules.States {
 
-		seq, err := lb.ruleSequence(xmlState.Rules)
+		seq, err := lb.ruleSequence(i, xmlState.Rules)
 		if err != nil {
-			return fmt.Errorf("For state %s: %w", xmlState.Name, err)
+			return err
 		}
 
-		s := state{xmlState.Name, seq}
+		s := state{name: xmlState.Name, rules: seq}
 		lb.lexer.rules.AddState(s)
 	}
 
-	for _, xmlState := range lb.cfg.Rules.States {
+	for i, xmlState := range lb.cfg.Rules.States {
 		err := lb.createCombinedStates(&xmlState)
 		if err != nil {
-			return fmt.Errorf("For state %s: %w", xmlState.Name, err)
+			return lb.errorAt(i, -1, err)
 		}
 	}
 
 	return nil
 }
 
-func (lb *lexerBuilder) ruleSequence(crs []config.Rule) ([]rule, error) {
-	rules := make([]rule, len(crs))
+func (lb *lexerBuilder) buildAnalyser() error {
+	if lb.cfg.Config.Analyse == nil {
+		return nil
+	}
+
+	a, err := newAnalyser(lb.cfg.Config.Analyse)
+	if err != nil {
+		return err
+	}
+	lb.lexer.analyser = a
+	return nil
+}
+
+// ruleSequence makes the rules crs of the state at index stateIndex.
+func (lb *lexerBuilder) ruleSequence(stateIndex int, crs []config.Rule) ([]rule, error) {
+	rules := make([]rule, 0, len(crs))
 	for i, cr := range crs {
 		err := lb.checkRule(&cr)
 		if err != nil {
-			return nil, fmt.Errorf("rule index %d: %w", i, err)
+			return nil, lb.errorAt(stateIndex, i, err)
 		}
 
-		r, err := lb.makeRule(cr.Pattern)
+		r, err := lb.makeRuleFor(&cr)
 		if err != nil {
-			return nil, err
+			return nil, lb.errorAt(stateIndex, i, err)
 		}
 
 		lb.updatePushForCombinedState(&r, &cr)
 
 		err = lb.setRuleFieldsFrom(&r, &cr)
 		if err != nil {
-			return nil, err
+			return nil, lb.errorAt(stateIndex, i, err)
 		}
 
-		rules[i] = r
+		// A rule whose condition doesn't hold is still made, so that the errors in it are reported
+		// whatever the values of the options.
+		ok, err := ruleApplies(&cr, lb.options)
+		if err != nil {
+			return nil, lb.errorAt(stateIndex, i, err)
+		}
+		if ok {
+			rules = append(rules, r)
+		}
 	}
 	return rules, nil
 }
 
-func (lb *lexerBuilder) makeRule(pattern string) (r rule, err error) {
-	pat := `\A` + pattern
+// errorAt returns a LexerDefinitionError for err located at the rule at index ruleIndex of the state at
+// index stateIndex in the config. ruleIndex is -1 if the error is in the state as a whole, and stateIndex is -1
+// if it isn't in any particular state.
+func (lb *lexerBuilder) errorAt(stateIndex, ruleIndex int, err error) error {
+	defErr := &LexerDefinitionError{Rule: -1, Err: err}
+	if stateIndex < 0 {
+		return defErr
+	}
+
+	st := &lb.cfg.Rules.States[stateIndex]
+	defErr.State = st.Name
+
+	pos, ok := lb.pos.State(stateIndex)
+	if ruleIndex >= 0 {
+		defErr.Rule = ruleIndex
+		defErr.Pattern = st.Rules[ruleIndex].Pattern
+		pos, ok = lb.pos.Rule(stateIndex, ruleIndex)
+	}
+	if ok {
+		defErr.Line, defErr.Column = pos.Line, pos.Column
+	}
+	return defErr
+}
 
-	var re *regexp2.Regexp
-	re, err = regexp2.Compile(pat, regexp2.Multiline)
+// errorInState returns a LexerDefinitionError for err located at the state named name.
+func (lb *lexerBuilder) errorInState(name string, err error) error {
+	for i, st := range lb.cfg.Rules.States {
+		if st.Name == name {
+			return lb.errorAt(i, -1, err)
+		}
+	}
+	// A combined state, which isn't in the config.
+	return &LexerDefinitionError{State: name, Rule: -1, Err: err}
+}
+
+// makeRuleFor makes the rule that matches the text that cr matches, using its pattern, its words, its
+// delimited region or the function it calls.
+func (lb *lexerBuilder) makeRuleFor(cr *config.Rule) (rule, error) {
+	opts := lb.regexpOptions(cr)
+	if cr.Words != nil {
+		w, err := lb.makeWords(cr.Words, opts)
+		return rule{words: w}, err
+	}
+	if cr.Delimited != nil {
+		d, err := newDelimited(cr.Delimited)
+		return rule{delimited: d}, err
+	}
+	if cr.Call != nil {
+		f, err := lookupRuleFunc(cr.Call.Func)
+		return rule{call: &call{name: cr.Call.Func, f: f}}, err
+	}
+	return lb.makeRule(cr.Pattern, opts)
+}
+
+func (lb *lexerBuilder) makeRule(pattern string, opts regexp2.RegexOptions) (r rule, err error) {
+	pattern, err = expandVariables(pattern, lb.cfg.Variables)
 	if err != nil {
 		return
 	}
+
+	// A pattern that refers to captured variables is compiled again when it is matched. Compiling it with
+	// the references removed checks its syntax.
+	r.captured = newCapturedPattern(pattern, opts)
+	r.pattern, err = compilePattern(capturedVariableRef.ReplaceAllString(pattern, ""), opts)
+	r.expr, r.opts = pattern, opts
+	return
+}
+
+// compilePattern compiles the pattern of a rule, which matches only at the position in the text that the
+// match starts at.
+func compilePattern(pattern string, opts regexp2.RegexOptions) (*regexp2.Regexp, error) {
+	re, err := regexp2.Compile(`\G(?:`+pattern+`)`, opts)
+	if err != nil {
+		return nil, err
+	}
 	re.MatchTimeout = time.Millisecond * 250
+	return re, nil
+}
 
-	r = rule{
-		pattern: re,
+// regexpOptions returns the options used to compile the pattern of the rule cr. They are
+// taken from the case_insensitive, dot_all and not_multiline flags of the lexer's config,
+// unless the rule overrides them with attributes of the same name.
+func (lb *lexerBuilder) regexpOptions(cr *config.Rule) regexp2.RegexOptions {
+	caseInsensitive := lb.cfg.Config.CaseInsensitive
+	if cr.CaseInsensitive != nil {
+		caseInsensitive = *cr.CaseInsensitive
 	}
-	return
+
+	dotAll := lb.cfg.Config.DotAll
+	if cr.DotAll != nil {
+		dotAll = *cr.DotAll
+	}
+
+	notMultiline := lb.cfg.Config.NotMultiline
+	if cr.NotMultiline != nil {
+		notMultiline = *cr.NotMultiline
+	}
+
+	var opts regexp2.RegexOptions
+	if !notMultiline {
+		opts |= regexp2.Multiline
+	}
+	if caseInsensitive {
+		opts |= regexp2.IgnoreCase
+	}
+	if dotAll {
+		opts |= regexp2.Singleline
+	}
+	return opts
 }
 
 // updatePushForCombinedState helps to handle the <combined> element. The combined element
@@ -323,7 +877,30 @@ func (lb *lexerBuilder) setRuleFieldsFrom(r *rule, cr *config.Rule) error {
 	}
 
 	if cr.Push != nil {
-		r.pushState = cr.Push.State
+		if cr.Push.State == "" || cr.Push.Capture != "" {
+			r.mutators = []mutator{pushMutator(cr.Push)}
+		} else {
+			r.pushState = cr.Push.State
+		}
+	}
+
+	if cr.Mutators != nil {
+		for _, e := range cr.Mutators.Mutators {
+			m := mutator{}
+			switch v := e.V.(type) {
+			case *config.Push:
+				m = pushMutator(v)
+			case *config.Pop:
+				m.popDepth = v.Depth
+			}
+			r.mutators = append(r.mutators, m)
+		}
+	}
+
+	for _, m := range r.mutators {
+		if m.capture != "" && m.group >= r.groupCount() {
+			return fmt.Errorf("a push captures group %d, but the rule's match has only %d groups", m.group, r.groupCount()-1)
+		}
 	}
 
 	if cr.Include != nil {
@@ -342,6 +919,21 @@ func (lb *lexerBuilder) setRuleFieldsFrom(r *rule, cr *config.Rule) error {
 				ge.tok = typ
 			case *config.UsingSelf:
 				ge.useSelfState = v.State
+			case *config.Using:
+				ge.usingLexer = v.Lexer
+			case *config.UsingByGroup:
+				if v.SublexerNameGroup <= 0 {
+					return fmt.Errorf("usingbygroup has an invalid sublexer_name_group %d", v.SublexerNameGroup)
+				}
+				ge.sublexerNameGroup = v.SublexerNameGroup
+				ge.tok = Text
+				if v.Fallback != "" {
+					typ, err := TokenTypeString(v.Fallback)
+					if err != nil {
+						return err
+					}
+					ge.tok = typ
+				}
 			}
 			r.byGroups = append(r.byGroups, ge)
 		}
@@ -351,21 +943,98 @@ func (lb *lexerBuilder) setRuleFieldsFrom(r *rule, cr *config.Rule) error {
 		r.useSelfState = cr.UsingSelf.State
 	}
 
+	if cr.Using != nil {
+		r.usingLexer = cr.Using.Lexer
+	}
+
 	return nil
 }
 
+// pushMutator returns the mutator that performs the push p.
+func pushMutator(p *config.Push) mutator {
+	return mutator{
+		pushState:   p.State,
+		pushCurrent: p.State == "",
+		capture:     p.Capture,
+		group:       p.Group,
+	}
+}
+
 func (lb *lexerBuilder) checkRule(r *config.Rule) error {
 	// A rule may have only of the following sets:
 	// 1. A token and _either_ a push or pop
 	// 2. An Include
 	// 3. A ByGroups
 
-	if r.Pattern == "" && r.Push == nil && r.Pop == nil && r.Include == nil {
+	if r.Pattern == "" && r.Words == nil && r.Delimited == nil && r.Call == nil && r.Push == nil && r.Pop == nil && r.Include == nil && r.Mutators == nil {
 		return fmt.Errorf("Rule has no pattern, no include, no push and no pop statement. This is not supported.")
 	}
 
+	if r.Words != nil {
+		if r.Pattern != "" {
+			return fmt.Errorf("a rule has both a Pattern and Words")
+		}
+		if len(strings.Fields(r.Words.List)) == 0 {
+			return fmt.Errorf("a rule has a Words with no words")
+		}
+	}
+
+	if r.Delimited != nil {
+		if r.Pattern != "" || r.Words != nil {
+			return fmt.Errorf("a rule has a Delimited and either a Pattern or Words")
+		}
+		if r.Token != nil || r.ByGroups != nil || r.Include != nil || r.Combined != nil || r.UsingSelf != nil || r.Using != nil {
+			return fmt.Errorf("a rule has a Delimited and either a Token, ByGroups, Include, Combined, UsingSelf or Using")
+		}
+		if r.Delimited.Open == "" || r.Delimited.Close == "" {
+			return fmt.Errorf("a rule has a Delimited without an open or close delimiter")
+		}
+		if r.Delimited.Nested && r.Delimited.Open == r.Delimited.Close {
+			return fmt.Errorf("a rule has a nested Delimited whose open and close delimiters are the same")
+		}
+	}
+
+	if r.Call != nil {
+		if r.Pattern != "" || r.Words != nil || r.Delimited != nil {
+			return fmt.Errorf("a rule has a Call and either a Pattern, Words or Delimited")
+		}
+		if r.Token != nil || r.ByGroups != nil || r.Include != nil || r.Combined != nil || r.UsingSelf != nil || r.Using != nil ||
+			r.Push != nil || r.Pop != nil || r.Mutators != nil {
+			return fmt.Errorf("a rule has a Call and either a Token, ByGroups, Include, Combined, UsingSelf, Using, Push, Pop or Mutators")
+		}
+		if r.Call.Func == "" {
+			return fmt.Errorf("a rule has a Call with no function")
+		}
+	}
+
+	for _, p := range pushesOf(r) {
+		if p.Capture == "" && p.Group != 0 {
+			return fmt.Errorf("a push has a group but no capture")
+		}
+		if p.Capture != "" && !capturedVariableRef.MatchString("{{$"+p.Capture+"}}") {
+			return fmt.Errorf("a push captures into the variable '%s', but the name of a variable must be a word", p.Capture)
+		}
+		if p.Group < 0 {
+			return fmt.Errorf("a push captures the negative group %d", p.Group)
+		}
+		if p.Capture != "" && r.Delimited != nil {
+			return fmt.Errorf("a rule has a Delimited and a push that captures")
+		}
+	}
+
+	if r.If != "" {
+		err := checkCondition(r.If, lb.cfg)
+		if err != nil {
+			return err
+		}
+	}
+
 	if r.Pop != nil && r.Push != nil {
-		return fmt.Errorf("Rule contains both a push and a pop")
+		return fmt.Errorf("Rule contains both a push and a pop. Use a mutators element instead.")
+	}
+
+	if r.Mutators != nil && (r.Push != nil || r.Pop != nil || r.Include != nil) {
+		return fmt.Errorf("a rule has both a Mutators and either a Push, Pop or Include")
 	}
 
 	if r.Token != nil {
@@ -383,8 +1052,12 @@ func (lb *lexerBuilder) checkRule(r *config.Rule) error {
 		}
 	}
 
-	if r.Combined != nil && (r.Push != nil || r.Pop != nil || r.Include != nil) {
-		return fmt.Errorf("a rule has both a Combined and either a Push, Pop or Include")
+	if r.UsingSelf != nil && r.Using != nil {
+		return fmt.Errorf("a rule has both a UsingSelf and a Using")
+	}
+
+	if r.Combined != nil && (r.Push != nil || r.Pop != nil || r.Include != nil || r.Mutators != nil) {
+		return fmt.Errorf("a rule has both a Combined and either a Push, Pop, Include or Mutators")
 	}
 
 	return nil
@@ -395,9 +1068,9 @@ func (lb *lexerBuilder) resolveIncludes() error {
 	newRules := map[string]state{}
 
 	for name, st := range lb.lexer.rules.rules {
-		list, err := lb.resolveIncludesIn(st.rules)
+		list, err := lb.resolveIncludesIn(st.rules, []string{name})
 		if err != nil {
-			return err
+			return lb.errorInState(name, err)
 		}
 		st.rules = list
 
@@ -408,7 +1081,9 @@ func (lb *lexerBuilder) resolveIncludes() error {
 	return nil
 }
 
-func (lb *lexerBuilder) resolveIncludesIn(rules []rule) (newRules []rule, err error) {
+// resolveIncludesIn replaces the include rules in rules with the rules of the included states. including
+// holds the names of the states whose includes are being resolved, and is used to detect include cycles.
+func (lb *lexerBuilder) resolveIncludesIn(rules []rule, including []string) (newRules []rule, err error) {
 	newRules = make([]rule, 0, len(rules))
 
 	for _, rl := range rules {
@@ -419,8 +1094,16 @@ func (lb *lexerBuilder) resolveIncludesIn(rules []rule) (newRules []rule, err er
 				return
 			}
 
+			for _, name := range including {
+				if name == rl.include {
+					err = fmt.Errorf("The state named '%s' includes itself: %s", rl.include,
+						strings.Join(append(including, rl.include), " -> "))
+					return
+				}
+			}
+
 			var resolved []rule
-			resolved, err = lb.resolveIncludesIn(includeState.rules)
+			resolved, err = lb.resolveIncludesIn(includeState.rules, append(including[:len(including):len(including)], rl.include))
 			if err != nil {
 				return
 			}
@@ -1,7 +1,12 @@
 package syn
 
 import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"testing/fstest"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -612,3 +617,1394 @@ int var3;
 
 }
 */
+
+func TestCaseInsensitiveLexer(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerFromXMLFile("lexers/embedded/sql.xml")
+	assert.Nil(err)
+	if err != nil {
+		t.FailNow()
+	}
+
+	input := []rune("select x FROM t")
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+
+	dumpTokens(t, tokens)
+
+	expected := []Token{
+		{Type: Keyword, Value: []rune("select"), Start: 0, End: 6},
+		{Type: TextWhitespace, Value: []rune(" "), Start: 6, End: 7},
+		{Type: Name, Value: []rune("x"), Start: 7, End: 8},
+		{Type: TextWhitespace, Value: []rune(" "), Start: 8, End: 9},
+		{Type: Keyword, Value: []rune("FROM"), Start: 9, End: 13},
+		{Type: TextWhitespace, Value: []rune(" "), Start: 13, End: 14},
+		{Type: Name, Value: []rune("t"), Start: 14, End: 15},
+	}
+
+	assert.Equal(expected, tokens)
+}
+
+func TestDotAllLexers(t *testing.T) {
+	// With dot_all the %-string of Ruby and Crystal runs over the newline. Its rule captures
+	// the delimiter inside the string, and emitting that group too would put every following
+	// token out of place.
+	input := []rune("x = % a\nif a and b\n  y \nend\n")
+
+	for _, name := range []string{"ruby", "crystal"} {
+		t.Run(name, func(t *testing.T) {
+			lex, err := NewLexerFromXMLFile("lexers/embedded/" + name + ".xml")
+			if err != nil {
+				t.Fatalf("Creating lexer failed: %v", err)
+			}
+
+			tokens, err := tokenize(lex.Tokenise(input))
+			if err != nil {
+				t.Fatalf("Tokenizing returned error: %v\n", err)
+			}
+
+			end := 0
+			for _, tok := range tokens {
+				if !assert.Equal(t, end, tok.Start) || !assert.Equal(t, string(input[tok.Start:tok.End]), string(tok.Value)) {
+					dumpTokens(t, tokens)
+					t.FailNow()
+				}
+				end = tok.End
+			}
+			assert.Equal(t, len(input), end)
+			assert.Contains(t, tokens, Token{Type: LiteralStringOther, Value: []rune("% a\nif "), Start: 4, End: 11})
+		})
+	}
+}
+
+func TestRuleRegexpFlagOverride(t *testing.T) {
+	def := `
+<lexer>
+  <config>
+    <name>Test</name>
+    <case_insensitive>true</case_insensitive>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="abc" case_insensitive="false">
+        <token type="Keyword"/>
+      </rule>
+      <rule pattern="def">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Other"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	assert := assert.New(t)
+
+	lex, err := NewLexerFromXML(strings.NewReader(def))
+	assert.Nil(err)
+	if err != nil {
+		t.FailNow()
+	}
+
+	input := []rune("abc ABC DEF")
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+
+	expected := []Token{
+		{Type: Keyword, Value: []rune("abc"), Start: 0, End: 3},
+		{Type: Text, Value: []rune(" "), Start: 3, End: 4},
+		{Type: Other, Value: []rune("ABC"), Start: 4, End: 7},
+		{Type: Text, Value: []rune(" "), Start: 7, End: 8},
+		{Type: Name, Value: []rune("DEF"), Start: 8, End: 11},
+	}
+
+	assert.Equal(expected, tokens)
+}
+
+func TestEnsureNL(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerFromXMLFile("lexers/embedded/go.xml")
+	assert.Nil(err)
+	if err != nil {
+		t.FailNow()
+	}
+
+	input := []rune("x := 1\r\n// comment")
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+
+	dumpTokens(t, tokens)
+
+	expected := []Token{
+		{Type: NameOther, Value: []rune("x"), Start: 0, End: 1},
+		{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+		{Type: Operator, Value: []rune(":="), Start: 2, End: 4},
+		{Type: Text, Value: []rune(" "), Start: 4, End: 5},
+		{Type: LiteralNumberInteger, Value: []rune("1"), Start: 5, End: 6},
+		{Type: Text, Value: []rune("\r\n"), Start: 6, End: 8},
+		{Type: CommentSingle, Value: []rune("// comment"), Start: 8, End: 18},
+	}
+
+	assert.Equal(expected, tokens)
+
+	// The appended newline must not alter the caller's text.
+	assert.Equal("x := 1\r\n// comment", string(input))
+	assert.Equal(18, len(input))
+}
+
+func TestUsingLexer(t *testing.T) {
+	host := `
+<lexer>
+  <config>
+    <name>Host</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="(\[)([^\]]*)(\])">
+        <bygroups>
+          <token type="Punctuation"/>
+          <using lexer="Inner"/>
+          <token type="Punctuation"/>
+        </bygroups>
+      </rule>
+      <rule pattern="&lt;[^&gt;]*&gt;">
+        <using lexer="inner"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	inner := `
+<lexer>
+  <config>
+    <name>Inner</name>
+    <alias>inner</alias>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="\d+">
+        <token type="LiteralNumber"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Keyword"/>
+      </rule>
+      <rule pattern="[^\w]">
+        <token type="Operator"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	assert := assert.New(t)
+
+	reg := NewLexerRegistry()
+	for _, def := range []string{host, inner} {
+		lex, err := NewLexerFromXML(strings.NewReader(def))
+		if err != nil {
+			t.Fatalf("Creating lexer failed: %v", err)
+		}
+		reg.Register(lex)
+	}
+
+	input := []rune("a [b 1] c <2>")
+	expected := []Token{
+		{Type: Name, Value: []rune("a"), Start: 0, End: 1},
+		{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+		{Type: Punctuation, Value: []rune("["), Start: 2, End: 3},
+		{Type: Keyword, Value: []rune("b"), Start: 3, End: 4},
+		{Type: Operator, Value: []rune(" "), Start: 4, End: 5},
+		{Type: LiteralNumber, Value: []rune("1"), Start: 5, End: 6},
+		{Type: Punctuation, Value: []rune("]"), Start: 6, End: 7},
+		{Type: Text, Value: []rune(" "), Start: 7, End: 8},
+		{Type: Name, Value: []rune("c"), Start: 8, End: 9},
+		{Type: Text, Value: []rune(" "), Start: 9, End: 10},
+		{Type: Operator, Value: []rune("<"), Start: 10, End: 11},
+		{Type: LiteralNumber, Value: []rune("2"), Start: 11, End: 12},
+		{Type: Operator, Value: []rune(">"), Start: 12, End: 13},
+	}
+
+	tokens, err := tokenize(reg.Get("Host").Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	dumpTokens(t, tokens)
+	assert.Equal(expected, tokens)
+
+	// Saving the state part way through, including while the sublexer is running, and
+	// restoring it later must produce the same tokens.
+	for i := 1; i < len(expected); i++ {
+		it := reg.Get("Host").Tokenise(input)
+
+		tokens, err := tokenizeAtMost(it, i)
+		assert.Nil(err)
+
+		state := it.State()
+		_, err = tokenize(it)
+		assert.Nil(err)
+		it.SetState(state)
+
+		rest, err := tokenize(it)
+		assert.Nil(err)
+
+		assert.Equal(expected, append(tokens, rest...), "restoring state after %d tokens", i)
+	}
+}
+
+func TestUsingUnregisteredLexer(t *testing.T) {
+	def := `
+<lexer>
+  <config>
+    <name>Host</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern=".+">
+        <using lexer="Missing"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	lex, err := NewLexerFromXML(strings.NewReader(def))
+	if err != nil {
+		t.Fatalf("Creating lexer failed: %v", err)
+	}
+	NewLexerRegistry().Register(lex)
+
+	_, err = tokenize(lex.Tokenise([]rune("text")))
+	assert.NotNil(t, err)
+}
+
+func TestAnalyse(t *testing.T) {
+	def := `
+<lexer>
+  <config>
+    <name>Test</name>
+    <analyse>
+      <regex pattern="(?m)^%test" score="0.4"/>
+      <regex pattern="(?m)^%more" score="0.3"/>
+      <regex pattern="(?m)^%lots" score="0.9"/>
+    </analyse>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern=".+">
+        <token type="Text"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	assert := assert.New(t)
+
+	reg := NewLexerRegistry()
+	test, err := NewLexerFromXML(strings.NewReader(def))
+	if err != nil {
+		t.Fatalf("Creating lexer failed: %v", err)
+	}
+	reg.Register(test)
+
+	for _, file := range []string{"lexers/embedded/bash.xml", "lexers/embedded/python.xml", "lexers/embedded/c.xml"} {
+		lex, err := NewLexerFromXMLFile(file)
+		if err != nil {
+			t.Fatalf("Creating lexer failed: %v", err)
+		}
+		reg.Register(lex)
+	}
+
+	assert.InDelta(0.7, test.AnalyseText([]rune("x\n%test\n%more\n")), 0.0001)
+	assert.Equal(float32(1), test.AnalyseText([]rune("%test\n%more\n%lots\n")))
+	assert.Equal(float32(0), reg.Get("C").AnalyseText([]rune("int main() {}")))
+
+	assert.Equal(reg.Get("Bash"), reg.Analyse([]rune("#!/bin/bash\necho hi\n")))
+	assert.Equal(reg.Get("Python"), reg.Analyse([]rune("#!/usr/bin/env python3\nprint('hi')\n")))
+	assert.Equal(test, reg.Analyse([]rune("%test\n")))
+	assert.Nil(reg.Analyse([]rune("nothing recognisable")))
+}
+
+func TestMutators(t *testing.T) {
+	def := `
+<lexer>
+  <config>
+    <name>Test</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="\(">
+        <token type="Punctuation"/>
+        <push state="paren"/>
+      </rule>
+      <rule pattern="\[">
+        <token type="Punctuation"/>
+        <mutators>
+          <push state="outer"/>
+          <push state="inner"/>
+        </mutators>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="paren">
+      <rule pattern="\(">
+        <token type="Punctuation"/>
+        <push/>
+      </rule>
+      <rule pattern="\)">
+        <token type="Punctuation"/>
+        <pop depth="1"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Keyword"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="outer">
+      <rule pattern="\]">
+        <token type="Punctuation"/>
+        <pop depth="1"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="LiteralString"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="inner">
+      <rule pattern=";">
+        <token type="Punctuation"/>
+        <mutators>
+          <pop depth="1"/>
+          <push state="last"/>
+        </mutators>
+      </rule>
+      <rule pattern="\w+">
+        <token type="NameOther"/>
+      </rule>
+    </state>
+    <state name="last">
+      <rule pattern="\]">
+        <token type="Punctuation"/>
+        <pop depth="1"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="LiteralNumber"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	assert := assert.New(t)
+
+	lex, err := NewLexerFromXML(strings.NewReader(def))
+	if err != nil {
+		t.Fatalf("Creating lexer failed: %v", err)
+	}
+
+	input := []rune("a (b (c) d) e [f;g] h] i")
+	expected := []Token{
+		{Type: Name, Value: []rune("a"), Start: 0, End: 1},
+		{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+		{Type: Punctuation, Value: []rune("("), Start: 2, End: 3},
+		{Type: Keyword, Value: []rune("b"), Start: 3, End: 4},
+		{Type: Text, Value: []rune(" "), Start: 4, End: 5},
+		{Type: Punctuation, Value: []rune("("), Start: 5, End: 6},
+		{Type: Keyword, Value: []rune("c"), Start: 6, End: 7},
+		{Type: Punctuation, Value: []rune(")"), Start: 7, End: 8},
+		{Type: Text, Value: []rune(" "), Start: 8, End: 9},
+		{Type: Keyword, Value: []rune("d"), Start: 9, End: 10},
+		{Type: Punctuation, Value: []rune(")"), Start: 10, End: 11},
+		{Type: Text, Value: []rune(" "), Start: 11, End: 12},
+		{Type: Name, Value: []rune("e"), Start: 12, End: 13},
+		{Type: Text, Value: []rune(" "), Start: 13, End: 14},
+		{Type: Punctuation, Value: []rune("["), Start: 14, End: 15},
+		{Type: NameOther, Value: []rune("f"), Start: 15, End: 16},
+		{Type: Punctuation, Value: []rune(";"), Start: 16, End: 17},
+		{Type: LiteralNumber, Value: []rune("g"), Start: 17, End: 18},
+		{Type: Punctuation, Value: []rune("]"), Start: 18, End: 19},
+		{Type: Text, Value: []rune(" "), Start: 19, End: 20},
+		{Type: LiteralString, Value: []rune("h"), Start: 20, End: 21},
+		{Type: Punctuation, Value: []rune("]"), Start: 21, End: 22},
+		{Type: Text, Value: []rune(" "), Start: 22, End: 23},
+		{Type: Name, Value: []rune("i"), Start: 23, End: 24},
+	}
+
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	dumpTokens(t, tokens)
+	assert.Equal(expected, tokens)
+
+	for i := 1; i < len(expected); i++ {
+		it := lex.Tokenise(input)
+
+		tokens, err := tokenizeAtMost(it, i)
+		assert.Nil(err)
+
+		state := it.State()
+		_, err = tokenize(it)
+		assert.Nil(err)
+		it.SetState(state)
+		assert.True(state.Equal(it.State()))
+
+		rest, err := tokenize(it)
+		assert.Nil(err)
+
+		assert.Equal(expected, append(tokens, rest...), "restoring state after %d tokens", i)
+	}
+}
+
+func TestRuleWithPushAndPopIsRejected(t *testing.T) {
+	def := `
+<lexer>
+  <config>
+    <name>Test</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="x">
+        <token type="Keyword"/>
+        <pop depth="1"/>
+        <push state="root"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	_, err := NewLexerFromXML(strings.NewReader(def))
+	assert.NotNil(t, err)
+}
+
+func TestUsingByGroup(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := NewLexerRegistry()
+	for _, file := range []string{"lexers/embedded/markdown.xml", "lexers/embedded/go.xml", "lexers/embedded/c.xml"} {
+		lex, err := NewLexerFromXMLFile(file)
+		if err != nil {
+			t.Fatalf("Creating lexer failed: %v", err)
+		}
+		reg.Register(lex)
+	}
+
+	input := []rune("```go\nx := 1\n```\n```h\nint\n```\n```nope\nx := 1\n```\n")
+	expected := []Token{
+		{Type: LiteralString, Value: []rune("```go\n"), Start: 0, End: 6},
+		{Type: NameOther, Value: []rune("x"), Start: 6, End: 7},
+		{Type: Text, Value: []rune(" "), Start: 7, End: 8},
+		{Type: Operator, Value: []rune(":="), Start: 8, End: 10},
+		{Type: Text, Value: []rune(" "), Start: 10, End: 11},
+		{Type: LiteralNumberInteger, Value: []rune("1"), Start: 11, End: 12},
+		{Type: Text, Value: []rune("\n"), Start: 12, End: 13},
+		{Type: LiteralString, Value: []rune("```"), Start: 13, End: 16},
+		{Type: Other, Value: []rune("\n"), Start: 16, End: 17},
+		{Type: LiteralString, Value: []rune("```h\n"), Start: 17, End: 22},
+		{Type: KeywordType, Value: []rune("int"), Start: 22, End: 25},
+		{Type: Text, Value: []rune("\n"), Start: 25, End: 26},
+		{Type: LiteralString, Value: []rune("```"), Start: 26, End: 29},
+		{Type: Other, Value: []rune("\n"), Start: 29, End: 30},
+		{Type: LiteralString, Value: []rune("```nope\n"), Start: 30, End: 38},
+		{Type: Text, Value: []rune("x := 1\n"), Start: 38, End: 45},
+		{Type: LiteralString, Value: []rune("```"), Start: 45, End: 48},
+		{Type: Other, Value: []rune("\n"), Start: 48, End: 49},
+	}
+
+	tokens, err := tokenize(reg.Get("markdown").Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	dumpTokens(t, tokens)
+	assert.Equal(expected, tokens)
+}
+
+func TestWriteXMLRoundTrip(t *testing.T) {
+	paths, err := filepath.Glob("lexers/embedded/*.xml")
+	if err != nil {
+		t.Fatalf("Listing lexers failed: %v", err)
+	}
+
+	sorted := func(s []string) []string {
+		if s == nil {
+			return nil
+		}
+		c := append([]string{}, s...)
+		sort.Strings(c)
+		return c
+	}
+
+	for _, path := range paths {
+		lex, err := NewLexerFromXMLFile(path)
+		if err != nil {
+			t.Fatalf("Loading lexer %s failed: %v", path, err)
+		}
+
+		var buf bytes.Buffer
+		err = lex.WriteXML(&buf)
+		if err != nil {
+			t.Fatalf("Writing lexer %s failed: %v", path, err)
+		}
+		written := buf.String()
+
+		lex2, err := NewLexerFromXML(&buf)
+		if err != nil {
+			t.Fatalf("Loading written lexer %s failed: %v. XML was:\n%s", path, err, written)
+		}
+
+		expected := *lex.cfg()
+		expected.Config.Aliases = sorted(expected.Config.Aliases)
+		expected.Config.Filenames = sorted(expected.Config.Filenames)
+		expected.Config.MimeTypes = sorted(expected.Config.MimeTypes)
+		assert.Equal(t, &expected, lex2.cfg(), "lexer %s", path)
+
+		// The output is already canonical, so writing it again produces the same text.
+		var buf2 bytes.Buffer
+		err = lex2.WriteXML(&buf2)
+		assert.Nil(t, err)
+		assert.Equal(t, written, buf2.String(), "lexer %s", path)
+	}
+}
+
+func TestLexerDefinitionFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	fsys := fstest.MapFS{
+		"lang.xml": &fstest.MapFile{Data: []byte(`
+<lexer>
+  <config>
+    <name>Lang</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="&quot;">
+        <token type="LiteralString"/>
+        <push state="string"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="string">
+      <rule pattern="[^&quot;]+">
+        <token type="LiteralString"/>
+      </rule>
+      <rule pattern="&quot;">
+        <token type="LiteralString"/>
+        <pop depth="1"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+		"lang.json": &fstest.MapFile{Data: []byte(`
+{
+  "config": {"name": "Lang"},
+  "rules": {
+    "states": [
+      {
+        "name": "root",
+        "rules": [
+          {"pattern": "\"", "token": {"type": "LiteralString"}, "push": {"state": "string"}},
+          {"pattern": "\\w+", "token": {"type": "Name"}},
+          {"pattern": "\\s+", "token": {"type": "Text"}}
+        ]
+      },
+      {
+        "name": "string",
+        "rules": [
+          {"pattern": "[^\"]+", "token": {"type": "LiteralString"}},
+          {"pattern": "\"", "token": {"type": "LiteralString"}, "pop": {"depth": 1}}
+        ]
+      }
+    ]
+  }
+}`)},
+		"lang.yml": &fstest.MapFile{Data: []byte(`
+config:
+  name: Lang
+rules:
+  states:
+    - name: root
+      rules:
+        - pattern: '"'
+          token: {type: LiteralString}
+          push: {state: string}
+        - pattern: '\w+'
+          token: {type: Name}
+        - pattern: '\s+'
+          token: {type: Text}
+    - name: string
+      rules:
+        - pattern: '[^"]+'
+          token: {type: LiteralString}
+        - pattern: '"'
+          token: {type: LiteralString}
+          pop: {depth: 1}
+`)},
+		"lang.txt": &fstest.MapFile{Data: []byte("not a lexer")},
+	}
+
+	expected := []Token{
+		{Type: Name, Value: []rune("say"), Start: 0, End: 3},
+		{Type: Text, Value: []rune(" "), Start: 3, End: 4},
+		{Type: LiteralString, Value: []rune(`"hi there"`), Start: 4, End: 14},
+	}
+
+	for _, name := range []string{"lang.xml", "lang.json", "lang.yml"} {
+		assert.True(IsLexerDefinitionFile(name))
+
+		lex, err := NewLexerFromFS(fsys, name)
+		if err != nil {
+			t.Fatalf("Loading %s failed: %v\n", name, err)
+		}
+
+		tokens, err := tokenize(lex.Tokenise([]rune(`say "hi there"`)))
+		if err != nil {
+			t.Fatalf("Tokenizing with %s returned error: %v\n", name, err)
+		}
+
+		assert.Equal(expected, tokens, "lexer %s", name)
+	}
+
+	assert.False(IsLexerDefinitionFile("lang.txt"))
+	_, err := NewLexerFromFS(fsys, "lang.txt")
+	assert.NotNil(err)
+}
+
+func TestLexerDefinitionError(t *testing.T) {
+	assert := assert.New(t)
+
+	fsys := fstest.MapFS{
+		"bad_pattern.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <config>
+    <name>Bad</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+    </state>
+    <state name="string">
+      <rule pattern="&quot;">
+        <token type="LiteralString"/>
+      </rule>
+        <rule pattern="(x">
+        <token type="LiteralString"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+		"bad_syntax.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <config>
+    <name>Bad</name>
+  </config>
+  <rules>
+</lexer>`)},
+		"missing_push.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <config>
+    <name>Bad</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="x">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="y">
+        <token type="Name"/>
+        <push state="missing"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+	}
+
+	var defErr *LexerDefinitionError
+
+	_, err := NewLexerFromFS(fsys, "bad_pattern.xml")
+	if assert.ErrorAs(err, &defErr) {
+		assert.Equal("bad_pattern.xml", defErr.File)
+		assert.Equal(15, defErr.Line)
+		assert.Equal(9, defErr.Column)
+		assert.Equal("string", defErr.State)
+		assert.Equal(1, defErr.Rule)
+		assert.Equal("(x", defErr.Pattern)
+		assert.True(strings.HasPrefix(err.Error(), "bad_pattern.xml:15:9: For state string: rule index 1: "), err.Error())
+	}
+
+	_, err = NewLexerFromXMLFS(fsys, "bad_syntax.xml")
+	if assert.ErrorAs(err, &defErr) {
+		assert.Equal("bad_syntax.xml", defErr.File)
+		assert.Equal(6, defErr.Line)
+		assert.Equal(-1, defErr.Rule)
+	}
+
+	_, err = NewLexerFromFS(fsys, "missing_push.xml")
+	if assert.ErrorAs(err, &defErr) {
+		assert.Equal(10, defErr.Line)
+		assert.Equal(7, defErr.Column)
+		assert.Equal("root", defErr.State)
+		assert.Equal(1, defErr.Rule)
+	}
+
+	// Definitions that aren't read from XML have no position.
+	_, err = NewLexerDef("Bad").
+		State("root").
+		Rule(`(x`, Emit(Text)).
+		Build()
+	if assert.ErrorAs(err, &defErr) {
+		assert.Equal(0, defErr.Line)
+		assert.Equal("root", defErr.State)
+		assert.Equal(0, defErr.Rule)
+	}
+}
+
+func TestNewLexerFromXMLStrict(t *testing.T) {
+	assert := assert.New(t)
+
+	def := `<lexer>
+  <config>
+    <name>Misspelt</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="\w+">
+        <token type="Name"/>
+        <Pop depth="1"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	_, err := NewLexerFromXML(strings.NewReader(def))
+	assert.Nil(err)
+
+	_, err = NewLexerFromXMLStrict(strings.NewReader(def))
+	var defErr *LexerDefinitionError
+	if assert.ErrorAs(err, &defErr) {
+		assert.Equal(9, defErr.Line)
+		assert.Equal(9, defErr.Column)
+		assert.Equal("root", defErr.State)
+		assert.Equal(0, defErr.Rule)
+		assert.Equal("line 9, column 9: For state root: rule index 0: unknown element <Pop> in <rule>", err.Error())
+	}
+}
+
+func TestLexerExtends(t *testing.T) {
+	assert := assert.New(t)
+
+	fsys := fstest.MapFS{
+		"base.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <config>
+    <name>Base</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="&quot;">
+        <token type="LiteralString"/>
+        <push state="string"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="string">
+      <rule pattern="[^&quot;\\]+">
+        <token type="LiteralString"/>
+      </rule>
+      <rule pattern="&quot;">
+        <token type="LiteralString"/>
+        <pop depth="1"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+		"derived.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <extends lexer="base"/>
+  <config>
+    <name>Derived</name>
+  </config>
+  <rules>
+    <state name="root" mode="prepend">
+      <rule pattern="say\b">
+        <token type="Keyword"/>
+      </rule>
+    </state>
+    <state name="string" mode="append">
+      <rule pattern="\\.">
+        <token type="LiteralStringEscape"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+		"derived_again.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <extends lexer="Derived"/>
+  <config>
+    <name>DerivedAgain</name>
+  </config>
+  <rules>
+    <state name="string">
+      <rule pattern="[\s\S]">
+        <token type="Comment"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+		"cycle_a.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <extends lexer="CycleB"/>
+  <config>
+    <name>CycleA</name>
+  </config>
+  <rules/>
+</lexer>`)},
+		"cycle_b.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <extends lexer="CycleA"/>
+  <config>
+    <name>CycleB</name>
+  </config>
+  <rules/>
+</lexer>`)},
+		"orphan.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <extends lexer="Missing"/>
+  <config>
+    <name>Orphan</name>
+  </config>
+  <rules/>
+</lexer>`)},
+	}
+
+	reg := NewLexerRegistry()
+	// Lexers may be registered before the lexers they extend.
+	for _, name := range []string{"derived_again.xml", "derived.xml", "base.xml", "cycle_a.xml", "cycle_b.xml", "orphan.xml"} {
+		lex, err := NewLexerFromFS(fsys, name)
+		if err != nil {
+			t.Fatalf("Loading %s failed: %v\n", name, err)
+		}
+		reg.Register(lex)
+	}
+
+	errs := reg.Resolve()
+	assert.Len(errs, 3)
+	for _, err := range errs {
+		t.Logf("%v", err)
+	}
+	assert.Nil(reg.Get("CycleA"))
+	assert.Nil(reg.Get("CycleB"))
+	assert.Nil(reg.Get("Orphan"))
+	assert.Len(reg.Lexers, 3)
+
+	derived := reg.Get("Derived")
+	if !assert.NotNil(derived) {
+		return
+	}
+	assert.Equal("", derived.Extends())
+
+	tokens, err := tokenize(derived.Tokenise([]rune(`say "a\"b"`)))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal([]Token{
+		{Type: Keyword, Value: []rune("say"), Start: 0, End: 3},
+		{Type: Text, Value: []rune(" "), Start: 3, End: 4},
+		{Type: LiteralString, Value: []rune(`"a`), Start: 4, End: 6},
+		{Type: LiteralStringEscape, Value: []rune(`\"`), Start: 6, End: 8},
+		{Type: LiteralString, Value: []rune(`b"`), Start: 8, End: 10},
+	}, tokens)
+
+	tokens, err = tokenize(reg.Get("DerivedAgain").Tokenise([]rune(`say "ab"`)))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal([]Token{
+		{Type: Keyword, Value: []rune("say"), Start: 0, End: 3},
+		{Type: Text, Value: []rune(" "), Start: 3, End: 4},
+		{Type: LiteralString, Value: []rune(`"`), Start: 4, End: 5},
+		{Type: Comment, Value: []rune(`ab"`), Start: 5, End: 8},
+	}, tokens)
+
+	// The definition is written as it was given, extending the other lexer.
+	var buf bytes.Buffer
+	assert.Nil(derived.WriteXML(&buf))
+	assert.Contains(buf.String(), `<extends lexer="base"/>`)
+	assert.Contains(buf.String(), `<state name="root" mode="prepend">`)
+
+	// A state can only have a mode in a lexer that extends another.
+	_, err = NewLexerFromXML(strings.NewReader(`<lexer>
+  <config>
+    <name>Mode</name>
+  </config>
+  <rules>
+    <state name="root" mode="append">
+      <rule pattern="x">
+        <token type="Text"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`))
+	assert.NotNil(err)
+}
+
+func TestPendingLexerReturnsError(t *testing.T) {
+	lex, err := NewLexerFromXML(strings.NewReader(`<lexer>
+  <extends lexer="Base"/>
+  <config>
+    <name>Pending</name>
+  </config>
+  <rules>
+    <state name="root"/>
+  </rules>
+</lexer>`))
+	if err != nil {
+		t.Fatalf("Loading the lexer failed: %v", err)
+	}
+
+	_, err = lex.Tokenise([]rune("a")).Next()
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "LexerRegistry.Resolve")
+	}
+}
+
+func TestArduinoExtendsCpp(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := NewLexerRegistry()
+	for _, file := range []string{"lexers/embedded/c++.xml", "lexers/embedded/arduino.xml"} {
+		lex, err := NewLexerFromXMLFile(file)
+		if err != nil {
+			t.Fatalf("Loading %s failed: %v", file, err)
+		}
+		reg.Register(lex)
+	}
+	assert.Empty(reg.Resolve())
+
+	tokens, err := tokenize(reg.Get("Arduino").Tokenise([]rune("class Led {};\n")))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	expected := []Token{
+		{Type: Keyword, Value: []rune("class"), Start: 0, End: 5},
+		{Type: Text, Value: []rune(" "), Start: 5, End: 6},
+		{Type: NameClass, Value: []rune("Led"), Start: 6, End: 9},
+		{Type: Text, Value: []rune(" "), Start: 9, End: 10},
+		{Type: Punctuation, Value: []rune("{};"), Start: 10, End: 13},
+		{Type: Text, Value: []rune("\n"), Start: 13, End: 14},
+	}
+	assert.Equal(expected, tokens)
+}
+
+func TestIncludeStateOfOtherLexer(t *testing.T) {
+	assert := assert.New(t)
+
+	fsys := fstest.MapFS{
+		"common.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <config>
+    <name>Common</name>
+    <case_insensitive>true</case_insensitive>
+  </config>
+  <rules>
+    <state name="root">
+      <rule>
+        <include state="numbers"/>
+      </rule>
+    </state>
+    <state name="numbers">
+      <rule pattern="0x[0-9a-f]+">
+        <token type="LiteralNumberHex"/>
+      </rule>
+      <rule pattern="[0-9]+">
+        <token type="LiteralNumberInteger"/>
+        <push state="suffix"/>
+      </rule>
+    </state>
+    <state name="suffix">
+      <rule pattern="[a-z]+">
+        <token type="KeywordType"/>
+        <pop depth="1"/>
+      </rule>
+      <rule>
+        <include lexer="Words" state="words"/>
+      </rule>
+      <rule pattern="">
+        <pop depth="1"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+		"words.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <config>
+    <name>Words</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule>
+        <include state="words"/>
+      </rule>
+    </state>
+    <state name="words">
+      <rule pattern="\$">
+        <token type="NameVariable"/>
+        <pop depth="1"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+		"host.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <config>
+    <name>Host</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule>
+        <include lexer="common" state="numbers"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+        <push state="suffix"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="suffix">
+      <rule pattern="!">
+        <token type="Punctuation"/>
+        <pop depth="1"/>
+      </rule>
+      <rule pattern="">
+        <pop depth="1"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+		"missing.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <config>
+    <name>Missing</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule>
+        <include lexer="Common" state="strings"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+	}
+
+	reg := NewLexerRegistry()
+	for _, name := range []string{"host.xml", "missing.xml", "common.xml", "words.xml"} {
+		lex, err := NewLexerFromFS(fsys, name)
+		if err != nil {
+			t.Fatalf("Loading %s failed: %v\n", name, err)
+		}
+		reg.Register(lex)
+	}
+
+	errs := reg.Resolve()
+	if assert.Len(errs, 1) {
+		t.Logf("%v", errs[0])
+	}
+	assert.Nil(reg.Get("Missing"))
+
+	host := reg.Get("Host")
+	tokens, err := tokenize(host.Tokenise([]rune("0XFF 12px abc! 3$")))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	expected := []Token{
+		// The pattern is case insensitive as in the Common lexer.
+		{Type: LiteralNumberHex, Value: []rune("0XFF"), Start: 0, End: 4},
+		{Type: Text, Value: []rune(" "), Start: 4, End: 5},
+		// The suffix state of the Common lexer is used, not the one of Host.
+		{Type: LiteralNumberInteger, Value: []rune("12"), Start: 5, End: 7},
+		{Type: KeywordType, Value: []rune("px"), Start: 7, End: 9},
+		{Type: Text, Value: []rune(" "), Start: 9, End: 10},
+		{Type: Name, Value: []rune("abc"), Start: 10, End: 13},
+		{Type: Punctuation, Value: []rune("!"), Start: 13, End: 14},
+		{Type: Text, Value: []rune(" "), Start: 14, End: 15},
+		{Type: LiteralNumberInteger, Value: []rune("3"), Start: 15, End: 16},
+		{Type: NameVariable, Value: []rune("$"), Start: 16, End: 17},
+	}
+	assert.Equal(expected, tokens)
+	assert.Empty(ValidateLexer(host))
+
+	// The definition is written as it was given.
+	var buf bytes.Buffer
+	assert.Nil(host.WriteXML(&buf))
+	assert.Contains(buf.String(), `<include state="numbers" lexer="common"/>`)
+	assert.NotContains(buf.String(), "Common::")
+}
+
+func TestCapturedVariables(t *testing.T) {
+	assert := assert.New(t)
+
+	def := `<lexer>
+  <config>
+    <name>Heredoc</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="(&lt;&lt;)(\S+)">
+        <bygroups>
+          <token type="Operator"/>
+          <token type="NameLabel"/>
+        </bygroups>
+        <push state="heredoc" capture="delim" group="2"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="heredoc">
+      <rule pattern="^{{$delim}}$">
+        <token type="NameLabel"/>
+        <pop depth="1"/>
+      </rule>
+      <rule pattern=".*\n">
+        <token type="LiteralString"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	lex, err := NewLexerFromXMLStrict(strings.NewReader(def))
+	if err != nil {
+		t.Fatalf("Loading the lexer failed: %v", err)
+	}
+	assert.Empty(ValidateLexer(lex))
+
+	// The delimiter is matched literally, so a.b doesn't end the heredoc that a.b started.
+	input := []rune("x <<a.b\naxb\nEND\na.b\ny")
+	expected := []Token{
+		{Type: Name, Value: []rune("x"), Start: 0, End: 1},
+		{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+		{Type: Operator, Value: []rune("<<"), Start: 2, End: 4},
+		{Type: NameLabel, Value: []rune("a.b"), Start: 4, End: 7},
+		{Type: LiteralString, Value: []rune("\naxb\nEND\n"), Start: 7, End: 16},
+		{Type: NameLabel, Value: []rune("a.b"), Start: 16, End: 19},
+		{Type: Text, Value: []rune("\n"), Start: 19, End: 20},
+		{Type: Name, Value: []rune("y"), Start: 20, End: 21},
+	}
+
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal(expected, tokens)
+
+	for i := 1; i < len(expected); i++ {
+		it := lex.Tokenise(input)
+
+		tokens, err := tokenizeAtMost(it, i)
+		assert.Nil(err)
+
+		state := it.State()
+		_, err = tokenize(it)
+		assert.Nil(err)
+		it.SetState(state)
+		assert.True(state.Equal(it.State()))
+
+		rest, err := tokenize(it)
+		assert.Nil(err)
+
+		assert.Equal(expected, append(tokens, rest...), "restoring state after %d tokens", i)
+	}
+
+	// The states differ when the captured values do.
+	it1 := lex.Tokenise([]rune("<<A\nA"))
+	it2 := lex.Tokenise([]rune("<<B\nB"))
+	_, err = tokenizeAtMost(it1, 2)
+	assert.Nil(err)
+	_, err = tokenizeAtMost(it2, 2)
+	assert.Nil(err)
+	assert.False(it1.State().Equal(it2.State()))
+
+	bad := strings.Replace(def, `group="2"`, `group="3"`, 1)
+	_, err = NewLexerFromXML(strings.NewReader(bad))
+	assert.NotNil(err)
+
+	bad = strings.Replace(def, `capture="delim" `, ``, 1)
+	_, err = NewLexerFromXML(strings.NewReader(bad))
+	assert.NotNil(err)
+}
+
+func TestBashHeredoc(t *testing.T) {
+	lex, err := NewLexerFromXMLFile("lexers/embedded/bash.xml")
+	if err != nil {
+		t.Fatalf("Creating lexer failed: %v", err)
+	}
+
+	// Only a heredoc started with <<- ends at a delimiter indented with tabs.
+	input := []rune("cat <<EOF\n\tEOF\nEOF\ncat <<-EOF\n\tx\n\tEOF\necho\n")
+	expected := []Token{
+		{Type: Text, Value: []rune("cat "), Start: 0, End: 4},
+		{Type: LiteralString, Value: []rune("<<EOF"), Start: 4, End: 9},
+		{Type: Text, Value: []rune("\n"), Start: 9, End: 10},
+		{Type: LiteralString, Value: []rune("\tEOF\nEOF"), Start: 10, End: 18},
+		{Type: Text, Value: []rune("\ncat "), Start: 18, End: 23},
+		{Type: LiteralString, Value: []rune("<<-EOF"), Start: 23, End: 29},
+		{Type: Text, Value: []rune("\n"), Start: 29, End: 30},
+		{Type: LiteralString, Value: []rune("\tx\n\tEOF"), Start: 30, End: 37},
+		{Type: Text, Value: []rune("\n"), Start: 37, End: 38},
+		{Type: NameBuiltin, Value: []rune("echo"), Start: 38, End: 42},
+		{Type: Text, Value: []rune("\n"), Start: 42, End: 43},
+	}
+
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	assert.Equal(t, expected, tokens)
+}
+
+func TestRulesSeeTextBeforeMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	def := `<lexer>
+  <config>
+    <name>Context</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule pattern="^#[^\n]*">
+        <token type="GenericHeading"/>
+      </rule>
+      <rule pattern="(?&lt;=\.)\w+">
+        <token type="NameAttribute"/>
+      </rule>
+      <rule pattern="\bat\b">
+        <token type="Keyword"/>
+      </rule>
+      <rule pattern="[0-9]">
+        <token type="LiteralNumber"/>
+      </rule>
+      <rule pattern="(\w+:)([^\n]*)">
+        <bygroups>
+          <token type="NameTag"/>
+          <usingself state="root"/>
+        </bygroups>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+      <rule pattern="[#.]">
+        <token type="Punctuation"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	lex, err := NewLexerFromXML(strings.NewReader(def))
+	if err != nil {
+		t.Fatalf("Loading the lexer failed: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		input    string
+		expected []Token
+	}{
+		{
+			name:  "line start in the middle of a line",
+			input: "a # b\n# c",
+			expected: []Token{
+				{Type: Name, Value: []rune("a"), Start: 0, End: 1},
+				{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+				{Type: Punctuation, Value: []rune("#"), Start: 2, End: 3},
+				{Type: Text, Value: []rune(" "), Start: 3, End: 4},
+				{Type: Name, Value: []rune("b"), Start: 4, End: 5},
+				{Type: Text, Value: []rune("\n"), Start: 5, End: 6},
+				{Type: GenericHeading, Value: []rune("# c"), Start: 6, End: 9},
+			},
+		},
+		{
+			name:  "word boundary and lookbehind",
+			input: "1at .at",
+			expected: []Token{
+				{Type: LiteralNumber, Value: []rune("1"), Start: 0, End: 1},
+				{Type: Name, Value: []rune("at"), Start: 1, End: 3},
+				{Type: Text, Value: []rune(" "), Start: 3, End: 4},
+				{Type: Punctuation, Value: []rune("."), Start: 4, End: 5},
+				{Type: NameAttribute, Value: []rune("at"), Start: 5, End: 7},
+			},
+		},
+		{
+			name:  "usingself group in the middle of a line",
+			input: "k:# at",
+			expected: []Token{
+				{Type: NameTag, Value: []rune("k:"), Start: 0, End: 2},
+				{Type: Punctuation, Value: []rune("#"), Start: 2, End: 3},
+				{Type: Text, Value: []rune(" "), Start: 3, End: 4},
+				{Type: Keyword, Value: []rune("at"), Start: 4, End: 6},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := tokenize(lex.Tokenise([]rune(tc.input)))
+			if err != nil {
+				t.Fatalf("Tokenizing returned error: %v\n", err)
+			}
+			assert.Equal(tc.expected, tokens)
+		})
+	}
+
+	// The state can be saved and restored within the group that the usingself sublexer lexes.
+	input := []rune("x\nk:# at.b\n# c")
+	expected, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+
+	for i := 1; i < len(expected); i++ {
+		it := lex.Tokenise(input)
+
+		tokens, err := tokenizeAtMost(it, i)
+		assert.Nil(err)
+
+		state := it.State()
+		_, err = tokenize(it)
+		assert.Nil(err)
+		it.SetState(state)
+
+		rest, err := tokenize(it)
+		assert.Nil(err)
+
+		assert.Equal(expected, append(tokens, rest...), "restoring state after %d tokens", i)
+	}
+}
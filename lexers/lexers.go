@@ -3,8 +3,10 @@ package lexers
 
 import (
 	"embed"
+	"errors"
 	"fmt"
 	"io/fs"
+	"path"
 
 	"github.com/jeffwilliams/syn"
 )
@@ -15,24 +17,45 @@ var embedded embed.FS
 // GlobalLexerRegistry is the global LexerRegistry of Lexers.
 var GlobalLexerRegistry = func() *syn.LexerRegistry {
 	reg := syn.NewLexerRegistry()
-	// index(reg)
-	paths, err := fs.Glob(embedded, "embedded/*.xml")
+	GlobalLexerLoadErrors = RegisterFS(reg, embedded, "embedded")
+	return reg
+}()
+
+var GlobalLexerLoadErrors []error
+
+// RegisterFS loads all the lexer definitions in the directory dir of fsys and registers them with reg.
+// The directory may mix XML, JSON and YAML definitions; the format of each file is determined by its extension
+// and files with other extensions are ignored. Lexers that extend other lexers are resolved once all the files are
+// registered, so they may extend lexers in the same directory or lexers already in reg. It returns the errors for
+// the lexers that could not be loaded.
+func RegisterFS(reg *syn.LexerRegistry, fsys fs.FS, dir string) (errs []error) {
+	entries, err := fs.ReadDir(fsys, dir)
 	if err != nil {
-		panic(err)
+		return []error{err}
 	}
-	for _, path := range paths {
-		lex, err := syn.NewLexerFromXMLFS(embedded, path)
+
+	for _, entry := range entries {
+		if entry.IsDir() || !syn.IsLexerDefinitionFile(entry.Name()) {
+			continue
+		}
+
+		p := path.Join(dir, entry.Name())
+		lex, err := syn.NewLexerFromFS(fsys, p)
 		if err != nil {
-			GlobalLexerLoadErrors = append(GlobalLexerLoadErrors, fmt.Errorf("Error loading lexer %s: %s", path, err))
+			// A LexerDefinitionError already names the file.
+			var defErr *syn.LexerDefinitionError
+			if !errors.As(err, &defErr) {
+				err = fmt.Errorf("Error loading lexer %s: %w", p, err)
+			}
+			errs = append(errs, err)
 			continue
 		}
 		reg.Register(lex)
-
 	}
-	return reg
-}()
 
-var GlobalLexerLoadErrors []error
+	errs = append(errs, reg.Resolve()...)
+	return
+}
 
 // Names of all lexers, optionally including aliases.
 func Names(withAliases bool) []string {
@@ -53,3 +76,8 @@ func MatchMimeType(mimeType string) *syn.Lexer {
 func Match(filename string) *syn.Lexer {
 	return GlobalLexerRegistry.Match(filename)
 }
+
+// Analyse returns the lexer whose definition scores text the highest. Returns nil when no lexer recognises the text.
+func Analyse(text []rune) *syn.Lexer {
+	return GlobalLexerRegistry.Analyse(text)
+}
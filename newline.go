@@ -0,0 +1,56 @@
+package syn
+
+// withTrailingNL returns text with a newline appended if it doesn't already end in one.
+// The returned bool is true if a newline was appended.
+func withTrailingNL(text []rune) ([]rune, bool) {
+	if len(text) > 0 && (text[len(text)-1] == '\n' || text[len(text)-1] == '\r') {
+		return text, false
+	}
+
+	result := make([]rune, len(text), len(text)+1)
+	copy(result, text)
+	return append(result, '\n'), true
+}
+
+// hideVirtualNL is an Iterator decorator that hides a newline that was appended to text by
+// withTrailingNL. Tokens that lie entirely within the appended newline are dropped, and tokens
+// that include it are truncated so that their Start, End and Value refer only to text.
+func hideVirtualNL(text []rune, it Iterator) Iterator {
+	return &virtualNLHider{
+		text: text,
+		it:   it,
+	}
+}
+
+type virtualNLHider struct {
+	text []rune
+	it   Iterator
+}
+
+func (h *virtualNLHider) Next() (tok Token, err error) {
+	for {
+		tok, err = h.it.Next()
+		if err != nil || tok.Type == EOFType {
+			return
+		}
+
+		if tok.Start >= len(h.text) {
+			continue
+		}
+
+		if tok.End > len(h.text) {
+			tok.End = len(h.text)
+		}
+		tok.Value = h.text[tok.Start:tok.End]
+		return
+	}
+}
+
+// State returns the state of the wrapped iterator. The hider itself has no state of its own.
+func (h *virtualNLHider) State() IteratorState {
+	return h.it.State()
+}
+
+func (h *virtualNLHider) SetState(s IteratorState) {
+	h.it.SetState(s)
+}
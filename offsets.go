@@ -29,6 +29,11 @@ func (o *offsetIterator) Offset() int {
 	return o.offset
 }
 
+// strippedOffset returns the offset in the text after \r\n was converted to \n that corresponds to Offset.
+func (o *offsetIterator) strippedOffset() int {
+	return o.offset - o.nextTransitionIndex
+}
+
 func (o *offsetIterator) Advance(length int) {
 	if length >= 0 {
 		o.forward(length)
@@ -86,8 +91,9 @@ func (o offsetIterator) Clone() offsetIterator {
 	copy(t, o.transitions)
 
 	return offsetIterator{
-		offset:      o.offset,
-		transitions: t,
+		offset:              o.offset,
+		transitions:         t,
+		nextTransitionIndex: o.nextTransitionIndex,
 	}
 }
 
@@ -132,6 +138,11 @@ func (a *offsetAdjuster) Next() (tok Token, err error) {
 		return
 	}
 
+	// Text that is not covered by any token, like text outside the groups of a bygroups rule, is skipped.
+	if gap := tok.Start - a.offsetIter.strippedOffset(); gap > 0 {
+		a.offsetIter.Advance(gap)
+	}
+
 	l := tok.Length()
 	tok.Start = a.offsetIter.Offset()
 	a.offsetIter.Advance(l)
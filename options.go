@@ -0,0 +1,103 @@
+package syn
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jeffwilliams/syn/internal/config"
+)
+
+var conditionSyntax = regexp.MustCompile(`^(\w+)\s*(!?=)\s*([\w.+-]+(?:\s*\|\s*[\w.+-]+)*)$`)
+
+// condition is the condition in the if attribute of a rule, like dialect=mysql. It holds when the option
+// has one of the values, or, if it is negated, when the option has none of them.
+type condition struct {
+	option  string
+	values  []string
+	negated bool
+}
+
+// parseCondition parses a condition of the form option=value or option!=value. The value may be a list
+// of values separated by |, as in dialect=mysql|tsql.
+func parseCondition(s string) (condition, error) {
+	m := conditionSyntax.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return condition{}, fmt.Errorf("a rule has the condition '%s', which is not of the form option=value or option!=value", s)
+	}
+
+	c := condition{option: m[1], negated: m[2] == "!="}
+	for _, v := range strings.Split(m[3], "|") {
+		c.values = append(c.values, strings.TrimSpace(v))
+	}
+	return c, nil
+}
+
+// holds returns true if the condition holds for the option values.
+func (c condition) holds(options map[string]string) bool {
+	value := options[c.option]
+	for _, v := range c.values {
+		if v == value {
+			return !c.negated
+		}
+	}
+	return c.negated
+}
+
+// checkCondition checks that the condition s is well formed and tests an option that cfg declares.
+func checkCondition(s string, cfg *config.Lexer) error {
+	c, err := parseCondition(s)
+	if err != nil {
+		return err
+	}
+
+	for _, o := range cfg.Options {
+		if o.Name == c.option {
+			return nil
+		}
+	}
+	return fmt.Errorf("a rule has a condition on the option %s, which the lexer doesn't declare", c.option)
+}
+
+// ruleApplies returns true if the rule cr has no condition or its condition holds for the option values.
+func ruleApplies(cr *config.Rule, options map[string]string) (bool, error) {
+	if cr.If == "" {
+		return true, nil
+	}
+
+	c, err := parseCondition(cr.If)
+	if err != nil {
+		return false, err
+	}
+	return c.holds(options), nil
+}
+
+// optionValues returns the values of the options that cfg declares. An option has its value in set if it
+// is there, and its default value otherwise. Values in set for options that cfg doesn't declare are ignored.
+func optionValues(cfg *config.Lexer, set map[string]string) map[string]string {
+	values := make(map[string]string, len(cfg.Options))
+	for _, o := range cfg.Options {
+		v, ok := set[o.Name]
+		if !ok {
+			v = o.Default
+		}
+		values[o.Name] = v
+	}
+	return values
+}
+
+// optionsKey returns a string that identifies the option values, for use as the key of a map.
+func optionsKey(values map[string]string) string {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s=%s\x00", name, values[name])
+	}
+	return b.String()
+}
@@ -0,0 +1,181 @@
+package syn
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const optionsLexerDef = `<lexer>
+  <config>
+    <name>Options</name>
+  </config>
+  <options>
+    <option name="dialect" default="ansi"/>
+  </options>
+  <rules>
+    <state name="root">
+      <rule pattern="` + "`[^`]*`" + `" if="dialect=mysql|mariadb">
+        <token type="NameVariable"/>
+      </rule>
+      <rule pattern="&#34;[^&#34;]*&#34;" if="dialect = mysql">
+        <token type="LiteralString"/>
+      </rule>
+      <rule pattern="&#34;[^&#34;]*&#34;">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Keyword"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+      <rule pattern="." if="dialect!=mysql">
+        <token type="Operator"/>
+      </rule>
+      <rule pattern=".">
+        <token type="Punctuation"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+func TestOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, err := NewLexerFromXMLStrict(strings.NewReader(optionsLexerDef))
+	if err != nil {
+		t.Fatalf("Loading the lexer failed: %v", err)
+	}
+	assert.Empty(ValidateLexer(lex))
+	assert.Equal(map[string]string{"dialect": "ansi"}, lex.Options())
+
+	input := []rune("a \"b\" `c`")
+
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	expected := []Token{
+		{Type: Keyword, Value: []rune("a"), Start: 0, End: 1},
+		{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+		{Type: Name, Value: []rune(`"b"`), Start: 2, End: 5},
+		{Type: Text, Value: []rune(" "), Start: 5, End: 6},
+		{Type: Operator, Value: []rune("`"), Start: 6, End: 7},
+		{Type: Keyword, Value: []rune("c"), Start: 7, End: 8},
+		{Type: Operator, Value: []rune("`"), Start: 8, End: 9},
+	}
+	assert.Equal(expected, tokens)
+
+	mysql := lex.WithOptions(map[string]string{"dialect": "mysql"})
+	if mysql == nil {
+		t.Fatalf("Building the mysql variant failed")
+	}
+	assert.Equal(map[string]string{"dialect": "mysql"}, mysql.Options())
+
+	tokens, err = tokenize(mysql.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	expected = []Token{
+		{Type: Keyword, Value: []rune("a"), Start: 0, End: 1},
+		{Type: Text, Value: []rune(" "), Start: 1, End: 2},
+		{Type: LiteralString, Value: []rune(`"b"`), Start: 2, End: 5},
+		{Type: Text, Value: []rune(" "), Start: 5, End: 6},
+		{Type: NameVariable, Value: []rune("`c`"), Start: 6, End: 9},
+	}
+	assert.Equal(expected, tokens)
+
+	tokens, err = tokenize(lex.WithOptions(map[string]string{"dialect": "mariadb"}).Tokenise([]rune("`c`.")))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	expected = []Token{
+		{Type: NameVariable, Value: []rune("`c`"), Start: 0, End: 3},
+		{Type: Operator, Value: []rune("."), Start: 3, End: 4},
+	}
+	assert.Equal(expected, tokens)
+
+	// Variants are cached, and the values that the lexer already has give back the lexer.
+	assert.Same(mysql, lex.WithOptions(map[string]string{"dialect": "mysql"}))
+	assert.Same(mysql, mysql.WithOptions(nil))
+	assert.Same(lex, mysql.WithOptions(map[string]string{"dialect": "ansi"}))
+	assert.Same(lex, lex.WithOptions(map[string]string{"unknown": "x"}))
+	assert.Same(lex, lex.WithOptions(nil))
+}
+
+func TestOptionsOfIncludedLexer(t *testing.T) {
+	fsys := fstest.MapFS{
+		"options.xml": &fstest.MapFile{Data: []byte(optionsLexerDef)},
+		"host.xml": &fstest.MapFile{Data: []byte(`<lexer>
+  <config>
+    <name>Host</name>
+  </config>
+  <rules>
+    <state name="root">
+      <rule>
+        <include lexer="Options" state="root"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`)},
+	}
+
+	reg := NewLexerRegistry()
+	for _, name := range []string{"host.xml", "options.xml"} {
+		lex, err := NewLexerFromFS(fsys, name)
+		if err != nil {
+			t.Fatalf("Loading %s failed: %v\n", name, err)
+		}
+		reg.Register(lex)
+	}
+	assert.Empty(t, reg.Resolve())
+
+	// The included rules are those for the default values of the options of the included lexer.
+	host := reg.Get("Host")
+	tokens, err := tokenize(host.Tokenise([]rune(`"b"`)))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	expected := []Token{
+		{Type: Name, Value: []rune(`"b"`), Start: 0, End: 3},
+	}
+	assert.Equal(t, expected, tokens)
+	assert.Empty(t, host.Options())
+}
+
+func TestBadConditionIsRejected(t *testing.T) {
+	tests := []struct {
+		name      string
+		condition string
+	}{
+		{name: "no value", condition: "dialect="},
+		{name: "no operator", condition: "dialect"},
+		{name: "empty alternative", condition: "dialect=mysql|"},
+		{name: "undeclared option", condition: "version=3"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			def := `<lexer>
+  <config>
+    <name>Test</name>
+  </config>
+  <options>
+    <option name="dialect" default="ansi"/>
+  </options>
+  <rules>
+    <state name="root">
+      <rule pattern="a" if="` + tc.condition + `">
+        <token type="Text"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+			_, err := NewLexerFromXML(strings.NewReader(def))
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package syn
 
 import (
+	"fmt"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -129,9 +130,24 @@ func (l *LexerRegistry) Match(filename string) *Lexer {
 	return nil
 }
 
+// Analyse returns the Lexer whose AnalyseText gives the highest score for text, or nil if no
+// Lexer gives a score above 0.
+func (l *LexerRegistry) Analyse(text []rune) *Lexer {
+	var picked *Lexer
+	highest := float32(0.0)
+	for _, lexer := range l.Lexers {
+		score := lexer.AnalyseText(text)
+		if score > highest {
+			picked = lexer
+			highest = score
+		}
+	}
+	return picked
+}
+
 // Register a Lexer with the LexerRegistry.
 func (l *LexerRegistry) Register(lexer *Lexer) *Lexer {
-	//lexer.SetRegistry(l)
+	lexer.SetRegistry(l)
 
 	config := lexer.cfg().Config
 	l.byName[config.Name] = lexer
@@ -143,3 +159,97 @@ func (l *LexerRegistry) Register(lexer *Lexer) *Lexer {
 	l.Lexers = append(l.Lexers, lexer)
 	return lexer
 }
+
+// Resolve builds the registered lexers that can't be built on their own because they refer to other lexers:
+// lexers that extend another lexer, and lexers that include states of another lexer. It should be called after
+// registering a set of lexers. It returns an error for each lexer that can't be built: because a lexer it refers
+// to is not registered, because the lexers extend each other in a cycle, or because the resulting definition is
+// invalid. Those lexers are removed from the registry.
+func (l *LexerRegistry) Resolve() (errs []error) {
+	// First the definitions of the lexers that extend others are combined with the definitions they extend,
+	// so that the lexers including states of them see the combined states.
+	resolving := map[*Lexer]bool{}
+
+	var extend func(lexer *Lexer, chain []string) error
+	extend = func(lexer *Lexer, chain []string) error {
+		parentName := lexer.Extends()
+		if parentName == "" {
+			return nil
+		}
+
+		chain = append(chain, lexer.cfg().Config.Name)
+		if resolving[lexer] {
+			return fmt.Errorf("The lexers extend each other in a cycle: %s", strings.Join(chain, " -> "))
+		}
+		resolving[lexer] = true
+		defer delete(resolving, lexer)
+
+		parent := l.lookup(parentName)
+		if parent == nil {
+			return fmt.Errorf("The lexer %s extends the lexer %s, which is not registered", lexer.cfg().Config.Name, parentName)
+		}
+
+		err := extend(parent, chain)
+		if err != nil {
+			return err
+		}
+		return lexer.extend(parent)
+	}
+
+	var failed []*Lexer
+	for _, lexer := range l.Lexers {
+		err := extend(lexer, nil)
+		if err != nil {
+			errs = append(errs, err)
+			failed = append(failed, lexer)
+		}
+	}
+	l.unregister(failed...)
+
+	failed = nil
+	for _, lexer := range l.Lexers {
+		if !lexer.pending {
+			continue
+		}
+		err := lexer.build(l)
+		if err != nil {
+			errs = append(errs, err)
+			failed = append(failed, lexer)
+		}
+	}
+	l.unregister(failed...)
+	return
+}
+
+// lookup returns the lexer with the given name or alias, or nil if there is none.
+func (l *LexerRegistry) lookup(name string) *Lexer {
+	for _, n := range []string{name, strings.ToLower(name)} {
+		if lexer := l.byName[n]; lexer != nil {
+			return lexer
+		}
+		if lexer := l.byAlias[n]; lexer != nil {
+			return lexer
+		}
+	}
+	return nil
+}
+
+// unregister removes the lexers from the registry.
+func (l *LexerRegistry) unregister(lexers ...*Lexer) {
+	for _, lexer := range lexers {
+		for i, lx := range l.Lexers {
+			if lx == lexer {
+				l.Lexers = append(l.Lexers[:i], l.Lexers[i+1:]...)
+				break
+			}
+		}
+
+		for _, m := range []map[string]*Lexer{l.byName, l.byAlias} {
+			for k, lx := range m {
+				if lx == lexer {
+					delete(m, k)
+				}
+			}
+		}
+	}
+}
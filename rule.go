@@ -3,6 +3,7 @@ package syn
 import (
 	"bytes"
 	"fmt"
+	"reflect"
 
 	"github.com/dlclark/regexp2"
 )
@@ -13,16 +14,41 @@ import (
 type state struct {
 	name  string
 	rules []rule
+	// vars holds the values of the variables captured by the rule that pushed the state. It is only set on
+	// the copy of the state on the stack.
+	vars map[string]string
+	// combined holds, at the index of the first rule of each run of rules whose patterns are matched
+	// together, the combined pattern of the run. It is nil at the other indexes, or if no patterns were combined.
+	combined []*combinedRules
 }
 
-func (r state) match(text []rune) (*regexp2.Match, *rule) {
-	for i, rule := range r.rules {
+// match returns the first rule of the state that matches at index pos of text, and its match. The values of
+// captured variables are looked up in vars.
+func (r state) match(text []rune, pos int, vars *stack) (*match, *rule) {
+	for i := 0; i < len(r.rules); {
+		if i < len(r.combined) && r.combined[i] != nil {
+			c := r.combined[i]
+			debugf("State.match: for state %s trying rules %d to %d combined\n", r.name, i, i+c.len()-1)
+			res, j, err := c.match(text, pos)
+			if err == nil {
+				if res != nil {
+					debugf("State.match: rule %d matched\n", i+j)
+					return res, &r.rules[i+j]
+				}
+				i += c.len()
+				continue
+			}
+			// The combined pattern timed out. The rules are tried one by one instead.
+		}
+
+		rule := r.rules[i]
 		debugf("State.match: for state %s trying rule %d /%s/\n", r.name, i, rule.pattern)
-		res, err := rule.match(text)
+		res, err := rule.match(text, pos, vars)
 		if res != nil && err == nil {
 			debugf("State.match: rule %d matched\n", i)
 			return res, &r.rules[i]
 		}
+		i++
 	}
 	return nil, nil
 }
@@ -64,6 +90,11 @@ func (r *rules) Contains(stateName string) (ok bool) {
 	return
 }
 
+// same returns true if r and o are the rules of the same lexer.
+func (r rules) same(o rules) bool {
+	return reflect.ValueOf(r.rules).Pointer() == reflect.ValueOf(o.rules).Pointer()
+}
+
 func (r rules) String() string {
 	var buf bytes.Buffer
 	for _, v := range r.rules {
@@ -75,18 +106,42 @@ func (r rules) String() string {
 // A Rule specifies a regexp to match when lexing at the current position in the text, and an action
 // to take if the regexp matches.
 type rule struct {
-	pattern      *regexp2.Regexp
+	pattern *regexp2.Regexp
+	// expr and opts are the pattern, with the variables expanded, and the options that pattern was compiled
+	// from. They are used to combine the pattern with the patterns of the rules around it.
+	expr string
+	opts regexp2.RegexOptions
+	// captured, when not nil, is the pattern with references to captured variables. It is matched instead of
+	// pattern, which has the references removed.
+	captured *capturedPattern
+	// words, when not nil, is matched instead of pattern.
+	words *words
+	// delimited, when not nil, is matched instead of pattern. The iterator then scans the rest of the region.
+	delimited *delimited
+	// call, when not nil, is called instead of matching pattern.
+	call         *call
 	tok          TokenType
 	pushState    string
 	popDepth     int
 	byGroups     []byGroupElement
 	include      string
 	useSelfState string
+	usingLexer   string
+	// mutators, when not empty, are applied to the state stack in order instead of pushState and popDepth.
+	mutators []mutator
 }
 
 func (r rule) String() string {
 	var buf bytes.Buffer
-	fmt.Fprintf(&buf, "(rule /%s/ tok: %s", r.pattern, r.tok)
+	if r.words != nil {
+		fmt.Fprintf(&buf, "(rule %s tok: %s", r.words, r.tok)
+	} else if r.delimited != nil {
+		fmt.Fprintf(&buf, "(rule %s tok: %s", r.delimited, r.delimited.tok)
+	} else if r.call != nil {
+		fmt.Fprintf(&buf, "(rule %s", r.call)
+	} else {
+		fmt.Fprintf(&buf, "(rule /%s/ tok: %s", r.pattern, r.tok)
+	}
 	if r.pushState != "" {
 		fmt.Fprintf(&buf, "  push: %s", r.pushState)
 	}
@@ -100,6 +155,12 @@ func (r rule) String() string {
 	if r.useSelfState != "" {
 		fmt.Fprintf(&buf, "  usingself: %s", r.useSelfState)
 	}
+	if r.usingLexer != "" {
+		fmt.Fprintf(&buf, "  using: %s", r.usingLexer)
+	}
+	if r.mutators != nil {
+		fmt.Fprintf(&buf, "  mutators: %v", r.mutators)
+	}
 	fmt.Fprintf(&buf, ")")
 	return buf.String()
 }
@@ -110,22 +171,85 @@ func (r rule) IsUseSelf() bool {
 	return r.useSelfState != ""
 }
 
-// Match attempts to match the rule. If it succeeds it returns a slice
-// holding the index pairs identifying the
-// leftmost match of the regular expression in b and the matches, if any, of
-// its subexpressions like regexp.FindSubmatchIndex.
+// IsUsing returns true if the Rule specifies that the matched text should be handled by lexing
+// it with a different lexer.
+func (r rule) IsUsing() bool {
+	return r.usingLexer != ""
+}
+
+// Match attempts to match the rule at index pos of text. If it succeeds it returns the
+// positions of the match and of the groups in the rule's pattern, if any, relative to pos. The text
+// before pos is seen by anchors like ^ and \b and by lookbehinds in the pattern. The values of the captured
+// variables the pattern refers to are looked up in vars, which is the state stack.
 // Returns nil if there is no match.
-func (r rule) match(text []rune) (*regexp2.Match, error) {
-	m, err := r.pattern.FindRunesMatch(text)
-	if m != nil && m.Index != 0 {
-		return nil, nil
+func (r rule) match(text []rune, pos int, vars *stack) (*match, error) {
+	if r.words != nil {
+		return r.words.match(text, pos)
+	}
+	if r.delimited != nil {
+		return r.delimited.match(text[pos:])
+	}
+	if r.call != nil {
+		return r.call.match(text[pos:], vars)
+	}
+
+	re := r.pattern
+	if r.captured != nil {
+		var err error
+		re, err = r.captured.regexp(vars)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	m, err := re.FindRunesMatchStartingAt(text, pos)
+	if err != nil || m == nil || m.Index != pos {
+		return nil, err
+	}
+
+	groups := m.Groups()
+	res := &match{groups: make([]capture, len(groups))}
+	for i, g := range groups {
+		if len(g.Captures) == 0 {
+			// The group didn't take part in the match.
+			continue
+		}
+		res.groups[i] = capture{start: g.Index - pos, length: g.Length}
 	}
-	return m, err
+	return res, nil
+}
+
+// groupCount returns the number of groups in the matches of the rule, including group 0, which is the entire match.
+func (r rule) groupCount() int {
+	switch {
+	case r.words != nil:
+		return 2
+	case r.delimited != nil, r.call != nil:
+		return 1
+	}
+	return len(r.pattern.GetGroupNumbers())
+}
+
+// match is the text matched by a rule. groups holds the position, relative to where the rule was matched, and
+// the length of the entire match, as group 0, followed by the groups of the rule's pattern.
+type match struct {
+	groups []capture
+	// call is the rest of the result of the function of a call rule, or nil for other rules.
+	call *callResult
+}
+
+// length returns the length of the entire match.
+func (m *match) length() int {
+	return m.groups[0].length
 }
 
 type byGroupElement struct {
 	tok          TokenType
 	useSelfState string
+	usingLexer   string
+	// sublexerNameGroup is the number of the group whose text names the lexer for this group. When
+	// no such lexer exists, tok is used instead.
+	sublexerNameGroup int
 }
 
 // IsUseSelf returns true if the Rule specifies that the group should be handled by lexing
@@ -133,3 +257,43 @@ type byGroupElement struct {
 func (b byGroupElement) IsUseSelf() bool {
 	return b.useSelfState != ""
 }
+
+// IsUsing returns true if the group should be handled by lexing the group text with a different lexer.
+func (b byGroupElement) IsUsing() bool {
+	return b.usingLexer != ""
+}
+
+// mutator is a single operation on the state stack: either a pop of popDepth states, or a push.
+type mutator struct {
+	popDepth  int
+	pushState string
+	// pushCurrent is true when the state that was on top of the stack when the rule matched
+	// is to be pushed again.
+	pushCurrent bool
+	// capture, when not empty, is the name of the variable of the pushed state that is set to the text
+	// of the group numbered group of the match.
+	capture string
+	group   int
+}
+
+func (m mutator) String() string {
+	var s string
+	switch {
+	case m.pushCurrent:
+		s = "push current"
+	case m.pushState != "":
+		s = fmt.Sprintf("push %s", m.pushState)
+	default:
+		return fmt.Sprintf("pop %d", m.popDepth)
+	}
+	if m.capture != "" {
+		s += fmt.Sprintf(" capturing group %d as %s", m.group, m.capture)
+	}
+	return s
+}
+
+// IsUsingByGroup returns true if the group should be handled by lexing the group text with the lexer
+// named by another group in the match.
+func (b byGroupElement) IsUsingByGroup() bool {
+	return b.sublexerNameGroup > 0
+}
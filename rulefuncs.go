@@ -0,0 +1,81 @@
+package syn
+
+import "strings"
+
+// The functions registered here are called by the lexers in lexers/embedded.
+func init() {
+	RegisterRuleFunc("rust-raw-string", rustRawString)
+	RegisterRuleFunc("lua-long-string", luaLongBracket("[", LiteralString))
+	RegisterRuleFunc("lua-long-comment", luaLongBracket("--[", CommentMultiline))
+}
+
+// rustRawString matches a Rust raw string like r#"..."#, or a raw byte string like br#"..."#. The string ends
+// at the first quote that is followed by as many #s as there are after the r.
+func rustRawString(text []rune, st *CallbackState) (int, []Token, CallbackAction) {
+	i := 0
+	if i < len(text) && text[i] == 'b' {
+		i++
+	}
+	if i >= len(text) || text[i] != 'r' {
+		return 0, nil, CallbackAction{}
+	}
+	i++
+
+	hashes := countRunes(text[i:], '#')
+	i += hashes
+	if i >= len(text) || text[i] != '"' {
+		return 0, nil, CallbackAction{}
+	}
+	i++
+
+	n := endOfClose(text, i, []rune(`"`+strings.Repeat("#", hashes)))
+	if n < 0 {
+		return 0, nil, CallbackAction{}
+	}
+	return n, []Token{{Type: LiteralString, Start: 0, End: n}}, CallbackAction{}
+}
+
+// luaLongBracket returns a RuleFunc that matches a Lua long bracket like [==[...]==] after the text prefix,
+// which ends with the first [. The bracket ends at the first ] that is followed by as many =s as there are
+// in the open bracket and another ]. The text matched is a token of type typ.
+func luaLongBracket(prefix string, typ TokenType) RuleFunc {
+	open := []rune(prefix)
+	return func(text []rune, st *CallbackState) (int, []Token, CallbackAction) {
+		if !hasRunePrefix(text, open) {
+			return 0, nil, CallbackAction{}
+		}
+		i := len(open)
+
+		level := countRunes(text[i:], '=')
+		i += level
+		if i >= len(text) || text[i] != '[' {
+			return 0, nil, CallbackAction{}
+		}
+		i++
+
+		n := endOfClose(text, i, []rune("]"+strings.Repeat("=", level)+"]"))
+		if n < 0 {
+			return 0, nil, CallbackAction{}
+		}
+		return n, []Token{{Type: typ, Start: 0, End: n}}, CallbackAction{}
+	}
+}
+
+// countRunes returns the number of times r is repeated at the start of text.
+func countRunes(text []rune, r rune) int {
+	n := 0
+	for n < len(text) && text[n] == r {
+		n++
+	}
+	return n
+}
+
+// endOfClose returns the index just after the first close in text at or after index i, or -1 if there is none.
+func endOfClose(text []rune, i int, close []rune) int {
+	for ; i+len(close) <= len(text); i++ {
+		if hasRunePrefix(text[i:], close) {
+			return i + len(close)
+		}
+	}
+	return -1
+}
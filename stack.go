@@ -15,10 +15,10 @@ func (s *stack) Push(list state) {
 }
 
 func (s *stack) Pop(count int) {
-	if len(s.data) > 0 {
-		s.data = s.data[:len(s.data)-count]
+	if count > len(s.data) {
+		count = len(s.data)
 	}
-	return
+	s.data = s.data[:len(s.data)-count]
 }
 
 func (s stack) Top() (list state) {
@@ -43,3 +43,17 @@ func (s stack) Clone() *stack {
 func (s *stack) Clear() {
 	s.data = s.data[:0]
 }
+
+// variable returns the value of the captured variable called name. It is looked up in the states from the
+// top of the stack down, so a state sees the variables of the states below it unless it sets them itself.
+func (s *stack) variable(name string) (value string, ok bool) {
+	if s == nil {
+		return
+	}
+	for i := len(s.data) - 1; i >= 0; i-- {
+		if value, ok = s.data[i].vars[name]; ok {
+			return
+		}
+	}
+	return
+}
@@ -32,3 +32,13 @@ func TestStack(t *testing.T) {
 	assert.Equal(0, s.Len())
 	assert.Equal(empty, s.Top())
 }
+
+func TestStackPopPastBottom(t *testing.T) {
+	assert := assert.New(t)
+
+	s := newStack()
+	s.Push(state{name: "a"})
+	s.Push(state{name: "b"})
+	s.Pop(5)
+	assert.Equal(0, s.Len())
+}
@@ -0,0 +1,368 @@
+package sublime
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/jeffwilliams/syn"
+	"github.com/jeffwilliams/syn/internal/grammar"
+	"github.com/jeffwilliams/syn/textmate"
+)
+
+// Convert reads a Sublime Text syntax definition from rdr and converts it to a Lexer. See ConvertSyntax.
+func Convert(rdr io.Reader, scopes textmate.ScopeMap) (*syn.Lexer, []textmate.Warning, error) {
+	s, err := DecodeSyntax(rdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ConvertSyntax(s, scopes)
+}
+
+// ConvertFile reads a Sublime Text syntax definition from a .sublime-syntax file and converts it to a Lexer.
+// See ConvertSyntax.
+func ConvertFile(path string, scopes textmate.ScopeMap) (*syn.Lexer, []textmate.Warning, error) {
+	s, err := DecodeSyntaxFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ConvertSyntax(s, scopes)
+}
+
+// ConvertSyntax converts a Sublime Text syntax definition to a Lexer. Scope names are mapped onto token types
+// using scopes, or textmate.DefaultScopes if scopes is nil. Text with a scope that has no mapping is given the
+// token type of the meta_content_scope or meta_scope of the context, or Text if neither is mapped.
+//
+// Each context becomes two states. The state named after the context holds its patterns, and is the state
+// that includes refer to. The state that is pushed for the context has the same name followed by .push, and
+// includes the prototype context if that applies, then the context itself, and then a rule that gives any other
+// character the token type of the context. The exception is the main context, whose pushed state is the root state;
+// so a context named root, if there is one, has its state renamed root.context. Anonymous contexts become states
+// named after the enclosing state followed by a number.
+//
+// A set is converted to a pop followed by a push, and variables are substituted into the patterns.
+//
+// Parts of the definition that can't be converted are skipped, and parts that are converted only approximately
+// are kept; both are described in the returned warnings. An error is returned only if the definition can't be read
+// or the resulting lexer definition is invalid.
+func ConvertSyntax(s *Syntax, scopes textmate.ScopeMap) (*syn.Lexer, []textmate.Warning, error) {
+	if scopes == nil {
+		scopes = textmate.DefaultScopes
+	}
+
+	c := &converter{
+		syntax: s,
+		scopes: scopes,
+	}
+	c.lexer = grammar.NewLexer(func(path, message string) {
+		c.warnings = append(c.warnings, textmate.Warning{Path: path, Message: message})
+	})
+
+	if s.Extends != nil {
+		c.lexer.Warn("extends", "extending other syntax definitions is not supported")
+	}
+	if _, ok := s.Contexts["main"]; !ok {
+		return nil, c.warnings, fmt.Errorf("The syntax definition has no main context")
+	}
+
+	c.findContextsWithoutPrototype()
+
+	for _, name := range c.contextNames() {
+		c.convertNamedContext(name)
+	}
+
+	c.lexer.BreakIncludeCycles()
+
+	lex, err := c.lexer.Build(newLexerDef(s))
+	return lex, c.warnings, err
+}
+
+type converter struct {
+	syntax *Syntax
+	scopes textmate.ScopeMap
+	// withoutPrototype contains the contexts that don't include the prototype: the prototype itself and
+	// the contexts it includes.
+	withoutPrototype map[string]bool
+	lexer            *grammar.Lexer
+	warnings         []textmate.Warning
+}
+
+// contextNames returns the names of the contexts with main first.
+func (c *converter) contextNames() []string {
+	names := []string{"main"}
+	for name := range c.syntax.Contexts {
+		if name != "main" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// stateName returns the name of the state that holds the patterns of the named context.
+func stateName(context string) string {
+	if context == "root" {
+		// root is the name of the state pushed for main
+		return "root.context"
+	}
+	return context
+}
+
+// pushedStateName returns the name of the state that is pushed for the named context.
+func pushedStateName(context string) string {
+	if context == "main" {
+		return "root"
+	}
+	return stateName(context) + ".push"
+}
+
+func (c *converter) findContextsWithoutPrototype() {
+	c.withoutPrototype = map[string]bool{}
+
+	var visit func(name string)
+	visit = func(name string) {
+		if c.withoutPrototype[name] {
+			return
+		}
+		c.withoutPrototype[name] = true
+		for _, p := range c.syntax.Contexts[name] {
+			if _, ok := c.syntax.Contexts[p.Include]; ok {
+				visit(p.Include)
+			}
+		}
+	}
+
+	if _, ok := c.syntax.Contexts["prototype"]; ok {
+		visit("prototype")
+	}
+}
+
+// contextMeta holds the properties of a context that are set by its meta patterns.
+type contextMeta struct {
+	// typ is the token type for the meta_scope, which covers the text that pushes and pops the context.
+	typ syn.TokenType
+	// contentTyp is the token type for the meta_content_scope, which covers the rest of the text in the context.
+	contentTyp       syn.TokenType
+	includePrototype bool
+}
+
+func (c *converter) meta(ctx Context) contextMeta {
+	m := contextMeta{typ: syn.Text, includePrototype: true}
+	var contentScope string
+	for _, p := range ctx {
+		if !p.isMeta() {
+			break
+		}
+		if p.MetaScope != "" {
+			m.typ = c.tokenType(p.MetaScope, syn.Text)
+		}
+		if p.MetaContentScope != "" {
+			contentScope = p.MetaContentScope
+		}
+		if p.MetaIncludePrototype != nil {
+			m.includePrototype = *p.MetaIncludePrototype
+		}
+	}
+	m.contentTyp = c.tokenType(contentScope, m.typ)
+	return m
+}
+
+func (c *converter) convertNamedContext(name string) {
+	ctx := c.syntax.Contexts[name]
+	path := fmt.Sprintf("contexts.%s", name)
+	m := c.meta(ctx)
+
+	pushed := c.lexer.AddState(pushedStateName(name))
+	if m.includePrototype && !c.withoutPrototype[name] && c.hasPrototype() {
+		pushed.Rules = append(pushed.Rules, grammar.Rule{Path: path, Include: stateName("prototype")})
+	}
+	pushed.Rules = append(pushed.Rules, grammar.Rule{Path: path, Include: stateName(name)}, grammar.FallbackRule(m.contentTyp))
+
+	st := c.lexer.AddState(stateName(name))
+	c.convertPatterns(st, ctx, m, path)
+}
+
+// convertAnonymousContext adds a state for an anonymous context within the state named parent, and returns its name.
+func (c *converter) convertAnonymousContext(parent string, ctx Context, path string) string {
+	m := c.meta(ctx)
+
+	st := c.lexer.AddState(c.lexer.NewChildStateName(parent))
+	if m.includePrototype && c.hasPrototype() {
+		st.Rules = append(st.Rules, grammar.Rule{Path: path, Include: stateName("prototype")})
+	}
+	c.convertPatterns(st, ctx, m, path)
+	st.Rules = append(st.Rules, grammar.FallbackRule(m.contentTyp))
+	return st.Name
+}
+
+func (c *converter) hasPrototype() bool {
+	_, ok := c.syntax.Contexts["prototype"]
+	return ok
+}
+
+func (c *converter) convertPatterns(st *grammar.State, ctx Context, m contextMeta, path string) {
+	for i := range ctx {
+		p := &ctx[i]
+		ppath := fmt.Sprintf("%s[%d]", path, i)
+
+		switch {
+		case p.isMeta():
+			continue
+		case p.Include != "":
+			c.convertInclude(st, p.Include, ppath)
+		case p.Match != "":
+			c.convertMatch(st, p, m, ppath)
+		default:
+			c.lexer.Warn(ppath, "the pattern has no match or include")
+		}
+	}
+}
+
+func (c *converter) convertInclude(st *grammar.State, name, path string) {
+	if _, ok := c.syntax.Contexts[name]; ok {
+		st.Rules = append(st.Rules, grammar.Rule{Path: path, Include: stateName(name)})
+		return
+	}
+
+	if strings.HasPrefix(name, "scope:") || strings.HasPrefix(name, "Packages/") {
+		c.lexer.Warn(path, "the include refers to the syntax %s; including other syntaxes is not supported", name)
+		return
+	}
+	c.lexer.Warn(path, "the include refers to the context %s, which doesn't exist", name)
+}
+
+func (c *converter) convertMatch(st *grammar.State, p *Pattern, m contextMeta, path string) {
+	switch {
+	case p.Embed != "":
+		c.lexer.Warn(path, "embed is not supported")
+		return
+	case p.Branch != nil || p.Fail != "":
+		c.lexer.Warn(path, "branching is not supported")
+		return
+	}
+	if len(p.WithPrototype) > 0 {
+		c.lexer.Warn(path, "with_prototype is not supported and is ignored")
+	}
+
+	pops := int(p.Pop)
+	targets := p.Push
+	if len(p.Set) > 0 {
+		pops++
+		targets = p.Set
+	}
+
+	// Unless the match has a scope, its text has the meta_scope of the context it pushes, or of the context
+	// it pops, or else the meta_content_scope of the current context.
+	typ := m.contentTyp
+	switch {
+	case len(targets) > 0:
+		last := targets[len(targets)-1]
+		ctx := last.Anonymous
+		if last.Name != "" {
+			ctx = c.syntax.Contexts[last.Name]
+		}
+		typ = c.meta(ctx).typ
+	case pops > 0:
+		typ = m.typ
+	}
+	typ = c.tokenType(p.Scope, typ)
+
+	var pushes []string
+	for i, t := range targets {
+		if t.Name == "" {
+			pushes = append(pushes, c.convertAnonymousContext(st.Name, t.Anonymous, fmt.Sprintf("%s.push[%d]", path, i)))
+			continue
+		}
+		if _, ok := c.syntax.Contexts[t.Name]; !ok {
+			c.lexer.Warn(path, "the pattern pushes the context %s, which doesn't exist", t.Name)
+			return
+		}
+		pushes = append(pushes, pushedStateName(t.Name))
+	}
+
+	types := map[int]syn.TokenType{}
+	for n, scope := range p.Captures {
+		if n == 0 {
+			continue
+		}
+		types[n] = c.tokenType(scope, typ)
+	}
+	if scope, ok := p.Captures[0]; ok {
+		typ = c.tokenType(scope, typ)
+	}
+
+	r, ok := c.lexer.MatchRule(path, c.expandVariables(p.Match, path), types, typ)
+	if !ok {
+		return
+	}
+
+	if pops > 0 {
+		r.Actions = append(r.Actions, syn.Pop(pops))
+	}
+	if len(pushes) > 0 {
+		r.Actions = append(r.Actions, syn.Push(pushes...))
+	}
+	st.Rules = append(st.Rules, r)
+}
+
+var variableRegexp = regexp.MustCompile(`\{\{(\w+)\}\}`)
+
+// expandVariables substitutes the values of the variables referenced in the pattern. Variables may refer to
+// other variables.
+func (c *converter) expandVariables(pattern, path string) string {
+	return c.expand(pattern, path, map[string]bool{})
+}
+
+func (c *converter) expand(pattern, path string, expanding map[string]bool) string {
+	return variableRegexp.ReplaceAllStringFunc(pattern, func(ref string) string {
+		name := ref[2 : len(ref)-2]
+		value, ok := c.syntax.Variables[name]
+		if !ok {
+			c.lexer.Warn(path, "the variable %s is not defined", name)
+			// Escaped, so that the pattern still matches the reference literally rather than syn treating it
+			// as a reference to one of its own variables.
+			return regexp.QuoteMeta(ref)
+		}
+		if expanding[name] {
+			c.lexer.Warn(path, "the variable %s refers to itself", name)
+			return ""
+		}
+
+		expanding[name] = true
+		value = c.expand(value, path, expanding)
+		delete(expanding, name)
+		return value
+	})
+}
+
+// tokenType returns the token type for the scope name, or def if the name is empty or has no mapping.
+func (c *converter) tokenType(scopeName string, def syn.TokenType) syn.TokenType {
+	if scopeName == "" {
+		return def
+	}
+
+	typ, ok := c.scopes.TokenType(scopeName)
+	if !ok {
+		return def
+	}
+	return typ
+}
+
+// newLexerDef returns a LexerDef with the configuration of the lexer for the syntax definition.
+func newLexerDef(s *Syntax) *syn.LexerDef {
+	name := s.Name
+	if name == "" {
+		name = s.Scope
+	}
+	def := syn.NewLexerDef(name)
+
+	if i := strings.LastIndexByte(s.Scope, '.'); i >= 0 {
+		def.Alias(strings.ToLower(s.Scope[i+1:]))
+	}
+	for _, ext := range append(s.FileExtensions, s.HiddenFileExtensions...) {
+		def.Filename("*." + strings.TrimPrefix(ext, "."))
+	}
+	return def
+}
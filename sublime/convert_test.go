@@ -0,0 +1,174 @@
+package sublime
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jeffwilliams/syn"
+	"github.com/jeffwilliams/syn/textmate"
+	"github.com/stretchr/testify/assert"
+)
+
+const toySyntax = `%YAML 1.2
+---
+name: Toy
+file_extensions: [toy]
+scope: source.toy
+variables:
+  ident: '[A-Za-z_]{{identchar}}*'
+  identchar: '[A-Za-z_0-9]'
+contexts:
+  prototype:
+    - include: comments
+  comments:
+    - match: '#.*$'
+      scope: comment.line.toy
+  main:
+    - match: '\b(if|else)\b'
+      scope: keyword.control.toy
+    - match: '\bfunc\b'
+      scope: storage.type.function.toy
+      push: function-name
+    - match: '"'
+      scope: punctuation.definition.string.begin.toy
+      push: string
+    - match: '\['
+      push:
+        - meta_scope: meta.brackets.toy
+        - match: '\]'
+          pop: true
+        - match: '\d+'
+          scope: constant.numeric.toy
+    - match: '<<'
+      embed: scope:source.other
+      escape: '>>'
+    - include: scope:source.other
+    - include: missing
+  function-name:
+    - match: '{{ident}}'
+      scope: entity.name.function.toy
+      set: params
+  params:
+    - match: '\('
+      scope: punctuation.section.parens.begin.toy
+    - match: '\)'
+      scope: punctuation.section.parens.end.toy
+      pop: 1
+    - match: '({{ident}})(\s*)(=)'
+      captures:
+        1: variable.parameter.toy
+        3: keyword.operator.assignment.toy
+    - match: '{{ident}}'
+      scope: variable.parameter.toy
+  string:
+    - meta_scope: string.quoted.double.toy
+    - meta_include_prototype: false
+    - match: '\\.'
+      scope: constant.character.escape.toy
+    - match: '"'
+      scope: punctuation.definition.string.end.toy
+      pop: true
+`
+
+func TestConvert(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, warnings, err := Convert(strings.NewReader(toySyntax), nil)
+	if err != nil {
+		t.Fatalf("Converting returned error: %v\n", err)
+	}
+
+	for _, w := range warnings {
+		t.Logf("warning: %s", w)
+	}
+
+	expectedWarnings := []textmate.Warning{
+		{Path: "contexts.main[4]", Message: "embed is not supported"},
+		{Path: "contexts.main[5]", Message: "the include refers to the syntax scope:source.other; including other syntaxes is not supported"},
+		{Path: "contexts.main[6]", Message: "the include refers to the context missing, which doesn't exist"},
+	}
+	assert.Equal(expectedWarnings, warnings)
+
+	input := []rune("func f(a, b=1) # c\nif \"x#\\n\" [1]")
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+
+	for _, tok := range tokens {
+		t.Logf("%s", tok)
+	}
+
+	expected := []syn.Token{
+		{Type: syn.KeywordType, Value: []rune("func"), Start: 0, End: 4},
+		{Type: syn.Text, Value: []rune(" "), Start: 4, End: 5},
+		{Type: syn.NameFunction, Value: []rune("f"), Start: 5, End: 6},
+		{Type: syn.Punctuation, Value: []rune("("), Start: 6, End: 7},
+		{Type: syn.NameVariable, Value: []rune("a"), Start: 7, End: 8},
+		{Type: syn.Text, Value: []rune(", "), Start: 8, End: 10},
+		{Type: syn.NameVariable, Value: []rune("b"), Start: 10, End: 11},
+		{Type: syn.Text, Value: []rune(""), Start: 11, End: 11},
+		{Type: syn.Operator, Value: []rune("="), Start: 11, End: 12},
+		{Type: syn.Text, Value: []rune("1"), Start: 12, End: 13},
+		{Type: syn.Punctuation, Value: []rune(")"), Start: 13, End: 14},
+		{Type: syn.Text, Value: []rune(" "), Start: 14, End: 15},
+		{Type: syn.CommentSingle, Value: []rune("# c"), Start: 15, End: 18},
+		{Type: syn.Text, Value: []rune("\n"), Start: 18, End: 19},
+		{Type: syn.Keyword, Value: []rune("if"), Start: 19, End: 21},
+		{Type: syn.Text, Value: []rune(" "), Start: 21, End: 22},
+		{Type: syn.LiteralString, Value: []rune(`"`), Start: 22, End: 23},
+		{Type: syn.LiteralStringDouble, Value: []rune("x#"), Start: 23, End: 25},
+		{Type: syn.LiteralStringEscape, Value: []rune(`\n`), Start: 25, End: 27},
+		{Type: syn.LiteralString, Value: []rune(`"`), Start: 27, End: 28},
+		{Type: syn.Text, Value: []rune(" ["), Start: 28, End: 30},
+		{Type: syn.LiteralNumber, Value: []rune("1"), Start: 30, End: 31},
+		{Type: syn.Text, Value: []rune("]"), Start: 31, End: 32},
+	}
+
+	assert.Equal(expected, tokens)
+}
+
+func TestConvertVariables(t *testing.T) {
+	assert := assert.New(t)
+
+	inp := `
+name: Vars
+scope: source.vars
+variables:
+  a: 'x{{b}}'
+  b: 'y{{a}}'
+contexts:
+  main:
+    - match: '{{a}}'
+      scope: keyword
+    - match: '{{undefined}}'
+      scope: keyword
+`
+
+	_, warnings, err := Convert(strings.NewReader(inp), nil)
+	if err != nil {
+		t.Fatalf("Converting returned error: %v\n", err)
+	}
+
+	expectedWarnings := []textmate.Warning{
+		{Path: "contexts.main[0]", Message: "the variable a refers to itself"},
+		{Path: "contexts.main[1]", Message: "the variable undefined is not defined"},
+	}
+	assert.Equal(expectedWarnings, warnings)
+}
+
+func TestConvertWithoutMain(t *testing.T) {
+	_, _, err := Convert(strings.NewReader("name: X\ncontexts:\n  other: []\n"), nil)
+	assert.NotNil(t, err)
+}
+
+func tokenize(it syn.Iterator) (tokens []syn.Token, err error) {
+	for {
+		var tok syn.Token
+		tok, err = it.Next()
+		if err != nil || tok.Type == syn.EOFType {
+			return
+		}
+		tokens = append(tokens, tok)
+	}
+}
@@ -0,0 +1,157 @@
+// Package sublime converts Sublime Text syntax definitions into syn Lexers.
+package sublime
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Syntax is a Sublime Text syntax definition, as found in .sublime-syntax files.
+type Syntax struct {
+	Name                 string             `yaml:"name"`
+	FileExtensions       []string           `yaml:"file_extensions"`
+	HiddenFileExtensions []string           `yaml:"hidden_file_extensions"`
+	Scope                string             `yaml:"scope"`
+	Extends              interface{}        `yaml:"extends"`
+	Variables            map[string]string  `yaml:"variables"`
+	Contexts             map[string]Context `yaml:"contexts"`
+}
+
+// Context is a list of patterns. A context may start with meta patterns, which set the
+// meta_scope, meta_content_scope and meta_include_prototype of the context.
+type Context []Pattern
+
+// Pattern is an element of a context.
+type Pattern struct {
+	Match    string         `yaml:"match"`
+	Scope    string         `yaml:"scope"`
+	Captures map[int]string `yaml:"captures"`
+	Push     Targets        `yaml:"push"`
+	Set      Targets        `yaml:"set"`
+	Pop      PopCount       `yaml:"pop"`
+
+	Embed         string      `yaml:"embed"`
+	Branch        interface{} `yaml:"branch"`
+	Fail          string      `yaml:"fail"`
+	WithPrototype Context     `yaml:"with_prototype"`
+
+	Include string `yaml:"include"`
+
+	MetaScope            string `yaml:"meta_scope"`
+	MetaContentScope     string `yaml:"meta_content_scope"`
+	MetaIncludePrototype *bool  `yaml:"meta_include_prototype"`
+	// ClearScopes only affects the scopes of nested text, which don't exist for syn tokens, so it is ignored.
+	ClearScopes interface{} `yaml:"clear_scopes"`
+}
+
+// isMeta returns true if the pattern only sets properties of the context.
+func (p *Pattern) isMeta() bool {
+	return p.Match == "" && p.Include == "" &&
+		(p.MetaScope != "" || p.MetaContentScope != "" || p.MetaIncludePrototype != nil || p.ClearScopes != nil)
+}
+
+// Target is a context that a pattern pushes or sets. It is either the name of a context or an anonymous context.
+type Target struct {
+	Name      string
+	Anonymous Context
+}
+
+// Targets is the list of contexts that a pattern pushes or sets, in the order they are pushed.
+type Targets []Target
+
+func (t *Targets) UnmarshalYAML(n *yaml.Node) error {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		*t = Targets{{Name: n.Value}}
+		return nil
+	case yaml.SequenceNode:
+		if len(n.Content) > 0 && n.Content[0].Kind == yaml.MappingNode {
+			// A single anonymous context
+			var c Context
+			err := n.Decode(&c)
+			if err != nil {
+				return err
+			}
+			*t = Targets{{Anonymous: c}}
+			return nil
+		}
+
+		for _, item := range n.Content {
+			switch item.Kind {
+			case yaml.ScalarNode:
+				*t = append(*t, Target{Name: item.Value})
+			case yaml.SequenceNode:
+				var c Context
+				err := item.Decode(&c)
+				if err != nil {
+					return err
+				}
+				*t = append(*t, Target{Anonymous: c})
+			default:
+				return fmt.Errorf("line %d: a context must be a name or a list of patterns", item.Line)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("line %d: a context must be a name or a list of patterns", n.Line)
+	}
+}
+
+// PopCount is the number of contexts that a pattern pops. Syntax definitions write it either as
+// true, which pops one context, or as a number.
+type PopCount int
+
+func (p *PopCount) UnmarshalYAML(n *yaml.Node) error {
+	var b bool
+	if n.Decode(&b) == nil {
+		*p = 0
+		if b {
+			*p = 1
+		}
+		return nil
+	}
+
+	var i int
+	err := n.Decode(&i)
+	if err != nil {
+		return fmt.Errorf("line %d: pop must be a boolean or a number", n.Line)
+	}
+	*p = PopCount(i)
+	return nil
+}
+
+// DecodeSyntax reads a Sublime Text syntax definition.
+func DecodeSyntax(rdr io.Reader) (*Syntax, error) {
+	data, err := io.ReadAll(rdr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Syntax definitions start with a %YAML 1.2 directive, but the YAML decoder only accepts version 1.1.
+	// The parts of YAML that syntax definitions use are the same in both.
+	data = yamlDirectiveRegexp.ReplaceAll(data, nil)
+
+	var s Syntax
+	err = yaml.Unmarshal(data, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+var yamlDirectiveRegexp = regexp.MustCompile(`^\s*%YAML[^\n]*\n`)
+
+// DecodeSyntaxFile reads a Sublime Text syntax definition from a .sublime-syntax file.
+func DecodeSyntaxFile(path string) (*Syntax, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return DecodeSyntax(f)
+}
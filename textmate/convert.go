@@ -0,0 +1,323 @@
+package textmate
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jeffwilliams/syn"
+	"github.com/jeffwilliams/syn/internal/grammar"
+)
+
+// Warning describes a part of a grammar that could not be converted, or was converted only approximately.
+type Warning struct {
+	// Path locates the part of the grammar, like repository.string.patterns[2].end
+	Path    string
+	Message string
+}
+
+func (w Warning) String() string {
+	return fmt.Sprintf("%s: %s", w.Path, w.Message)
+}
+
+// Convert reads a TextMate grammar in JSON format from rdr and converts it to a Lexer. See ConvertGrammar.
+func Convert(rdr io.Reader, scopes ScopeMap) (*syn.Lexer, []Warning, error) {
+	g, err := DecodeGrammar(rdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ConvertGrammar(g, scopes)
+}
+
+// ConvertFile reads a TextMate grammar from a .tmLanguage.json file and converts it to a Lexer. See ConvertGrammar.
+func ConvertFile(path string, scopes ScopeMap) (*syn.Lexer, []Warning, error) {
+	g, err := DecodeGrammarFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ConvertGrammar(g, scopes)
+}
+
+// ConvertGrammar converts a TextMate grammar to a Lexer. Scope names are mapped onto token types using scopes,
+// or DefaultScopes if scopes is nil. Text with a scope that has no mapping is given the token type of the
+// enclosing begin/end pattern, or Text at the top level.
+//
+// The top-level patterns of the grammar become the $self state, which the root state includes followed by
+// a rule that emits any other character as Text. Each repository entry becomes a state
+// named by the entry's key prefixed with #. A match pattern becomes a rule, and a begin/end pattern becomes a
+// rule that pushes a new state containing the end pattern, which pops the state, followed by the nested patterns.
+// Includes of $self, $base and repository entries become include rules.
+//
+// Parts of the grammar that can't be converted are skipped, and parts that are converted only approximately
+// are kept; both are described in the returned warnings. An error is returned only if the grammar can't be read
+// or the resulting lexer definition is invalid.
+func ConvertGrammar(g *Grammar, scopes ScopeMap) (*syn.Lexer, []Warning, error) {
+	if scopes == nil {
+		scopes = DefaultScopes
+	}
+
+	c := &converter{
+		scopes:          scopes,
+		repository:      map[string]*Pattern{},
+		repositoryPaths: map[string]string{},
+	}
+	c.lexer = grammar.NewLexer(func(path, message string) {
+		c.warnings = append(c.warnings, Warning{Path: path, Message: message})
+	})
+
+	c.collectRepository(g.Repository, "repository")
+	c.collectNestedRepositories(g.Patterns, "patterns")
+
+	if len(g.Injections) > 0 {
+		c.lexer.Warn("injections", "injections are not supported")
+	}
+
+	// The top-level patterns are kept in their own state so that including $self doesn't also
+	// include the fallback rule of the root state.
+	root := c.lexer.AddState("root")
+	root.Rules = append(root.Rules, grammar.Rule{Path: "patterns", Include: selfState}, grammar.FallbackRule(syn.Text))
+	self := c.lexer.AddState(selfState)
+	c.convertPatterns(self, g.Patterns, "patterns", syn.Text)
+
+	for _, key := range sortedKeys(c.repository) {
+		st := c.lexer.AddState("#" + key)
+		c.convertPattern(st, c.repository[key], c.repositoryPaths[key], syn.Text)
+	}
+
+	c.lexer.BreakIncludeCycles()
+
+	lex, err := c.lexer.Build(newLexerDef(g))
+	return lex, c.warnings, err
+}
+
+// selfState is the name of the state that holds the top-level patterns of the grammar.
+const selfState = "$self"
+
+type converter struct {
+	scopes ScopeMap
+	// repository contains the entries of the grammar's repository and of all the nested repositories.
+	repository      map[string]*Pattern
+	repositoryPaths map[string]string
+	lexer           *grammar.Lexer
+	warnings        []Warning
+}
+
+// collectRepository adds the entries of repo to the converter's repository, and then the entries of the
+// repositories nested within them. Nested repositories are flattened into one, so entries with the same
+// key in different nested repositories can't be told apart.
+func (c *converter) collectRepository(repo map[string]*Pattern, path string) {
+	var keys []string
+	for _, key := range sortedKeys(repo) {
+		p := fmt.Sprintf("%s.%s", path, key)
+		if repo[key] == nil {
+			c.lexer.Warn(p, "the repository entry %s is null", key)
+			continue
+		}
+		keys = append(keys, key)
+		if _, ok := c.repository[key]; ok {
+			c.lexer.Warn(p, "the repository entry %s is defined more than once; only the first definition is used", key)
+			continue
+		}
+		c.repository[key] = repo[key]
+		c.repositoryPaths[key] = p
+	}
+
+	for _, key := range keys {
+		p := fmt.Sprintf("%s.%s", path, key)
+		c.collectRepository(repo[key].Repository, p+".repository")
+		c.collectNestedRepositories(repo[key].Patterns, p+".patterns")
+	}
+}
+
+func (c *converter) collectNestedRepositories(patterns []Pattern, path string) {
+	for i := range patterns {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		c.collectRepository(patterns[i].Repository, p+".repository")
+		c.collectNestedRepositories(patterns[i].Patterns, p+".patterns")
+	}
+}
+
+func (c *converter) convertPatterns(st *grammar.State, patterns []Pattern, path string, def syn.TokenType) {
+	for i := range patterns {
+		c.convertPattern(st, &patterns[i], fmt.Sprintf("%s[%d]", path, i), def)
+	}
+}
+
+// convertPattern adds the rules for the pattern p to the state st. def is the token type for text
+// whose scope has no mapping.
+func (c *converter) convertPattern(st *grammar.State, p *Pattern, path string, def syn.TokenType) {
+	if p.Disabled {
+		return
+	}
+
+	switch {
+	case p.Include != "":
+		target, ok := c.includeTarget(p.Include, path)
+		if ok {
+			st.Rules = append(st.Rules, grammar.Rule{Path: path, Include: target})
+		}
+	case p.Match != "":
+		c.convertMatch(st, p, path, def)
+	case p.Begin != "" && p.While != "":
+		c.lexer.Warn(path, "begin/while patterns are not supported")
+	case p.Begin != "":
+		c.convertBeginEnd(st, p, path, def)
+	case len(p.Patterns) > 0:
+		c.convertPatterns(st, p.Patterns, path+".patterns", def)
+	case len(p.Repository) > 0:
+		// Only holds a nested repository, which was already collected.
+	default:
+		c.lexer.Warn(path, "the pattern has no match, begin, include or patterns")
+	}
+}
+
+// includeTarget returns the name of the state for the include reference inc.
+func (c *converter) includeTarget(inc, path string) (string, bool) {
+	switch {
+	case inc == "$self" || inc == "$base":
+		return selfState, true
+	case strings.HasPrefix(inc, "#"):
+		if _, ok := c.repository[inc[1:]]; !ok {
+			c.lexer.Warn(path, "the include refers to the repository entry %s, which doesn't exist", inc[1:])
+			return "", false
+		}
+		return inc, true
+	default:
+		c.lexer.Warn(path, "the include refers to the grammar %s; including other grammars is not supported", inc)
+		return "", false
+	}
+}
+
+func (c *converter) convertMatch(st *grammar.State, p *Pattern, path string, def syn.TokenType) {
+	typ := c.tokenType(p.Name, def)
+	r, ok := c.matchRule(path+".match", p.Match, p.Captures, typ)
+	if !ok {
+		return
+	}
+
+	r.Path = path
+	st.Rules = append(st.Rules, r)
+}
+
+func (c *converter) convertBeginEnd(st *grammar.State, p *Pattern, path string, def syn.TokenType) {
+	if grammar.HasBackref(p.End) {
+		c.lexer.Warn(path+".end", "the end pattern refers to groups of the begin pattern, which is not supported")
+		return
+	}
+
+	typ := c.tokenType(p.Name, def)
+	content := c.tokenType(p.ContentName, typ)
+
+	beginCaptures, endCaptures := p.BeginCaptures, p.EndCaptures
+	if len(beginCaptures) == 0 {
+		beginCaptures = p.Captures
+	}
+	if len(endCaptures) == 0 {
+		endCaptures = p.Captures
+	}
+
+	begin, ok := c.matchRule(path+".begin", p.Begin, beginCaptures, typ)
+	if !ok {
+		return
+	}
+	end, ok := c.matchRule(path+".end", p.End, endCaptures, typ)
+	if !ok {
+		return
+	}
+
+	inner := c.lexer.AddState(c.lexer.NewChildStateName(st.Name))
+	begin.Path = path
+	begin.Actions = append(begin.Actions, syn.Push(inner.Name))
+	st.Rules = append(st.Rules, begin)
+
+	end.Actions = append(end.Actions, syn.Pop(1))
+	if !p.ApplyEndPatternLast {
+		inner.Rules = append(inner.Rules, end)
+	}
+	c.convertPatterns(inner, p.Patterns, path+".patterns", content)
+	if p.ApplyEndPatternLast {
+		inner.Rules = append(inner.Rules, end)
+	}
+	inner.Rules = append(inner.Rules, grammar.FallbackRule(content))
+}
+
+// matchRule returns a rule for the pattern that emits tokens for the scopes of the captures. typ is the
+// token type for the parts of the match that have no scope given in captures.
+func (c *converter) matchRule(path, pattern string, captures map[string]Capture, typ syn.TokenType) (grammar.Rule, bool) {
+	if whole, ok := captures["0"]; ok {
+		typ = c.tokenType(whole.Name, typ)
+	}
+
+	types := map[int]syn.TokenType{}
+	for _, k := range sortedKeys(captures) {
+		capture := captures[k]
+		n, err := strconv.Atoi(k)
+		if err != nil {
+			c.lexer.Warn(path, "the capture %s is not a group number", k)
+			continue
+		}
+		if len(capture.Patterns) > 0 {
+			c.lexer.Warn(path, "patterns within captures are not supported; the patterns of capture %d are ignored", n)
+		}
+		if capture.Name == "" || n == 0 {
+			continue
+		}
+		types[n] = c.tokenType(capture.Name, typ)
+	}
+
+	return c.lexer.MatchRule(path, pattern, types, typ)
+}
+
+// tokenType returns the token type for the scope name, or def if the name is empty or has no mapping.
+func (c *converter) tokenType(scopeName string, def syn.TokenType) syn.TokenType {
+	if scopeName == "" {
+		return def
+	}
+
+	typ, ok := c.scopes.TokenType(scopeName)
+	if !ok {
+		return def
+	}
+	return typ
+}
+
+// newLexerDef returns a LexerDef with the configuration of the lexer for the grammar.
+func newLexerDef(g *Grammar) *syn.LexerDef {
+	name := g.Name
+	if name == "" {
+		name = g.ScopeName
+	}
+	def := syn.NewLexerDef(name)
+
+	if i := strings.LastIndexByte(g.ScopeName, '.'); i >= 0 {
+		def.Alias(strings.ToLower(g.ScopeName[i+1:]))
+	}
+	for _, ft := range g.FileTypes {
+		def.Filename("*." + strings.TrimPrefix(ft, "."))
+	}
+	return def
+}
+
+// sortedKeys returns the keys of m in order. Keys that are numbers, like those of captures, come first in
+// numeric order, and the others follow in lexical order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, errA := strconv.Atoi(keys[i])
+		b, errB := strconv.Atoi(keys[j])
+		switch {
+		case errA == nil && errB == nil:
+			return a < b
+		case errA == nil || errB == nil:
+			return errA == nil
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
@@ -0,0 +1,217 @@
+package textmate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jeffwilliams/syn"
+	"github.com/stretchr/testify/assert"
+)
+
+const toyGrammar = `
+{
+  "name": "Toy",
+  "scopeName": "source.toy",
+  "fileTypes": ["toy"],
+  "patterns": [
+    {"include": "#comment"},
+    {"include": "#keywords"},
+    {
+      "match": "\\b(func)\\s+(\\w+)",
+      "captures": {
+        "1": {"name": "storage.type.function.toy"},
+        "2": {"name": "entity.name.function.toy"}
+      }
+    },
+    {"include": "#string"},
+    {"begin": "\\(", "end": "\\)", "name": "meta.group.toy", "patterns": [{"include": "$self"}]},
+    {"include": "source.other"},
+    {"begin": "<<(\\w+)", "end": "^\\1$", "name": "string.unquoted.heredoc.toy"},
+    {"begin": "^>", "while": "^>", "name": "markup.quote.toy"},
+    {"match": "\\d+", "name": "constant.numeric.toy"}
+  ],
+  "repository": {
+    "comment": {"match": "#.*$", "name": "comment.line.number-sign.toy"},
+    "keywords": {"match": "\\b(if|else)\\b", "name": "keyword.control.toy"},
+    "string": {
+      "begin": "\"",
+      "end": "\"",
+      "beginCaptures": {"0": {"name": "punctuation.definition.string.begin.toy"}},
+      "name": "string.quoted.double.toy",
+      "patterns": [
+        {"match": "\\\\.", "name": "constant.character.escape.toy"},
+        {"include": "#missing"}
+      ]
+    },
+    "a": {"patterns": [{"include": "#b"}]},
+    "b": {"patterns": [{"include": "#a"}]}
+  }
+}`
+
+func TestConvert(t *testing.T) {
+	assert := assert.New(t)
+
+	lex, warnings, err := Convert(strings.NewReader(toyGrammar), nil)
+	if err != nil {
+		t.Fatalf("Converting returned error: %v\n", err)
+	}
+
+	for _, w := range warnings {
+		t.Logf("warning: %s", w)
+	}
+
+	expectedWarnings := []Warning{
+		{Path: "patterns[5]", Message: "the include refers to the grammar source.other; including other grammars is not supported"},
+		{Path: "patterns[6].end", Message: "the end pattern refers to groups of the begin pattern, which is not supported"},
+		{Path: "patterns[7]", Message: "begin/while patterns are not supported"},
+		{Path: "repository.string.patterns[1]", Message: "the include refers to the repository entry missing, which doesn't exist"},
+		{Path: "repository.b.patterns[0]", Message: "the include of #a is removed since it includes itself"},
+	}
+	assert.Equal(expectedWarnings, warnings)
+
+	input := []rune(`func main (if "a\n" 12) # hi`)
+	tokens, err := tokenize(lex.Tokenise(input))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+
+	for _, tok := range tokens {
+		t.Logf("%s", tok)
+	}
+
+	expected := []syn.Token{
+		{Type: syn.KeywordType, Value: []rune("func"), Start: 0, End: 4},
+		{Type: syn.Text, Value: []rune(" "), Start: 4, End: 5},
+		{Type: syn.NameFunction, Value: []rune("main"), Start: 5, End: 9},
+		{Type: syn.Text, Value: []rune(" ("), Start: 9, End: 11},
+		{Type: syn.Keyword, Value: []rune("if"), Start: 11, End: 13},
+		{Type: syn.Text, Value: []rune(" "), Start: 13, End: 14},
+		{Type: syn.LiteralString, Value: []rune(`"`), Start: 14, End: 15},
+		{Type: syn.LiteralStringDouble, Value: []rune("a"), Start: 15, End: 16},
+		{Type: syn.LiteralStringEscape, Value: []rune(`\n`), Start: 16, End: 18},
+		{Type: syn.LiteralStringDouble, Value: []rune(`"`), Start: 18, End: 19},
+		{Type: syn.Text, Value: []rune(" "), Start: 19, End: 20},
+		{Type: syn.LiteralNumber, Value: []rune("12"), Start: 20, End: 22},
+		{Type: syn.Text, Value: []rune(") "), Start: 22, End: 24},
+		{Type: syn.CommentSingle, Value: []rune("# hi"), Start: 24, End: 28},
+	}
+
+	assert.Equal(expected, tokens)
+}
+
+func TestCaptureWarningsAreInOrder(t *testing.T) {
+	grammar := `
+{
+  "name": "Toy",
+  "scopeName": "source.toy",
+  "patterns": [
+    {
+      "match": "(a)(b)",
+      "captures": {
+        "x": {"name": "keyword.toy"},
+        "2": {"name": "keyword.toy", "patterns": [{"match": "b"}]},
+        "1": {"name": "keyword.toy", "patterns": [{"match": "a"}]},
+        "10": {"patterns": [{"match": "c"}]},
+        "y": {"name": "keyword.toy"}
+      }
+    }
+  ]
+}`
+
+	expectedWarnings := []Warning{
+		{Path: "patterns[0].match", Message: "patterns within captures are not supported; the patterns of capture 1 are ignored"},
+		{Path: "patterns[0].match", Message: "patterns within captures are not supported; the patterns of capture 2 are ignored"},
+		{Path: "patterns[0].match", Message: "patterns within captures are not supported; the patterns of capture 10 are ignored"},
+		{Path: "patterns[0].match", Message: "the capture x is not a group number"},
+		{Path: "patterns[0].match", Message: "the capture y is not a group number"},
+	}
+
+	// The captures are a map, so a wrong order would likely show up in one of several conversions.
+	for i := 0; i < 10; i++ {
+		_, warnings, err := Convert(strings.NewReader(grammar), nil)
+		if err != nil {
+			t.Fatalf("Converting returned error: %v\n", err)
+		}
+		assert.Equal(t, expectedWarnings, warnings)
+	}
+}
+
+func TestNullRepositoryEntry(t *testing.T) {
+	grammar := `
+{
+  "name": "Toy",
+  "scopeName": "source.toy",
+  "patterns": [{"include": "#a"}, {"include": "#b"}],
+  "repository": {
+    "a": null,
+    "b": {"match": "b", "name": "keyword.toy", "repository": {"c": null}}
+  }
+}`
+
+	_, warnings, err := Convert(strings.NewReader(grammar), nil)
+	if err != nil {
+		t.Fatalf("Converting returned error: %v\n", err)
+	}
+
+	expectedWarnings := []Warning{
+		{Path: "repository.a", Message: "the repository entry a is null"},
+		{Path: "repository.b.repository.c", Message: "the repository entry c is null"},
+		{Path: "patterns[0]", Message: "the include refers to the repository entry a, which doesn't exist"},
+	}
+	assert.Equal(t, expectedWarnings, warnings)
+}
+
+func TestConvertCustomScopes(t *testing.T) {
+	assert := assert.New(t)
+
+	scopes := ScopeMap{
+		"keyword": syn.KeywordReserved,
+	}
+
+	lex, _, err := Convert(strings.NewReader(toyGrammar), scopes)
+	if err != nil {
+		t.Fatalf("Converting returned error: %v\n", err)
+	}
+
+	tokens, err := tokenize(lex.Tokenise([]rune("if 1")))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+
+	expected := []syn.Token{
+		{Type: syn.KeywordReserved, Value: []rune("if"), Start: 0, End: 2},
+		{Type: syn.Text, Value: []rune(" 1"), Start: 2, End: 4},
+	}
+
+	assert.Equal(expected, tokens)
+}
+
+func TestScopeMap(t *testing.T) {
+	assert := assert.New(t)
+
+	typ, ok := DefaultScopes.TokenType("keyword.control.go")
+	assert.True(ok)
+	assert.Equal(syn.Keyword, typ)
+
+	typ, ok = DefaultScopes.TokenType("keyword.operator.assignment.go")
+	assert.True(ok)
+	assert.Equal(syn.Operator, typ)
+
+	typ, ok = DefaultScopes.TokenType("meta.block.go string.quoted.double.go")
+	assert.True(ok)
+	assert.Equal(syn.LiteralStringDouble, typ)
+
+	_, ok = DefaultScopes.TokenType("meta.block.go")
+	assert.False(ok)
+}
+
+func tokenize(it syn.Iterator) (tokens []syn.Token, err error) {
+	for {
+		var tok syn.Token
+		tok, err = it.Next()
+		if err != nil || tok.Type == syn.EOFType {
+			return
+		}
+		tokens = append(tokens, tok)
+	}
+}
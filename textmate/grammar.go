@@ -0,0 +1,91 @@
+// Package textmate converts TextMate grammars into syn Lexers.
+package textmate
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// Grammar is a TextMate grammar, as found in .tmLanguage.json files.
+type Grammar struct {
+	Name       string              `json:"name"`
+	ScopeName  string              `json:"scopeName"`
+	FileTypes  []string            `json:"fileTypes"`
+	Patterns   []Pattern           `json:"patterns"`
+	Repository map[string]*Pattern `json:"repository"`
+	Injections map[string]*Pattern `json:"injections"`
+}
+
+// Pattern is an element of the patterns list of a grammar or of a repository.
+type Pattern struct {
+	Include string `json:"include"`
+
+	Match string `json:"match"`
+
+	Begin string `json:"begin"`
+	End   string `json:"end"`
+	While string `json:"while"`
+
+	Name        string `json:"name"`
+	ContentName string `json:"contentName"`
+
+	Captures      map[string]Capture `json:"captures"`
+	BeginCaptures map[string]Capture `json:"beginCaptures"`
+	EndCaptures   map[string]Capture `json:"endCaptures"`
+	WhileCaptures map[string]Capture `json:"whileCaptures"`
+
+	Patterns   []Pattern           `json:"patterns"`
+	Repository map[string]*Pattern `json:"repository"`
+
+	ApplyEndPatternLast flag `json:"applyEndPatternLast"`
+	Disabled            flag `json:"disabled"`
+}
+
+// Capture assigns a scope to a capture group of a match, begin or end pattern.
+type Capture struct {
+	Name     string    `json:"name"`
+	Patterns []Pattern `json:"patterns"`
+}
+
+// flag is a boolean that grammars write either as true/false or as 1/0.
+type flag bool
+
+func (f *flag) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return err
+	}
+
+	switch t := v.(type) {
+	case bool:
+		*f = flag(t)
+	case float64:
+		*f = t != 0
+	default:
+		*f = false
+	}
+	return nil
+}
+
+// DecodeGrammar reads a TextMate grammar in JSON format.
+func DecodeGrammar(rdr io.Reader) (*Grammar, error) {
+	var g Grammar
+	err := json.NewDecoder(rdr).Decode(&g)
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// DecodeGrammarFile reads a TextMate grammar from a .tmLanguage.json file.
+func DecodeGrammarFile(path string) (*Grammar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return DecodeGrammar(f)
+}
@@ -0,0 +1,115 @@
+package textmate
+
+import (
+	"strings"
+
+	"github.com/jeffwilliams/syn"
+)
+
+// ScopeMap maps TextMate scope names onto token types. A scope matches an entry in the
+// map if the entry is the scope itself or a prefix of it made of whole dot-separated parts, and
+// the longest such entry wins. For example the scope keyword.control.go matches the entry
+// keyword.control before the entry keyword.
+type ScopeMap map[string]syn.TokenType
+
+// TokenType returns the token type for the scope name. A scope name may contain several scopes
+// separated by spaces, in which case the first that has a match is used. ok is false when no
+// scope matches.
+func (m ScopeMap) TokenType(scopeName string) (typ syn.TokenType, ok bool) {
+	for _, scope := range strings.Fields(scopeName) {
+		for {
+			typ, ok = m[scope]
+			if ok {
+				return
+			}
+
+			i := strings.LastIndexByte(scope, '.')
+			if i < 0 {
+				break
+			}
+			scope = scope[:i]
+		}
+	}
+	return
+}
+
+// DefaultScopes maps the scope names recommended in the TextMate manual, along with some
+// common ones used by popular grammars, onto token types.
+var DefaultScopes = ScopeMap{
+	"comment":                     syn.Comment,
+	"comment.line":                syn.CommentSingle,
+	"comment.block":               syn.CommentMultiline,
+	"comment.block.documentation": syn.LiteralStringDoc,
+
+	"constant":                  syn.NameConstant,
+	"constant.numeric":          syn.LiteralNumber,
+	"constant.numeric.integer":  syn.LiteralNumberInteger,
+	"constant.numeric.float":    syn.LiteralNumberFloat,
+	"constant.numeric.hex":      syn.LiteralNumberHex,
+	"constant.numeric.octal":    syn.LiteralNumberOct,
+	"constant.numeric.binary":   syn.LiteralNumberBin,
+	"constant.character":        syn.LiteralStringChar,
+	"constant.character.escape": syn.LiteralStringEscape,
+	"constant.language":         syn.KeywordConstant,
+	"constant.other":            syn.NameConstant,
+
+	"entity":                       syn.Name,
+	"entity.name":                  syn.Name,
+	"entity.name.function":         syn.NameFunction,
+	"entity.name.type":             syn.NameClass,
+	"entity.name.class":            syn.NameClass,
+	"entity.name.namespace":        syn.NameNamespace,
+	"entity.name.tag":              syn.NameTag,
+	"entity.name.section":          syn.GenericHeading,
+	"entity.name.label":            syn.NameLabel,
+	"entity.other.attribute-name":  syn.NameAttribute,
+	"entity.other.inherited-class": syn.NameClass,
+
+	"invalid": syn.Error,
+
+	"keyword":          syn.Keyword,
+	"keyword.control":  syn.Keyword,
+	"keyword.operator": syn.Operator,
+	"keyword.other":    syn.Keyword,
+
+	"markup.bold":      syn.GenericStrong,
+	"markup.italic":    syn.GenericEmph,
+	"markup.underline": syn.GenericUnderline,
+	"markup.heading":   syn.GenericHeading,
+	"markup.inserted":  syn.GenericInserted,
+	"markup.deleted":   syn.GenericDeleted,
+	"markup.raw":       syn.LiteralStringBacktick,
+	"markup.quote":     syn.GenericEmph,
+
+	"punctuation":                    syn.Punctuation,
+	"punctuation.definition.comment": syn.Comment,
+	"punctuation.definition.string":  syn.LiteralString,
+	"punctuation.definition.tag":     syn.Punctuation,
+	"punctuation.section.embedded":   syn.LiteralStringInterpol,
+
+	"storage":          syn.KeywordDeclaration,
+	"storage.type":     syn.KeywordType,
+	"storage.modifier": syn.Keyword,
+
+	"string":                  syn.LiteralString,
+	"string.quoted.single":    syn.LiteralStringSingle,
+	"string.quoted.double":    syn.LiteralStringDouble,
+	"string.quoted.triple":    syn.LiteralStringDoc,
+	"string.quoted.other":     syn.LiteralStringOther,
+	"string.unquoted.heredoc": syn.LiteralStringHeredoc,
+	"string.interpolated":     syn.LiteralStringInterpol,
+	"string.regexp":           syn.LiteralStringRegex,
+	"string.other":            syn.LiteralStringOther,
+
+	"support":          syn.NameBuiltin,
+	"support.function": syn.NameBuiltin,
+	"support.class":    syn.NameClass,
+	"support.type":     syn.KeywordType,
+	"support.constant": syn.NameConstant,
+	"support.variable": syn.NameVariable,
+
+	"variable":           syn.NameVariable,
+	"variable.parameter": syn.NameVariable,
+	"variable.language":  syn.NameBuiltinPseudo,
+	"variable.other":     syn.NameVariable,
+}
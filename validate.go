@@ -0,0 +1,337 @@
+package syn
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jeffwilliams/syn/internal/config"
+)
+
+// DiagnosticKind identifies the kind of problem that a Diagnostic describes.
+type DiagnosticKind int
+
+const (
+	// InvalidRule is a rule that the lexer can't be built with, like one with a pattern that
+	// doesn't compile or an unknown token type.
+	InvalidRule DiagnosticKind = iota
+	// MissingState is a reference to a state that isn't defined, or a missing root state.
+	MissingState
+	// IncludeCycle is an include that, directly or through other states, includes the state it is in.
+	IncludeCycle
+	// EmptyMatchLoop is a rule that can match without the lexer making progress, so that the lexer
+	// loops forever or produces an endless run of empty tokens.
+	EmptyMatchLoop
+	// UnreachableState is a state that can never be entered from the root state.
+	UnreachableState
+)
+
+func (k DiagnosticKind) String() string {
+	switch k {
+	case InvalidRule:
+		return "invalid rule"
+	case MissingState:
+		return "missing state"
+	case IncludeCycle:
+		return "include cycle"
+	case EmptyMatchLoop:
+		return "empty match loop"
+	case UnreachableState:
+		return "unreachable state"
+	default:
+		return fmt.Sprintf("DiagnosticKind(%d)", int(k))
+	}
+}
+
+// Diagnostic describes a problem found in a lexer definition by ValidateLexer.
+type Diagnostic struct {
+	// State is the name of the state that the problem is in.
+	State string
+	// Rule is the index of the rule within the state, or -1 if the problem is with the state as a whole.
+	Rule    int
+	Kind    DiagnosticKind
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	if d.Rule < 0 {
+		return fmt.Sprintf("state %s: %s: %s", d.State, d.Kind, d.Message)
+	}
+	return fmt.Sprintf("state %s rule %d: %s: %s", d.State, d.Rule, d.Kind, d.Message)
+}
+
+// ValidateLexer checks the definition of the lexer l for problems and returns a Diagnostic for each
+// one found. Besides the problems that stop a lexer from being built, it finds those that only show up
+// while lexing: rules that can match without the lexer making progress, include cycles, and states
+// that can't be reached from the root state. It returns nil if no problems are found.
+func ValidateLexer(l *Lexer) []Diagnostic {
+	return validateConfig(l.cfg())
+}
+
+// Validate checks the definition for problems in the same way as ValidateLexer. Unlike Build, which stops
+// at the first error, it reports every problem found.
+func (d *LexerDef) Validate() []Diagnostic {
+	return validateConfig(d.config())
+}
+
+// validator finds the problems in a lexer definition.
+type validator struct {
+	cfg    *config.Lexer
+	lb     lexerBuilder
+	states map[string]*config.State
+	diags  []Diagnostic
+}
+
+func validateConfig(cfg *config.Lexer) []Diagnostic {
+	v := validator{
+		cfg:    cfg,
+		lb:     newLexerBuilder(cfg),
+		states: map[string]*config.State{},
+	}
+	for i := range cfg.Rules.States {
+		st := &cfg.Rules.States[i]
+		if _, ok := v.states[st.Name]; !ok {
+			v.states[st.Name] = st
+		}
+	}
+
+	v.checkRoot()
+	v.checkRules()
+	v.checkIncludeCycles()
+	v.checkReachability()
+	return v.diags
+}
+
+func (v *validator) add(state string, rule int, kind DiagnosticKind, format string, args ...interface{}) {
+	v.diags = append(v.diags, Diagnostic{
+		State:   state,
+		Rule:    rule,
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *validator) checkRoot() {
+	if _, ok := v.states["root"]; !ok {
+		v.add("root", -1, MissingState, "no root state is defined")
+	}
+}
+
+func (v *validator) checkRules() {
+	for _, st := range v.cfg.Rules.States {
+		for i := range st.Rules {
+			cr := &st.Rules[i]
+			v.checkReferences(st.Name, i, cr)
+			v.checkRule(st.Name, i, cr)
+		}
+	}
+}
+
+// checkReferences checks that the states the rule cr refers to exist.
+func (v *validator) checkReferences(state string, index int, cr *config.Rule) {
+	for _, ref := range referencesOf(cr) {
+		if _, ok := v.states[ref.state]; !ok {
+			v.add(state, index, MissingState, "the rule %s the state %s, which is not defined", ref.how, ref.state)
+		}
+	}
+}
+
+// checkRule checks that the lexer can be built with the rule cr, and that the rule makes progress when it matches.
+func (v *validator) checkRule(state string, index int, cr *config.Rule) {
+	err := v.lb.checkRule(cr)
+	if err != nil {
+		v.add(state, index, InvalidRule, "%v", err)
+		return
+	}
+
+	r, err := v.lb.makeRuleFor(cr)
+	if err != nil {
+		v.add(state, index, InvalidRule, "the pattern doesn't compile: %v", err)
+		return
+	}
+
+	err = v.lb.setRuleFieldsFrom(&r, cr)
+	if err != nil {
+		v.add(state, index, InvalidRule, "%v", err)
+		return
+	}
+
+	if cr.Include != nil || changesState(cr) {
+		return
+	}
+
+	if !emitsTokens(cr) {
+		// The iterator moves on to the next rule at the same position, so matching this rule
+		// again makes it recurse forever.
+		v.add(state, index, EmptyMatchLoop, "the rule emits no token and doesn't change the state, so the lexer loops when it matches")
+		return
+	}
+
+	if matchesEmpty(r) {
+		v.add(state, index, EmptyMatchLoop, "the pattern can match empty text and the rule doesn't change the state, so the lexer stops making progress when it does")
+	}
+}
+
+// changesState returns true if the rule cr pushes or pops states.
+func changesState(cr *config.Rule) bool {
+	return cr.Push != nil || cr.Pop != nil || cr.Mutators != nil || cr.Combined != nil
+}
+
+// emitsTokens returns true if the rule cr emits tokens for the text it matches.
+func emitsTokens(cr *config.Rule) bool {
+	return cr.Token != nil || cr.ByGroups != nil || cr.UsingSelf != nil || cr.Using != nil || cr.Delimited != nil || cr.Call != nil
+}
+
+// emptyMatchProbes are the texts that matchesEmpty tries the pattern of a rule against.
+var emptyMatchProbes = []string{"", "a", "A", "0", "_", " ", "\t", "\n", ".", "\"", "'", "(", ")", "/", "#", "<", "\\"}
+
+// matchesEmpty returns true if the pattern of the rule r matches empty text at the start of any of the
+// probe texts. Patterns whose empty match depends on their context are not always detected.
+func matchesEmpty(r rule) bool {
+	for _, probe := range emptyMatchProbes {
+		m, err := r.match([]rune(probe), 0, nil)
+		if err == nil && m != nil && m.length() == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// stateRef is a reference from a rule to a state.
+type stateRef struct {
+	state string
+	// how describes the way the state is referred to.
+	how string
+}
+
+// referencesOf returns the references to states made by the rule cr. Includes of states of other lexers
+// are not references to states of the same lexer, so they are left out.
+func referencesOf(cr *config.Rule) (refs []stateRef) {
+	for _, push := range pushesOf(cr) {
+		if push.State != "" {
+			refs = append(refs, stateRef{state: push.State, how: "pushes"})
+		}
+	}
+
+	if cr.Include != nil && cr.Include.Lexer == "" {
+		refs = append(refs, stateRef{state: cr.Include.State, how: "includes"})
+	}
+
+	if cr.Combined != nil {
+		for _, s := range cr.Combined.States {
+			refs = append(refs, stateRef{state: s, how: "combines"})
+		}
+	}
+
+	if cr.UsingSelf != nil && cr.UsingSelf.State != "" {
+		refs = append(refs, stateRef{state: cr.UsingSelf.State, how: "lexes text using"})
+	}
+
+	if cr.ByGroups != nil {
+		for _, e := range cr.ByGroups.ByGroupsElements {
+			if u, ok := e.V.(*config.UsingSelf); ok && u.State != "" {
+				refs = append(refs, stateRef{state: u.State, how: "lexes a group using"})
+			}
+		}
+	}
+	return
+}
+
+// checkIncludeCycles finds the include rules that lead back to the state they are in.
+func (v *validator) checkIncludeCycles() {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	marks := map[string]int{}
+	var path []string
+
+	var visit func(name string)
+	visit = func(name string) {
+		marks[name] = visiting
+		path = append(path, name)
+
+		st := v.states[name]
+		for i := range st.Rules {
+			inc := st.Rules[i].Include
+			if inc == nil || inc.Lexer != "" {
+				continue
+			}
+			if _, ok := v.states[inc.State]; !ok {
+				continue
+			}
+
+			switch marks[inc.State] {
+			case visiting:
+				cycle := append(pathFrom(path, inc.State), inc.State)
+				v.add(name, i, IncludeCycle, "the include leads back to the state %s: %s",
+					inc.State, strings.Join(cycle, " -> "))
+			case unvisited:
+				visit(inc.State)
+			}
+		}
+
+		path = path[:len(path)-1]
+		marks[name] = done
+	}
+
+	for _, st := range v.cfg.Rules.States {
+		if marks[st.Name] == unvisited {
+			visit(st.Name)
+		}
+	}
+}
+
+// pathFrom returns the part of path that starts at the element name.
+func pathFrom(path []string, name string) []string {
+	for i, s := range path {
+		if s == name {
+			return append([]string(nil), path[i:]...)
+		}
+	}
+	return nil
+}
+
+// checkReachability finds the states that can't be entered starting from the root state. The functions called
+// by rules may push any state, so if a reachable rule calls one no state is reported.
+func (v *validator) checkReachability() {
+	if _, ok := v.states["root"]; !ok {
+		return
+	}
+
+	reached := map[string]bool{}
+	calls := false
+	var visit func(name string)
+	visit = func(name string) {
+		st, ok := v.states[name]
+		if !ok || reached[name] {
+			return
+		}
+		reached[name] = true
+		for i := range st.Rules {
+			if st.Rules[i].Call != nil {
+				calls = true
+			}
+			for _, ref := range referencesOf(&st.Rules[i]) {
+				visit(ref.state)
+			}
+		}
+	}
+	visit("root")
+	if calls {
+		return
+	}
+
+	var unreached []string
+	for name := range v.states {
+		if !reached[name] {
+			unreached = append(unreached, name)
+		}
+	}
+	sort.Strings(unreached)
+
+	for _, name := range unreached {
+		v.add(name, -1, UnreachableState, "the state can't be reached from the root state")
+	}
+}
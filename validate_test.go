@@ -0,0 +1,171 @@
+package syn
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateLexer(t *testing.T) {
+	tests := []struct {
+		name     string
+		def      *LexerDef
+		expected []Diagnostic
+	}{
+		{
+			name: "valid",
+			def: NewLexerDef("Valid").
+				State("root").
+				Include("common").
+				Rule(`"`, Emit(String), Push("string")).
+				State("string").
+				Rule(`[^"]+`, Emit(String)).
+				Rule(`"`, Emit(String), Pop(1)).
+				Rule(``, Pop(1)).
+				State("common").
+				Rule(`\s+`, Emit(Text)),
+		},
+		{
+			name: "missing states",
+			def: NewLexerDef("Missing").
+				State("other").
+				Rule(`x`, Emit(Text), Push("nowhere")).
+				Include("absent"),
+			expected: []Diagnostic{
+				{State: "root", Rule: -1, Kind: MissingState},
+				{State: "other", Rule: 0, Kind: MissingState},
+				{State: "other", Rule: 1, Kind: MissingState},
+			},
+		},
+		{
+			name: "include cycle",
+			def: NewLexerDef("Cycle").
+				State("root").
+				Include("a").
+				State("a").
+				Rule(`a`, Emit(Text)).
+				Include("b").
+				State("b").
+				Include("a"),
+			expected: []Diagnostic{
+				{State: "b", Rule: 0, Kind: IncludeCycle},
+			},
+		},
+		{
+			name: "empty match loops",
+			def: NewLexerDef("Loops").
+				State("root").
+				Rule(`\s*`, Emit(Text)).
+				Rule(`x`).
+				Rule(`(a?)(b?)`, ByGroups(Emit(Name), Emit(Operator))).
+				Rule(`y?`, Emit(Text), Push("other")).
+				State("other").
+				Rule(`z*`, Pop(1)),
+			expected: []Diagnostic{
+				{State: "root", Rule: 0, Kind: EmptyMatchLoop},
+				{State: "root", Rule: 1, Kind: EmptyMatchLoop},
+				{State: "root", Rule: 2, Kind: EmptyMatchLoop},
+			},
+		},
+		{
+			name: "unreachable state",
+			def: NewLexerDef("Unreachable").
+				State("root").
+				Rule(`x`, Emit(Text)).
+				State("dead").
+				Rule(`y`, Emit(Text), Push("dead2")).
+				State("dead2").
+				Rule(`z`, Emit(Text), UsingSelf("root")),
+			expected: []Diagnostic{
+				{State: "dead", Rule: -1, Kind: UnreachableState},
+				{State: "dead2", Rule: -1, Kind: UnreachableState},
+			},
+		},
+		{
+			name: "invalid rules",
+			def: NewLexerDef("Invalid").
+				State("root").
+				Rule(`(x`, Emit(Text)).
+				Rule(`y`, Emit(TokenType(123456))),
+			expected: []Diagnostic{
+				{State: "root", Rule: 0, Kind: InvalidRule},
+				{State: "root", Rule: 1, Kind: InvalidRule},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			diags := tc.def.Validate()
+			for _, d := range diags {
+				t.Logf("%s", d)
+			}
+
+			// Only the location and kind are compared, not the wording of the message.
+			var actual []Diagnostic
+			for _, d := range diags {
+				assert.NotEmpty(t, d.Message)
+				d.Message = ""
+				actual = append(actual, d)
+			}
+			assert.Equal(t, tc.expected, actual)
+		})
+	}
+}
+
+func TestBuildWithIncludeCycle(t *testing.T) {
+	_, err := NewLexerDef("Cycle").
+		State("root").
+		Include("root").
+		Build()
+	assert.NotNil(t, err)
+}
+
+func TestValidateEmbeddedLexers(t *testing.T) {
+	files, err := filepath.Glob("lexers/embedded/*.xml")
+	if err != nil {
+		t.Fatalf("Listing the embedded lexers failed: %v", err)
+	}
+
+	reg := NewLexerRegistry()
+	names := map[*Lexer]string{}
+	for _, file := range files {
+		lex, err := loadStrict(file)
+		if err != nil {
+			t.Errorf("Loading %s failed: %v", file, err)
+			continue
+		}
+		reg.Register(lex)
+		names[lex] = filepath.Base(file)
+	}
+
+	for _, err := range reg.Resolve() {
+		t.Errorf("%v", err)
+	}
+
+	for _, lex := range reg.Lexers {
+		for _, d := range ValidateLexer(lex) {
+			// Some lexers taken from Chroma contain states that are no longer used. These are harmless.
+			if d.Kind == UnreachableState {
+				t.Logf("%s: %s", names[lex], d)
+				continue
+			}
+			t.Errorf("%s: %s", names[lex], d)
+		}
+	}
+}
+
+// loadStrict loads the XML lexer definition in file, treating any element or attribute that is not
+// understood as an error.
+func loadStrict(file string) (*Lexer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lex, err := NewLexerFromXMLStrict(f)
+	return lex, inFile(err, file)
+}
@@ -0,0 +1,109 @@
+package syn
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/dlclark/regexp2"
+	"github.com/jeffwilliams/syn/internal/config"
+)
+
+// variableRef matches a reference to a variable in a pattern, like {{ident}}.
+var variableRef = regexp.MustCompile(`\{\{(\w+)\}\}`)
+
+// expandVariables replaces the references to variables in pattern with their values, which are taken from
+// vars. The values may themselves refer to other variables. If there are no variables the pattern is left as it
+// is, so that lexers written before variables existed can match a literal {{name}}.
+func expandVariables(pattern string, vars []config.Var) (string, error) {
+	if len(vars) == 0 || !strings.Contains(pattern, "{{") {
+		return pattern, nil
+	}
+
+	values := make(map[string]string, len(vars))
+	for _, v := range vars {
+		values[v.Name] = v.Value
+	}
+
+	return expandVariablesIn(pattern, values, nil)
+}
+
+// expandVariablesIn replaces the references to variables in pattern. expanding holds the names of the variables
+// whose values are being expanded, and is used to find variables that refer to themselves.
+func expandVariablesIn(pattern string, values map[string]string, expanding []string) (string, error) {
+	var err error
+	res := variableRef.ReplaceAllStringFunc(pattern, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+
+		name := variableRef.FindStringSubmatch(ref)[1]
+		value, ok := values[name]
+		if !ok {
+			err = fmt.Errorf("The pattern refers to the variable %s, which is not defined", name)
+			return ref
+		}
+
+		for _, n := range expanding {
+			if n == name {
+				cycle := append(pathFrom(expanding, name), name)
+				err = fmt.Errorf("The variable %s refers to itself: %s", name, strings.Join(cycle, " -> "))
+				return ref
+			}
+		}
+
+		var exp string
+		exp, err = expandVariablesIn(value, values, append(expanding, name))
+		return exp
+	})
+	return res, err
+}
+
+// capturedVariableRef matches a reference in a pattern to a variable captured when a state was pushed, like {{$ident}}.
+var capturedVariableRef = regexp.MustCompile(`\{\{\$(\w+)\}\}`)
+
+// capturedPattern is a pattern that refers to captured variables. Their values are only known when the pattern
+// is matched, so it is compiled then, once for each distinct set of values.
+type capturedPattern struct {
+	pattern string
+	opts    regexp2.RegexOptions
+	// compiled maps the pattern with the values substituted to its compiled form.
+	compiled sync.Map
+}
+
+// newCapturedPattern returns a capturedPattern for pattern if it refers to captured variables, or nil if it doesn't.
+func newCapturedPattern(pattern string, opts regexp2.RegexOptions) *capturedPattern {
+	if !capturedVariableRef.MatchString(pattern) {
+		return nil
+	}
+	return &capturedPattern{pattern: pattern, opts: opts}
+}
+
+// regexp returns the pattern compiled with the values of the variables that it refers to, which are looked
+// up in vars. The values are matched literally.
+func (p *capturedPattern) regexp(vars *stack) (*regexp2.Regexp, error) {
+	var err error
+	pat := capturedVariableRef.ReplaceAllStringFunc(p.pattern, func(ref string) string {
+		name := capturedVariableRef.FindStringSubmatch(ref)[1]
+		value, ok := vars.variable(name)
+		if !ok && err == nil {
+			err = fmt.Errorf("The pattern refers to the captured variable %s, which is not set", name)
+		}
+		return regexp2.Escape(value)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if re, ok := p.compiled.Load(pat); ok {
+		return re.(*regexp2.Regexp), nil
+	}
+
+	re, err := compilePattern(pat, p.opts)
+	if err != nil {
+		return nil, err
+	}
+	p.compiled.Store(pat, re)
+	return re, nil
+}
@@ -0,0 +1,203 @@
+package syn
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dlclark/regexp2"
+	"github.com/dlclark/regexp2/syntax"
+	"github.com/jeffwilliams/syn/internal/config"
+)
+
+// words matches any word of a list, like the pattern prefix(word1|word2|...)suffix. Rather than trying
+// each alternative in turn the words are looked up in a trie, so that long lists of keywords are fast to
+// match. As with the pattern, the first word in the list that matches along with the suffix is chosen,
+// and the match has one group, which holds the word.
+type words struct {
+	list     []string
+	root     *wordNode
+	foldCase bool
+	// prefix and suffix are the patterns that must match before and after the word. They are nil when the
+	// pattern is empty or \b, which are checked without a regular expression.
+	prefix, suffix         *regexp2.Regexp
+	prefixText, suffixText string
+}
+
+// wordNode is a node in the trie of words. The path from the root to the node spells a prefix of a word.
+type wordNode struct {
+	children map[rune]*wordNode
+	// index is one more than the index in the list of the first word that ends at this node, or 0
+	// if none does.
+	index int
+}
+
+// wordBoundary is the prefix or suffix that is checked directly.
+const wordBoundary = `\b`
+
+// newWords makes a words that matches the whitespace separated words in list. The prefix and suffix
+// patterns, and the words if opts makes the match case insensitive, are matched using opts.
+func newWords(list, prefix, suffix string, opts regexp2.RegexOptions) (*words, error) {
+	w := &words{
+		list:       strings.Fields(list),
+		root:       &wordNode{},
+		foldCase:   opts&regexp2.IgnoreCase != 0,
+		prefixText: prefix,
+		suffixText: suffix,
+	}
+
+	var err error
+	if prefix != "" && prefix != wordBoundary {
+		w.prefix, err = compileWordsPattern(`\G(?:`+prefix+`)`, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if suffix != "" && suffix != wordBoundary {
+		w.suffix, err = compileWordsPattern(`\G(?:`+suffix+`)`, opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, word := range w.list {
+		node := w.root
+		for _, r := range word {
+			r = w.fold(r)
+			next := node.children[r]
+			if next == nil {
+				next = &wordNode{}
+				if node.children == nil {
+					node.children = map[rune]*wordNode{}
+				}
+				node.children[r] = next
+			}
+			node = next
+		}
+		if node.index == 0 {
+			node.index = i + 1
+		}
+	}
+	return w, nil
+}
+
+func compileWordsPattern(pat string, opts regexp2.RegexOptions) (*regexp2.Regexp, error) {
+	re, err := regexp2.Compile(pat, opts)
+	if err != nil {
+		return nil, err
+	}
+	re.MatchTimeout = time.Millisecond * 250
+	return re, nil
+}
+
+func (w *words) fold(r rune) rune {
+	if w.foldCase {
+		return unicode.ToLower(r)
+	}
+	return r
+}
+
+// wordCandidate is a word that is found at the position in the text being matched.
+type wordCandidate struct {
+	index int
+	end   int
+}
+
+// match matches the words at index pos of text. The positions in the match are relative to pos.
+func (w *words) match(text []rune, pos int) (*match, error) {
+	start, err := w.matchPrefix(text, pos)
+	if err != nil || start < 0 {
+		return nil, err
+	}
+
+	var candidates []wordCandidate
+	node := w.root
+	for i := start; i < len(text); i++ {
+		node = node.children[w.fold(text[i])]
+		if node == nil {
+			break
+		}
+		if node.index > 0 {
+			candidates = append(candidates, wordCandidate{index: node.index, end: i + 1})
+		}
+	}
+
+	// The words are tried in the order they are listed in, like the alternatives of a pattern.
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].index < candidates[j].index
+	})
+
+	for _, c := range candidates {
+		end, err := w.matchSuffix(text, c.end)
+		if err != nil {
+			return nil, err
+		}
+		if end >= 0 {
+			return &match{groups: []capture{{start: 0, length: end - pos}, {start: start - pos, length: c.end - start}}}, nil
+		}
+	}
+	return nil, nil
+}
+
+// matchPrefix returns the position of the end of the text that the prefix matches at index pos of text, or
+// -1 if it doesn't match.
+func (w *words) matchPrefix(text []rune, pos int) (int, error) {
+	switch {
+	case w.prefix != nil:
+		m, err := w.prefix.FindRunesMatchStartingAt(text, pos)
+		if err != nil || m == nil || m.Index != pos {
+			return -1, err
+		}
+		return pos + m.Length, nil
+	case w.prefixText == wordBoundary:
+		if !isWordBoundary(text, pos) {
+			return -1, nil
+		}
+	}
+	return pos, nil
+}
+
+// matchSuffix returns the position of the end of the text that the suffix matches at index i of text, or
+// -1 if it doesn't match.
+func (w *words) matchSuffix(text []rune, i int) (int, error) {
+	switch {
+	case w.suffix != nil:
+		m, err := w.suffix.FindRunesMatchStartingAt(text, i)
+		if err != nil || m == nil || m.Index != i {
+			return -1, err
+		}
+		return i + m.Length, nil
+	case w.suffixText == wordBoundary:
+		if !isWordBoundary(text, i) {
+			return -1, nil
+		}
+	}
+	return i, nil
+}
+
+// isWordBoundary returns true if \b matches at index i of text.
+func isWordBoundary(text []rune, i int) bool {
+	before := i > 0 && syntax.IsWordChar(text[i-1])
+	after := i < len(text) && syntax.IsWordChar(text[i])
+	return before != after
+}
+
+func (w *words) String() string {
+	return w.prefixText + "(" + strings.Join(w.list, "|") + ")" + w.suffixText
+}
+
+// makeWords makes the words matched by a rule from the words element cw.
+func (lb *lexerBuilder) makeWords(cw *config.Words, opts regexp2.RegexOptions) (*words, error) {
+	prefix, err := expandVariables(cw.Prefix, lb.cfg.Variables)
+	if err != nil {
+		return nil, err
+	}
+
+	suffix, err := expandVariables(cw.Suffix, lb.cfg.Variables)
+	if err != nil {
+		return nil, err
+	}
+
+	return newWords(cw.List, prefix, suffix, opts)
+}
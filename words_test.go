@@ -0,0 +1,135 @@
+package syn
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dlclark/regexp2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWordsMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		list   string
+		prefix string
+		suffix string
+		opts   regexp2.RegexOptions
+		text   string
+		// pos is the position in text to match at.
+		pos int
+		// length is the length of the match, or -1 if there is none.
+		length int
+	}{
+		{name: "word", list: "if else", text: "else", length: 4},
+		{name: "no word", list: "if else", text: "x", length: -1},
+		{name: "first listed word wins", list: "in int", text: "int", length: 2},
+		{name: "suffix rejects shorter word", list: "in int", suffix: `\b`, text: "int x", length: 3},
+		{name: "boundary at end of text", list: "in int", suffix: `\b`, text: "int", length: 3},
+		{name: "no boundary", list: "in int", suffix: `\b`, text: "integer", length: -1},
+		{name: "boundary prefix", list: "if", prefix: `\b`, text: "if", length: 2},
+		{name: "boundary prefix before non-word", list: "+=", prefix: `\b`, text: "+=", length: -1},
+		{name: "pattern prefix", list: "define include", prefix: `#\s*`, text: "#  include <x>", length: 10},
+		{name: "pattern suffix", list: "print len", suffix: `(?=\s*\()`, text: "len (x)", length: 3},
+		{name: "suffix not followed", list: "print len", suffix: `(?=\s*\()`, text: "len x", length: -1},
+		{name: "suffix sees the word", list: "a ab", suffix: `(?<=b)`, text: "ab", length: 2},
+		{name: "boundary prefix after word", list: "if", prefix: `\b`, text: "xif", pos: 1, length: -1},
+		{name: "boundary prefix after non-word", list: "if", prefix: `\b`, text: " if", pos: 1, length: 2},
+		{name: "prefix sees text before", list: "len", prefix: `(?<=\.)`, text: "x.len", pos: 2, length: 3},
+		{name: "case sensitive", list: "select", text: "SELECT", length: -1},
+		{name: "case insensitive", list: "select", opts: regexp2.IgnoreCase, text: "SeLeCt", length: 6},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			w, err := newWords(tc.list, tc.prefix, tc.suffix, tc.opts)
+			if err != nil {
+				t.Fatalf("Making the words failed: %v", err)
+			}
+
+			m, err := w.match([]rune(tc.text), tc.pos)
+			assert.Nil(t, err)
+			if tc.length < 0 {
+				assert.Nil(t, m)
+				return
+			}
+			if assert.NotNil(t, m) {
+				assert.Equal(t, tc.length, m.length())
+			}
+		})
+	}
+}
+
+func TestWordsRule(t *testing.T) {
+	assert := assert.New(t)
+
+	def := `<lexer>
+  <config>
+    <name>Words</name>
+  </config>
+  <variables>
+    <var name="end">\b</var>
+  </variables>
+  <rules>
+    <state name="root">
+      <rule>
+        <words suffix="{{end}}">
+          if else
+          while
+        </words>
+        <token type="Keyword"/>
+      </rule>
+      <rule>
+        <words suffix="\b">begin</words>
+        <bygroups>
+          <token type="NameDecorator"/>
+        </bygroups>
+        <push state="block"/>
+      </rule>
+      <rule pattern="\w+">
+        <token type="Name"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+    <state name="block">
+      <rule>
+        <words>end</words>
+        <token type="Keyword"/>
+        <pop depth="1"/>
+      </rule>
+      <rule pattern="\s+">
+        <token type="Text"/>
+      </rule>
+    </state>
+  </rules>
+</lexer>`
+
+	lex, err := NewLexerFromXMLStrict(strings.NewReader(def))
+	if err != nil {
+		t.Fatalf("Loading the lexer failed: %v", err)
+	}
+	assert.Empty(ValidateLexer(lex))
+
+	tokens, err := tokenize(lex.Tokenise([]rune("iffy if begin end")))
+	if err != nil {
+		t.Fatalf("Tokenizing returned error: %v\n", err)
+	}
+	expected := []Token{
+		{Type: Name, Value: []rune("iffy"), Start: 0, End: 4},
+		{Type: Text, Value: []rune(" "), Start: 4, End: 5},
+		{Type: Keyword, Value: []rune("if"), Start: 5, End: 7},
+		{Type: Text, Value: []rune(" "), Start: 7, End: 8},
+		// The group of the words is the word.
+		{Type: NameDecorator, Value: []rune("begin"), Start: 8, End: 13},
+		{Type: Text, Value: []rune(" "), Start: 13, End: 14},
+		{Type: Keyword, Value: []rune("end"), Start: 14, End: 17},
+	}
+	assert.Equal(expected, tokens)
+
+	// A words element must have words.
+	bad := strings.Replace(def, `<words>end</words>`, `<words> </words>`, 1)
+	_, err = NewLexerFromXML(strings.NewReader(bad))
+	assert.NotNil(err)
+}